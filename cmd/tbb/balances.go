@@ -29,7 +29,7 @@ func balancesListCmd() *cobra.Command {
 		Use:   "list",
 		Short: "Lists all balances",
 		Run: func(cmd *cobra.Command, args []string) {
-			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd))
+			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd), getDBBackendFromCmd(cmd))
 			if err != nil {
 				fmt.Fprintln(os.Stderr, err)
 				os.Exit(1)
@@ -47,6 +47,7 @@ func balancesListCmd() *cobra.Command {
 	}
 
 	addDefaultRequiredFlags(balancesListCmd)
+	addDBBackendFlag(balancesListCmd)
 
 	return balancesListCmd
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const configFileName = "config.json"
+
+// nodeConfig is the node config file content, flags take precedence over it
+type nodeConfig struct {
+	// Bootstrap are "[account@]ip:port" addresses of the peers the node joins the network by
+	Bootstrap []string `json:"bootstrap"`
+	// Seed runs the node without any bootstrap peer
+	Seed bool `json:"seed"`
+}
+
+func getConfigFilePath(dataDir string) string {
+	return filepath.Join(dataDir, configFileName)
+}
+
+// loadNodeConfig reads the config file, a missing default config file is an empty config
+func loadNodeConfig(path string, isDefault bool) (nodeConfig, error) {
+	var config nodeConfig
+
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && isDefault {
+		return config, nil
+	}
+	if err != nil {
+		return config, err
+	}
+
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return config, fmt.Errorf("invalid config file '%s'. %w", path, err)
+	}
+
+	return config, nil
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"the-blockchain-bar/database"
+)
+
+func dbCmd() *cobra.Command {
+	var dbCmd = &cobra.Command{
+		Use:   "db",
+		Short: "Manages the blockchain database (convert, snapshot...)",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+
+	dbCmd.AddCommand(dbConvertCmd())
+	dbCmd.AddCommand(dbSnapshotCmd())
+
+	return dbCmd
+}
+
+func dbConvertCmd() *cobra.Command {
+	var dbConvertCmd = &cobra.Command{
+		Use:   "convert",
+		Short: "Converts the block.db file into the db backend",
+		Run: func(cmd *cobra.Command, args []string) {
+			backend := getDBBackendFromCmd(cmd)
+
+			err := database.ConvertBlocksDb(getDataDirFromCmd(cmd), backend)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("block.db converted into the '%s' db backend\n", backend)
+		},
+	}
+
+	addDefaultRequiredFlags(dbConvertCmd)
+	addDBBackendFlag(dbConvertCmd)
+
+	return dbConvertCmd
+}
+
+func dbSnapshotCmd() *cobra.Command {
+	var dbSnapshotCmd = &cobra.Command{
+		Use:   "snapshot",
+		Short: "Writes a state snapshot to speed up the next node startup",
+		Run: func(cmd *cobra.Command, args []string) {
+			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd), getDBBackendFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			defer state.Close()
+
+			snapshot, err := state.WriteSnapshot()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("State snapshot of block '%d' %x written\n", snapshot.Height, snapshot.Hash)
+		},
+	}
+
+	addDefaultRequiredFlags(dbSnapshotCmd)
+	addDBBackendFlag(dbSnapshotCmd)
+
+	return dbSnapshotCmd
+}
@@ -7,14 +7,30 @@ import (
 
 	"github.com/spf13/cobra"
 
+	"the-blockchain-bar/database"
 	"the-blockchain-bar/fs"
+	"the-blockchain-bar/logger"
+	"the-blockchain-bar/node"
 )
 
 const (
-	flagDataDir = "datadir"
-	flagIP      = "ip"
-	flagPort    = "port"
-	flagMiner   = "miner"
+	flagDataDir   = "datadir"
+	flagIP        = "ip"
+	flagPort      = "port"
+	flagMiner     = "miner"
+	flagKey       = "key"
+	flagDBBackend = "db-backend"
+	flagLight     = "light"
+	flagBootstrap = "bootstrap"
+	flagSeed      = "seed"
+	flagConfig    = "config"
+	flagLogLevel  = "log-level"
+	flagLogFormat = "log-format"
+	flagMetrics   = "metrics-port"
+
+	// andrejAccount is the genesis account owning the bootstrap node
+	andrejAccount   = "0x09ee50f2f37fcba1845de6fe5c762e83e65e755c"
+	babayagaAccount = "0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a"
 )
 
 func main() {
@@ -28,8 +44,10 @@ func main() {
 
 	tbbCmd.AddCommand(versionCmd)
 	tbbCmd.AddCommand(balancesCmd())
+	tbbCmd.AddCommand(walletCmd())
 	tbbCmd.AddCommand(runCmd())
 	tbbCmd.AddCommand(migrateCmd())
+	tbbCmd.AddCommand(dbCmd())
 
 	err := tbbCmd.Execute()
 	if err != nil {
@@ -48,6 +66,117 @@ func getDataDirFromCmd(cmd *cobra.Command) string {
 	return fs.ExpandPath(dataDir)
 }
 
+func addDBBackendFlag(cmd *cobra.Command) {
+	cmd.Flags().String(
+		flagDBBackend,
+		database.DefaultBackend,
+		fmt.Sprintf("storage backend of the blocks, '%s' or '%s'", database.BackendJSONLines, database.BackendBolt),
+	)
+}
+
+func getDBBackendFromCmd(cmd *cobra.Command) string {
+	backend, _ := cmd.Flags().GetString(flagDBBackend)
+	return backend
+}
+
+func addBootstrapFlags(cmd *cobra.Command) {
+	cmd.Flags().StringArray(
+		flagBootstrap,
+		nil,
+		"'[account@]ip:port' of a peer to join the network by, repeat the flag for more peers",
+	)
+	cmd.Flags().Bool(
+		flagSeed,
+		false,
+		"runs the node without bootstrap peers, waiting for other nodes to peer with it",
+	)
+	cmd.Flags().String(
+		flagConfig,
+		"",
+		fmt.Sprintf("path to the node config file, defaults to '%s' in the data dir", configFileName),
+	)
+}
+
+func addLogFlags(cmd *cobra.Command) {
+	cmd.Flags().String(
+		flagLogLevel,
+		logger.LevelInfo,
+		fmt.Sprintf("minimal level of the logged records, '%s', '%s', '%s' or '%s'", logger.LevelDebug, logger.LevelInfo, logger.LevelWarn, logger.LevelError),
+	)
+	cmd.Flags().String(
+		flagLogFormat,
+		logger.FormatText,
+		fmt.Sprintf("format of the logged records, '%s' or '%s'", logger.FormatText, logger.FormatJSON),
+	)
+}
+
+// getLoggerFromCmd return logger writing to stderr by the --log-level and --log-format flags,
+// the logger is also set as default for the code logging outside of the node
+func getLoggerFromCmd(cmd *cobra.Command) (logger.Logger, error) {
+	level, _ := cmd.Flags().GetString(flagLogLevel)
+	format, _ := cmd.Flags().GetString(flagLogFormat)
+
+	log, err := logger.New(os.Stderr, level, format)
+	if err != nil {
+		return nil, err
+	}
+	logger.SetDefault(log)
+
+	return log, nil
+}
+
+// getBootstrapsFromCmd return bootstrap peers of the --bootstrap flags or of the config file,
+// no peers for a seed node and the andrej's node when none are configured
+func getBootstrapsFromCmd(cmd *cobra.Command) ([]node.PeerNode, error) {
+	addrs, _ := cmd.Flags().GetStringArray(flagBootstrap)
+	isSeed, _ := cmd.Flags().GetBool(flagSeed)
+	configPath, _ := cmd.Flags().GetString(flagConfig)
+
+	isDefaultConfig := configPath == ""
+	if isDefaultConfig {
+		configPath = getConfigFilePath(getDataDirFromCmd(cmd))
+	}
+
+	config, err := loadNodeConfig(fs.ExpandPath(configPath), isDefaultConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if isSeed && len(addrs) > 0 {
+		return nil, fmt.Errorf("--%s can't be combined with --%s", flagSeed, flagBootstrap)
+	}
+
+	if len(addrs) == 0 {
+		if isSeed || config.Seed {
+			return nil, nil
+		}
+
+		addrs = config.Bootstrap
+	}
+
+	if len(addrs) == 0 {
+		return []node.PeerNode{node.NewPeerNode(
+			node.DefaultIP,
+			node.DefaultHTTPPort,
+			true,
+			database.NewAccount(andrejAccount),
+			false,
+		)}, nil
+	}
+
+	bootstraps := make([]node.PeerNode, 0, len(addrs))
+	for _, addr := range addrs {
+		peer, err := node.ParsePeerNode(addr)
+		if err != nil {
+			return nil, err
+		}
+
+		bootstraps = append(bootstraps, peer)
+	}
+
+	return bootstraps, nil
+}
+
 func incorrectUsageErr() error {
 	return errors.New("incorrect usage")
 }
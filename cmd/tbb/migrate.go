@@ -3,11 +3,13 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"the-blockchain-bar/database"
 	"the-blockchain-bar/node"
 
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/spf13/cobra"
 )
 
@@ -19,28 +21,66 @@ var migrateCmd = func() *cobra.Command {
 			miner, _ := cmd.Flags().GetString(flagMiner)
 			ip, _ := cmd.Flags().GetString(flagIP)
 			port, _ := cmd.Flags().GetUint64(flagPort)
+			keyPath, _ := cmd.Flags().GetString(flagKey)
 
-			peer := node.NewPeerNode(
-				"127.0.0.1",
-				8080,
-				true,
-				database.NewAccount("andrej"),
-				false,
-			)
+			privKey, err := crypto.LoadECDSA(keyPath)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			andrej := crypto.PubkeyToAddress(privKey.PublicKey)
+			babayaga := database.NewAccount(babayagaAccount)
+
+			_, err = getLoggerFromCmd(cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			bootstraps, err := getBootstrapsFromCmd(cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			self := node.NewPeerNode(ip, port, false, database.NewAccount(miner), true)
 
 			n := node.New(
 				getDataDirFromCmd(cmd),
+				getDBBackendFromCmd(cmd),
 				ip,
 				port,
 				database.NewAccount(miner),
-				peer,
+				bootstraps,
 			)
 
-			n.AddPendingTX(database.NewTx("andrej", "andrej", 3, ""), peer)
-			n.AddPendingTX(database.NewTx("andrej", "babayaga", 2000, ""), peer)
-			n.AddPendingTX(database.NewTx("babayaga", "andrej", 1, ""), peer)
-			n.AddPendingTX(database.NewTx("babayaga", "caesar", 1000, ""), peer)
-			n.AddPendingTX(database.NewTx("babayaga", "andrej", 50, ""), peer)
+			state, err := database.NewStateFromDisk(getDataDirFromCmd(cmd), getDBBackendFromCmd(cmd))
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			nonce := state.GetNextAccountNonce(andrej)
+			state.Close()
+
+			txs := []database.Tx{
+				database.NewTx(andrej, andrej, 3, nonce, ""),
+				database.NewTx(andrej, babayaga, 2000, nonce+1, ""),
+			}
+
+			for _, tx := range txs {
+				signedTx, err := database.SignTx(tx, privKey)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+
+				err = n.AddPendingTX(signedTx, self)
+				if err != nil {
+					fmt.Fprintln(os.Stderr, err)
+					os.Exit(1)
+				}
+			}
 
 			ctx, closeNode := context.WithTimeout(context.Background(), time.Minute*15)
 
@@ -58,7 +98,7 @@ var migrateCmd = func() *cobra.Command {
 				}
 			}()
 
-			err := n.Run(ctx)
+			err = n.Run(ctx)
 			if err != nil {
 				fmt.Println(err)
 			}
@@ -67,6 +107,11 @@ var migrateCmd = func() *cobra.Command {
 	}
 
 	addDefaultRequiredFlags(migrateCmd)
+	addDBBackendFlag(migrateCmd)
+	addBootstrapFlags(migrateCmd)
+	addLogFlags(migrateCmd)
+	migrateCmd.Flags().String(flagKey, "", "path to the hex encoded private key of the account signing the migration TXs")
+	migrateCmd.MarkFlagRequired(flagKey)
 	migrateCmd.Flags().String(flagMiner, node.DefaultMiner, "miner account of this node to receive block rewards")
 	migrateCmd.Flags().String(flagIP, node.DefaultIP, "expose IP for communication with peers")
 	migrateCmd.Flags().Uint64(flagPort, node.DefaultHTTPPort, "exposed HTTP port for communication with peers")
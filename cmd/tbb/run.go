@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/spf13/cobra"
 
@@ -19,25 +21,43 @@ func runCmd() *cobra.Command {
 			miner, _ := cmd.Flags().GetString(flagMiner)
 			ip, _ := cmd.Flags().GetString(flagIP)
 			port, _ := cmd.Flags().GetUint64(flagPort)
+			isLight, _ := cmd.Flags().GetBool(flagLight)
+			metricsPort, _ := cmd.Flags().GetUint64(flagMetrics)
 			fmt.Println("Launching TBB Node and its HTTP API...")
 
-			bootstrap := node.NewPeerNode(
-				"127.0.0.1",
-				8080,
-				true,
-				database.NewAccount("andrej"),
-				false,
-			)
+			log, err := getLoggerFromCmd(cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			bootstraps, err := getBootstrapsFromCmd(cmd)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			var n *node.Node
+			if isLight {
+				n = node.NewLight(getDataDirFromCmd(cmd), ip, port, bootstraps)
+			} else {
+				n = node.New(
+					getDataDirFromCmd(cmd),
+					getDBBackendFromCmd(cmd),
+					ip,
+					port,
+					database.NewAccount(miner),
+					bootstraps,
+				)
+			}
+			n.SetLogger(log)
+			n.SetMetricsPort(metricsPort)
 
-			n := node.New(
-				getDataDirFromCmd(cmd),
-				ip,
-				port,
-				database.NewAccount(miner),
-				bootstrap,
-			)
+			// interrupting the node shuts it down gracefully
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
 
-			err := n.Run(context.Background())
+			err = n.Run(ctx)
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
@@ -46,6 +66,9 @@ func runCmd() *cobra.Command {
 	}
 
 	addDefaultRequiredFlags(runCmd)
+	addDBBackendFlag(runCmd)
+	addBootstrapFlags(runCmd)
+	addLogFlags(runCmd)
 	runCmd.Flags().String(
 		flagMiner,
 		node.DefaultMiner,
@@ -55,11 +78,21 @@ func runCmd() *cobra.Command {
 		"",
 		"exposedIP for communication with peers",
 	)
+	runCmd.Flags().Bool(
+		flagLight,
+		false,
+		"syncs only block headers and verifies balances and TXs fetched from full peers with proofs",
+	)
 	runCmd.Flags().Uint64(
 		flagPort,
 		node.DefaultHTTPPort,
 		"exposed HTTP port for communication with peers",
 	)
+	runCmd.Flags().Uint64(
+		flagMetrics,
+		0,
+		"serves the Prometheus /metrics on this port instead of the HTTP API port",
+	)
 
 	return runCmd
 }
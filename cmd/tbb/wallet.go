@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/spf13/cobra"
+	"golang.org/x/term"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/wallet"
+)
+
+const flagKeystoreAccount = "account"
+
+func walletCmd() *cobra.Command {
+	var walletCmd = &cobra.Command{
+		Use:   "wallet",
+		Short: "Manages blockchain accounts and keys.",
+		PreRunE: func(cmd *cobra.Command, args []string) error {
+			return incorrectUsageErr()
+		},
+		Run: func(cmd *cobra.Command, args []string) {},
+	}
+
+	walletCmd.AddCommand(walletNewAccountCmd())
+	walletCmd.AddCommand(walletListCmd())
+	walletCmd.AddCommand(walletPrintPrivKeyCmd())
+
+	return walletCmd
+}
+
+func walletNewAccountCmd() *cobra.Command {
+	var walletNewAccountCmd = &cobra.Command{
+		Use:   "new-account",
+		Short: "Creates a new account with a new set of a elliptic-curve Private + Public keys.",
+		Run: func(cmd *cobra.Command, args []string) {
+			password, err := getPassPhrase("Please enter a password to encrypt the new wallet:", true)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			acc, err := wallet.NewKeystoreAccount(getDataDirFromCmd(cmd), password)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("New account created: %s\n", acc.Hex())
+			fmt.Printf("Saved in: %s\n", wallet.GetKeystoreDirPath(getDataDirFromCmd(cmd)))
+		},
+	}
+
+	addDefaultRequiredFlags(walletNewAccountCmd)
+
+	return walletNewAccountCmd
+}
+
+func walletListCmd() *cobra.Command {
+	var walletListCmd = &cobra.Command{
+		Use:   "list",
+		Short: "Lists all accounts stored in the keystore.",
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, acc := range wallet.ListAccounts(getDataDirFromCmd(cmd)) {
+				fmt.Println(acc.Hex())
+			}
+		},
+	}
+
+	addDefaultRequiredFlags(walletListCmd)
+
+	return walletListCmd
+}
+
+func walletPrintPrivKeyCmd() *cobra.Command {
+	var walletPrintPrivKeyCmd = &cobra.Command{
+		Use:   "print-pk",
+		Short: "Unlocks keystore file and prints the Private + Public keys.",
+		Run: func(cmd *cobra.Command, args []string) {
+			accRaw, _ := cmd.Flags().GetString(flagKeystoreAccount)
+
+			password, err := getPassPhrase("Please enter a password to decrypt the wallet:", false)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			privKey, err := wallet.UnlockKey(getDataDirFromCmd(cmd), database.NewAccount(accRaw), password)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+
+			fmt.Printf("Private key: %s\n", hexutil.Encode(crypto.FromECDSA(privKey))[2:])
+			fmt.Printf("Public key: %s\n", hexutil.Encode(crypto.FromECDSAPub(&privKey.PublicKey)))
+		},
+	}
+
+	addDefaultRequiredFlags(walletPrintPrivKeyCmd)
+	walletPrintPrivKeyCmd.Flags().String(flagKeystoreAccount, "", "account address of the key to unlock")
+	walletPrintPrivKeyCmd.MarkFlagRequired(flagKeystoreAccount)
+
+	return walletPrintPrivKeyCmd
+}
+
+// getPassPhrase prompts for the password without echoing it
+// when stdin is a terminal, otherwise it reads the first line
+func getPassPhrase(prompt string, confirmation bool) (string, error) {
+	fmt.Println(prompt)
+
+	password, err := readPassword()
+	if err != nil {
+		return "", err
+	}
+
+	if confirmation {
+		fmt.Println("Repeat password:")
+
+		confirm, err := readPassword()
+		if err != nil {
+			return "", err
+		}
+
+		if password != confirm {
+			return "", errors.New("passwords do not match")
+		}
+	}
+
+	return password, nil
+}
+
+var stdinReader = bufio.NewReader(os.Stdin)
+
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		password, err := term.ReadPassword(fd)
+		fmt.Println()
+		return string(password), err
+	}
+
+	line, err := stdinReader.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -4,11 +4,11 @@ import (
 	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
+	"math/big"
 )
 
-//BlockReward is reward for miner
+// BlockReward is reward for miner
 const BlockReward = 100
 
 // Hash is type for hashed db
@@ -44,11 +44,16 @@ func (h Hash) IsEmpty() bool {
 
 // BlockHeader is block metadata
 type BlockHeader struct {
-	Parent Hash    `json:"parent"` // parent block reference
-	Number uint64  `json:"number"`
-	Nonce  uint32  `json:"nonce"`
-	Time   uint64  `json:"time"`
-	Miner  Account `json:"miner"`
+	Parent     Hash    `json:"parent"` // parent block reference
+	Number     uint64  `json:"number"`
+	Nonce      uint32  `json:"nonce"`
+	Time       uint64  `json:"time"`
+	Difficulty uint64  `json:"difficulty"` // expected number of hashes to mine the block
+	Miner      Account `json:"miner"`
+	TXRoot     Hash    `json:"tx_root"`    // Merkle root of the payload TX hashes
+	StateRoot  Hash    `json:"state_root"` // Merkle root of the accounts after the block
+	// Version is the binary encoding the header is hashed with, zero is the current version
+	Version byte `json:"version,omitempty"`
 }
 
 // BlockFS store unique hash from a block
@@ -60,37 +65,74 @@ type BlockFS struct {
 // Block contains batches of transactions and hashed
 type Block struct {
 	Header BlockHeader `json:"header"`
-	TXs    []Tx        `json:"payload"` // new transactions only (payload)
+	TXs    []SignedTx  `json:"payload"` // new transactions only (payload)
 }
 
-// NewBlock will return new block
-func NewBlock(parent Hash, number uint64, nonce uint32, time uint64, miner Account, txs []Tx) Block {
+// NewBlock will return new block committing to the TXs,
+// a TX can't be included twice
+func NewBlock(parent Hash, number uint64, nonce uint32, time uint64, difficulty uint64, miner Account, stateRoot Hash, txs []SignedTx) (Block, error) {
+	txRoot, err := TXsMerkleRoot(txs)
+	if err != nil {
+		return Block{}, err
+	}
+
 	return Block{
 		Header: BlockHeader{
-			Parent: parent,
-			Number: number,
-			Nonce:  nonce,
-			Miner:  miner,
-			Time:   time,
+			Parent:     parent,
+			Number:     number,
+			Nonce:      nonce,
+			Miner:      miner,
+			Time:       time,
+			Difficulty: difficulty,
+			TXRoot:     txRoot,
+			StateRoot:  stateRoot,
 		},
 		TXs: txs,
-	}
+	}, nil
 }
 
-// Hash will return hash from a block
+// Hash will return hash from a block header,
+// the TXs are committed to by the header TX root
 func (b Block) Hash() (Hash, error) {
-	blockJSON, err := json.Marshal(b)
+	return b.Header.Hash()
+}
+
+// Hash return hash of the binary encoded header
+func (h BlockHeader) Hash() (Hash, error) {
+	encoded, err := h.Encode()
 	if err != nil {
 		return Hash{}, err
 	}
 
-	return sha256.Sum256(blockJSON), nil
+	return sha256.Sum256(encoded), nil
 }
 
-// IsBlockHashValid check is block hash valid
-func IsBlockHashValid(hash Hash) bool {
-	return fmt.Sprintf("%x", hash[0]) == "0" &&
-		fmt.Sprintf("%x", hash[1]) == "0" &&
-		fmt.Sprintf("%x", hash[2]) == "0" &&
-		fmt.Sprintf("%x", hash[3]) != "0"
+// Fees return sum of the fees paid by block transactions
+func (b Block) Fees() (uint, error) {
+	var fees uint
+	for _, tx := range b.TXs {
+		var ok bool
+		fees, ok = addAmounts(fees, tx.Fee)
+		if !ok {
+			return 0, fmt.Errorf("block '%d' fees overflow", b.Header.Number)
+		}
+	}
+
+	return fees, nil
+}
+
+// IsBlockHashValid check if the block hash meets the difficulty,
+// the hash as a number must not exceed the maximal hash divided by difficulty
+func IsBlockHashValid(hash Hash, difficulty uint64) bool {
+	if difficulty == 0 {
+		return false
+	}
+
+	return new(big.Int).SetBytes(hash[:]).Cmp(difficultyToTarget(difficulty)) <= 0
+}
+
+func difficultyToTarget(difficulty uint64) *big.Int {
+	maxTarget := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+	return maxTarget.Div(maxTarget, new(big.Int).SetUint64(difficulty))
 }
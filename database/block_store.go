@@ -0,0 +1,761 @@
+package database
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"the-blockchain-bar/logger"
+)
+
+// BlockStore persists blocks, canonical and side branches, and looks them up
+// by hash, canonical height or canonical TX hash without scanning the chain
+type BlockStore interface {
+	// Append persists a new block
+	Append(hash Hash, b Block) error
+	// Block return a stored block by its hash
+	Block(hash Hash) (Block, error)
+	// SetCanonical marks a stored block as the canonical block at its height
+	SetCanonical(number uint64, hash Hash) error
+	// TruncateCanonical drops canonical blocks from the height up
+	TruncateCanonical(number uint64) error
+	// CanonicalBlock return the canonical block at the height
+	CanonicalBlock(number uint64) (Block, error)
+	// CanonicalBlocks return canonical blocks in heights [from, to)
+	CanonicalBlocks(from, to uint64) ([]Block, error)
+	// CanonicalHashes return hashes of the canonical blocks in heights [from, to) without reading the blocks
+	CanonicalHashes(from, to uint64) ([]Hash, error)
+	// ForEach iterates over stored blocks in the order they were appended until fn returns false
+	ForEach(fn func(hash Hash, b Block) bool) error
+	// ForEachAfter iterates over blocks appended after the stored block until fn returns false
+	ForEachAfter(hash Hash, fn func(hash Hash, b Block) bool) error
+	// TXBlockHash return hash of the canonical block which includes the TX
+	TXBlockHash(txHash Hash) (Hash, error)
+	Close() error
+}
+
+const (
+	// BackendJSONLines stores blocks as JSON lines in the block.db file
+	BackendJSONLines = "jsonl"
+	// BackendBolt stores blocks in an embedded bbolt key value db
+	BackendBolt = "bolt"
+	// DefaultBackend is the block store backend used when none is selected
+	DefaultBackend = BackendJSONLines
+)
+
+// BalancesStore is a BlockStore which also keeps account balances and nonces
+// after a canonical block, so the state loads without replaying the blocks before it
+type BalancesStore interface {
+	BlockStore
+	// PutBalances replaces the stored account balances and nonces with the snapshot
+	PutBalances(snapshot Snapshot) error
+	// Balances return the stored account balances and nonces, false is returned when none are stored
+	Balances() (Snapshot, bool, error)
+}
+
+// OpenBlockStore opens the block store of the backend in the data dir
+func OpenBlockStore(dataDir string, backend string) (BlockStore, error) {
+	return OpenBlockStoreWithLogger(dataDir, backend, logger.Default())
+}
+
+// OpenBlockStoreWithLogger opens the block store of the backend in the data dir, logging into the logger
+func OpenBlockStoreWithLogger(dataDir string, backend string, log logger.Logger) (BlockStore, error) {
+	switch backend {
+	case BackendJSONLines:
+		return NewJSONLinesBlockStoreWithLogger(dataDir, log)
+	case BackendBolt:
+		return NewBoltBlockStore(dataDir)
+	default:
+		return nil, fmt.Errorf("unknown db backend '%s'", backend)
+	}
+}
+
+// ConvertBlocksDb copies blocks of the block.db file into an empty store of the backend
+// and builds its indexes by replaying the blocks
+func ConvertBlocksDb(dataDir string, backend string) error {
+	if backend == BackendJSONLines {
+		return fmt.Errorf("block.db is already stored by the '%s' backend", backend)
+	}
+
+	err := initDataDirIfNotExists(dataDir)
+	if err != nil {
+		return err
+	}
+
+	from, err := NewJSONLinesBlockStore(dataDir)
+	if err != nil {
+		return err
+	}
+	defer from.Close()
+
+	to, err := OpenBlockStore(dataDir, backend)
+	if err != nil {
+		return err
+	}
+
+	isEmpty := true
+	err = to.ForEach(func(_ Hash, _ Block) bool {
+		isEmpty = false
+		return false
+	})
+	if err == nil && !isEmpty {
+		err = fmt.Errorf("'%s' db already contains blocks", backend)
+	}
+	if err != nil {
+		to.Close()
+		return err
+	}
+
+	var appendErr error
+	err = from.ForEach(func(hash Hash, b Block) bool {
+		appendErr = to.Append(hash, b)
+		return appendErr == nil
+	})
+	if err == nil {
+		err = appendErr
+	}
+
+	closeErr := to.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	state, err := NewStateFromDisk(dataDir, backend)
+	if err != nil {
+		return err
+	}
+
+	return state.Close()
+}
+
+const (
+	// hash index record is block hash, offset and length in the blocks db
+	hashIndexRecordSize = 32 + 8 + 4
+	// height index record is offset and length in the blocks db
+	heightIndexRecordSize = 8 + 4
+)
+
+// blockRecordFormat is the block.db record format whose checksum is CRC-32
+// of the block hash followed by the encoded block.
+// Legacy records without a format checksum only the encoded block.
+const blockRecordFormat = 1
+
+// blockRecord is a block.db line with the binary encoded block and its checksum
+type blockRecord struct {
+	Key      Hash    `json:"hash"`
+	Value    []byte  `json:"block"`
+	Checksum *uint32 `json:"checksum"`
+	Format   uint8   `json:"format,omitempty"`
+}
+
+// newBlockRecord return a record of the current format
+func newBlockRecord(hash Hash, encoded []byte) blockRecord {
+	checksum := blockRecordChecksum(hash, encoded)
+
+	return blockRecord{hash, encoded, &checksum, blockRecordFormat}
+}
+
+func blockRecordChecksum(hash Hash, encoded []byte) uint32 {
+	return crc32.Update(crc32.ChecksumIEEE(hash[:]), crc32.IEEETable, encoded)
+}
+
+type blockPosition struct {
+	offset int64
+	length uint32
+}
+
+// jsonLinesBlockStore keeps blocks as JSON lines in the block.db file,
+// indexed by hash and canonical height in two fixed size record files.
+// block.db is fsynced after every appended block, the indexes are not
+// as they're rebuilt from block.db when behind it.
+type jsonLinesBlockStore struct {
+	dbFile          *os.File
+	dbSize          int64
+	hashIndexFile   *os.File
+	heightIndexFile *os.File
+	positions       map[Hash]blockPosition
+
+	// txBlocks indexes canonical TXs by hash to the block including them,
+	// it's built from the canonical blocks on the first TX lookup
+	txBlocks   map[Hash]Hash
+	txBlocksMu sync.Mutex
+}
+
+// NewJSONLinesBlockStore opens the block.db in the data dir and its indexes,
+// a trailing partially written record is truncated and the hash index
+// is rebuilt for blocks appended without being indexed
+func NewJSONLinesBlockStore(dataDir string) (BlockStore, error) {
+	return NewJSONLinesBlockStoreWithLogger(dataDir, logger.Default())
+}
+
+// NewJSONLinesBlockStoreWithLogger opens the block.db in the data dir and its indexes,
+// logging the truncated partially written record into the logger
+func NewJSONLinesBlockStoreWithLogger(dataDir string, log logger.Logger) (BlockStore, error) {
+	dbFile, err := os.OpenFile(getBlocksDbFilePath(dataDir), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	hashIndexFile, err := os.OpenFile(getBlocksHashIndexFilePath(dataDir), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		dbFile.Close()
+		return nil, err
+	}
+
+	heightIndexFile, err := os.OpenFile(getBlocksHeightIndexFilePath(dataDir), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		dbFile.Close()
+		hashIndexFile.Close()
+		return nil, err
+	}
+
+	store := &jsonLinesBlockStore{
+		dbFile:          dbFile,
+		hashIndexFile:   hashIndexFile,
+		heightIndexFile: heightIndexFile,
+		positions:       make(map[Hash]blockPosition),
+	}
+
+	err = truncateTornRecord(dbFile, "block.db", log)
+	if err == nil {
+		err = store.loadHashIndex()
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+func (js *jsonLinesBlockStore) Append(hash Hash, b Block) error {
+	encoded, err := b.Encode()
+	if err != nil {
+		return err
+	}
+
+	recordJSON, err := json.Marshal(newBlockRecord(hash, encoded))
+	if err != nil {
+		return err
+	}
+
+	_, err = js.dbFile.Write(append(recordJSON, '\n'))
+	if err == nil {
+		err = js.dbFile.Sync()
+	}
+	if err != nil {
+		// drop the partially written record so next appends start on a new line
+		js.dbFile.Truncate(js.dbSize)
+		return err
+	}
+
+	pos := blockPosition{js.dbSize, uint32(len(recordJSON))}
+	js.dbSize += int64(len(recordJSON)) + 1
+
+	return js.indexHash(hash, pos)
+}
+
+func (js *jsonLinesBlockStore) Block(hash Hash) (Block, error) {
+	pos, isKnown := js.positions[hash]
+	if !isKnown {
+		return Block{}, fmt.Errorf("block '%x' not found", hash)
+	}
+
+	return js.readBlock(pos)
+}
+
+// SetCanonical also indexes the block TXs by their hash once the TX index is built
+func (js *jsonLinesBlockStore) SetCanonical(number uint64, hash Hash) error {
+	pos, isKnown := js.positions[hash]
+	if !isKnown {
+		return fmt.Errorf("block '%x' not found", hash)
+	}
+
+	js.txBlocksMu.Lock()
+	defer js.txBlocksMu.Unlock()
+
+	err := js.unindexTXs(number, number+1)
+	if err != nil {
+		return err
+	}
+
+	record := make([]byte, heightIndexRecordSize)
+	binary.BigEndian.PutUint64(record[0:8], uint64(pos.offset))
+	binary.BigEndian.PutUint32(record[8:12], pos.length)
+
+	_, err = js.heightIndexFile.WriteAt(record, int64(number)*heightIndexRecordSize)
+	if err != nil {
+		return err
+	}
+
+	return js.indexTXs(hash, pos)
+}
+
+func (js *jsonLinesBlockStore) TruncateCanonical(number uint64) error {
+	js.txBlocksMu.Lock()
+	defer js.txBlocksMu.Unlock()
+
+	count, err := js.canonicalCount()
+	if err != nil {
+		return err
+	}
+
+	err = js.unindexTXs(number, count)
+	if err != nil {
+		return err
+	}
+
+	return js.heightIndexFile.Truncate(int64(number) * heightIndexRecordSize)
+}
+
+func (js *jsonLinesBlockStore) CanonicalBlock(number uint64) (Block, error) {
+	pos, err := js.canonicalPosition(number)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return js.readBlock(pos)
+}
+
+func (js *jsonLinesBlockStore) CanonicalBlocks(from, to uint64) ([]Block, error) {
+	blocks := make([]Block, 0)
+	for number := from; number < to; number++ {
+		b, err := js.CanonicalBlock(number)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, b)
+	}
+
+	return blocks, nil
+}
+
+// CanonicalHashes maps the height index positions back to hashes with the in memory hash index
+func (js *jsonLinesBlockStore) CanonicalHashes(from, to uint64) ([]Hash, error) {
+	hashes := make([]Hash, 0)
+	if from >= to {
+		return hashes, nil
+	}
+
+	offsetHashes := make(map[int64]Hash, len(js.positions))
+	for hash, pos := range js.positions {
+		offsetHashes[pos.offset] = hash
+	}
+
+	records := make([]byte, (to-from)*heightIndexRecordSize)
+	n, err := js.heightIndexFile.ReadAt(records, int64(from)*heightIndexRecordSize)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	for number := from; number < to; number++ {
+		i := (number - from) * heightIndexRecordSize
+		if i+heightIndexRecordSize > uint64(n) {
+			return nil, fmt.Errorf("canonical block '%d' not found", number)
+		}
+
+		hash, isKnown := offsetHashes[int64(binary.BigEndian.Uint64(records[i:i+8]))]
+		if !isKnown {
+			return nil, fmt.Errorf("canonical block '%d' not found", number)
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+// TXBlockHash looks the TX up in the in memory index of canonical TXs,
+// the index is built from the canonical blocks on the first lookup
+func (js *jsonLinesBlockStore) TXBlockHash(txHash Hash) (Hash, error) {
+	js.txBlocksMu.Lock()
+	defer js.txBlocksMu.Unlock()
+
+	if js.txBlocks == nil {
+		err := js.loadTXIndex()
+		if err != nil {
+			return Hash{}, err
+		}
+	}
+
+	blockHash, isKnown := js.txBlocks[txHash]
+	if !isKnown {
+		return Hash{}, fmt.Errorf("TX '%x' %w", txHash, ErrNotFound)
+	}
+
+	return blockHash, nil
+}
+
+func (js *jsonLinesBlockStore) ForEach(fn func(hash Hash, b Block) bool) error {
+	return js.scan(0, func(blockFs BlockFS, _ blockPosition) bool {
+		return fn(blockFs.Key, blockFs.Value)
+	})
+}
+
+func (js *jsonLinesBlockStore) ForEachAfter(hash Hash, fn func(hash Hash, b Block) bool) error {
+	pos, isKnown := js.positions[hash]
+	if !isKnown {
+		return fmt.Errorf("block '%x' not found", hash)
+	}
+
+	return js.scan(pos.offset+int64(pos.length)+1, func(blockFs BlockFS, _ blockPosition) bool {
+		return fn(blockFs.Key, blockFs.Value)
+	})
+}
+
+func (js *jsonLinesBlockStore) Close() error {
+	js.hashIndexFile.Close()
+	js.heightIndexFile.Close()
+
+	return js.dbFile.Close()
+}
+
+func (js *jsonLinesBlockStore) readBlock(pos blockPosition) (Block, error) {
+	recordJSON := make([]byte, pos.length)
+
+	_, err := js.dbFile.ReadAt(recordJSON, pos.offset)
+	if err != nil {
+		return Block{}, err
+	}
+
+	blockFs, err := decodeBlockRecord(recordJSON, pos)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return blockFs.Value, nil
+}
+
+// canonicalPosition return position of the canonical block at the height in block.db
+func (js *jsonLinesBlockStore) canonicalPosition(number uint64) (blockPosition, error) {
+	record := make([]byte, heightIndexRecordSize)
+
+	_, err := js.heightIndexFile.ReadAt(record, int64(number)*heightIndexRecordSize)
+	if err == io.EOF {
+		return blockPosition{}, fmt.Errorf("canonical block '%d' not found", number)
+	}
+	if err != nil {
+		return blockPosition{}, err
+	}
+
+	return blockPosition{
+		offset: int64(binary.BigEndian.Uint64(record[0:8])),
+		length: binary.BigEndian.Uint32(record[8:12]),
+	}, nil
+}
+
+// canonicalCount return how many canonical blocks the height index holds
+func (js *jsonLinesBlockStore) canonicalCount() (uint64, error) {
+	info, err := js.heightIndexFile.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(info.Size() / heightIndexRecordSize), nil
+}
+
+// loadTXIndex indexes TXs of every canonical block
+func (js *jsonLinesBlockStore) loadTXIndex() error {
+	count, err := js.canonicalCount()
+	if err != nil {
+		return err
+	}
+
+	hashes, err := js.CanonicalHashes(0, count)
+	if err != nil {
+		return err
+	}
+
+	js.txBlocks = make(map[Hash]Hash)
+	for _, hash := range hashes {
+		err = js.indexTXs(hash, js.positions[hash])
+		if err != nil {
+			js.txBlocks = nil
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexTXs indexes TXs of the canonical block once the TX index is built
+func (js *jsonLinesBlockStore) indexTXs(hash Hash, pos blockPosition) error {
+	if js.txBlocks == nil {
+		return nil
+	}
+
+	b, err := js.readBlock(pos)
+	if err != nil {
+		return err
+	}
+
+	for _, signedTx := range b.TXs {
+		txHash, err := signedTx.Hash()
+		if err != nil {
+			return err
+		}
+
+		js.txBlocks[txHash] = hash
+	}
+
+	return nil
+}
+
+// unindexTXs drops TX index of the canonical blocks in heights [from, to)
+func (js *jsonLinesBlockStore) unindexTXs(from, to uint64) error {
+	if js.txBlocks == nil {
+		return nil
+	}
+
+	count, err := js.canonicalCount()
+	if err != nil {
+		return err
+	}
+
+	if to > count {
+		to = count
+	}
+
+	for number := from; number < to; number++ {
+		pos, err := js.canonicalPosition(number)
+		if err != nil {
+			return err
+		}
+
+		b, err := js.readBlock(pos)
+		if err != nil {
+			return err
+		}
+
+		hash, err := b.Hash()
+		if err != nil {
+			return err
+		}
+
+		for _, signedTx := range b.TXs {
+			txHash, err := signedTx.Hash()
+			if err != nil {
+				return err
+			}
+
+			// the TX may be already indexed in a block of the new canonical chain
+			if js.txBlocks[txHash] == hash {
+				delete(js.txBlocks, txHash)
+			}
+		}
+	}
+
+	return nil
+}
+
+// truncateTornRecord drops a trailing record without the line end,
+// left by a crash in the middle of a JSON lines file write
+func truncateTornRecord(file *os.File, fileName string, log logger.Logger) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	size := info.Size()
+	end := size
+	chunk := make([]byte, 4096)
+	for end > 0 {
+		start := end - int64(len(chunk))
+		if start < 0 {
+			start = 0
+		}
+
+		n, err := file.ReadAt(chunk[:end-start], start)
+		if err != nil {
+			return err
+		}
+
+		i := bytes.LastIndexByte(chunk[:n], '\n')
+		if i >= 0 {
+			end = start + int64(i) + 1
+			break
+		}
+
+		end = start
+	}
+
+	if end == size {
+		return nil
+	}
+
+	log.Warn("Truncating partially written record", "file", fileName, "bytes", size-end, "offset", end)
+
+	err = file.Truncate(end)
+	if err != nil {
+		return err
+	}
+
+	return file.Sync()
+}
+
+func (js *jsonLinesBlockStore) indexHash(hash Hash, pos blockPosition) error {
+	record := make([]byte, hashIndexRecordSize)
+	copy(record[0:32], hash[:])
+	binary.BigEndian.PutUint64(record[32:40], uint64(pos.offset))
+	binary.BigEndian.PutUint32(record[40:44], pos.length)
+
+	_, err := js.hashIndexFile.Write(record)
+	if err != nil {
+		return err
+	}
+
+	js.positions[hash] = pos
+
+	return nil
+}
+
+// loadHashIndex reads the hash index into memory, dropping records
+// beyond the block.db end, and indexes blocks appended after the last record
+func (js *jsonLinesBlockStore) loadHashIndex() error {
+	info, err := js.dbFile.Stat()
+	if err != nil {
+		return err
+	}
+	js.dbSize = info.Size()
+
+	indexed := int64(0)
+	validRecords := int64(0)
+
+	reader := bufio.NewReader(js.hashIndexFile)
+	record := make([]byte, hashIndexRecordSize)
+	for {
+		_, err := io.ReadFull(reader, record)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		var hash Hash
+		copy(hash[:], record[0:32])
+		pos := blockPosition{
+			offset: int64(binary.BigEndian.Uint64(record[32:40])),
+			length: binary.BigEndian.Uint32(record[40:44]),
+		}
+
+		if pos.offset+int64(pos.length)+1 > js.dbSize {
+			break
+		}
+
+		js.positions[hash] = pos
+		indexed = pos.offset + int64(pos.length) + 1
+		validRecords++
+	}
+
+	err = js.hashIndexFile.Truncate(validRecords * hashIndexRecordSize)
+	if err != nil {
+		return err
+	}
+
+	_, err = js.hashIndexFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	var indexErr error
+	err = js.scan(indexed, func(blockFs BlockFS, pos blockPosition) bool {
+		indexErr = js.indexHash(blockFs.Key, pos)
+		return indexErr == nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return indexErr
+}
+
+// scan decodes block.db lines from the offset until fn returns false
+func (js *jsonLinesBlockStore) scan(offset int64, fn func(BlockFS, blockPosition) bool) error {
+	reader := bufio.NewReader(io.NewSectionReader(js.dbFile, offset, js.dbSize-offset))
+	var lastNumber *uint64
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		pos := blockPosition{offset, uint32(len(line) - 1)}
+		offset += int64(len(line))
+
+		if pos.length == 0 {
+			continue
+		}
+
+		blockFs, err := decodeBlockRecord(line[:pos.length], pos)
+		if err != nil {
+			if lastNumber != nil {
+				return fmt.Errorf("%s, previous record is block '%d'", err.Error(), *lastNumber)
+			}
+
+			return err
+		}
+		lastNumber = &blockFs.Value.Header.Number
+
+		if !fn(blockFs, pos) {
+			return nil
+		}
+	}
+}
+
+// decodeBlockRecord decodes a block.db line and verifies its checksum.
+// The key of a legacy record isn't checksummed and is verified against the block hash instead.
+func decodeBlockRecord(recordJSON []byte, pos blockPosition) (BlockFS, error) {
+	var record blockRecord
+	err := json.Unmarshal(recordJSON, &record)
+	if err != nil {
+		return BlockFS{}, fmt.Errorf("corrupted block.db record at offset %d. %s", pos.offset, err.Error())
+	}
+
+	b, err := DecodeBlock(record.Value)
+	if err != nil {
+		return BlockFS{}, fmt.Errorf("corrupted block.db record at offset %d. %s", pos.offset, err.Error())
+	}
+
+	if record.Checksum == nil {
+		return BlockFS{}, fmt.Errorf("corrupted block '%d' record at block.db offset %d. Missing checksum", b.Header.Number, pos.offset)
+	}
+
+	switch record.Format {
+	case blockRecordFormat:
+		if blockRecordChecksum(record.Key, record.Value) != *record.Checksum {
+			return BlockFS{}, fmt.Errorf("corrupted block '%d' record at block.db offset %d. Checksum mismatch", b.Header.Number, pos.offset)
+		}
+	case 0:
+		if crc32.ChecksumIEEE(record.Value) != *record.Checksum {
+			return BlockFS{}, fmt.Errorf("corrupted block '%d' record at block.db offset %d. Checksum mismatch", b.Header.Number, pos.offset)
+		}
+
+		hash, err := b.Hash()
+		if err != nil {
+			return BlockFS{}, err
+		}
+
+		if hash != record.Key {
+			return BlockFS{}, fmt.Errorf("corrupted block '%d' record at block.db offset %d. Hash mismatch", b.Header.Number, pos.offset)
+		}
+	default:
+		return BlockFS{}, fmt.Errorf("corrupted block '%d' record at block.db offset %d. Unknown record format %d", b.Header.Number, pos.offset, record.Format)
+	}
+
+	return BlockFS{record.Key, b}, nil
+}
@@ -0,0 +1,385 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"the-blockchain-bar/logger"
+)
+
+func TestJSONLinesBlockStore_RebuildsHashIndex(t *testing.T) {
+	dataDir, _ := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	store, err := NewJSONLinesBlockStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	miner := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	hashes := make([]Hash, 0)
+	parent := Hash{}
+	for number := uint64(0); number < 3; number++ {
+		b := newTestBlock(t, parent, number, 0, number, 1, miner, Hash{}, []SignedTx{})
+		parent, err = b.Hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.Append(parent, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = store.SetCanonical(number, parent)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hashes = append(hashes, parent)
+	}
+	store.Close()
+
+	// drop the last hash index record as if the node crashed before writing it
+	err = os.Truncate(getBlocksHashIndexFilePath(dataDir), 2*hashIndexRecordSize+10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewJSONLinesBlockStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	for number, hash := range hashes {
+		b, err := store.Block(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if b.Header.Number != uint64(number) {
+			t.Fatalf("block '%x' was suppose to be number %d, not %d", hash, number, b.Header.Number)
+		}
+	}
+
+	blocks, err := store.CanonicalBlocks(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 2 || blocks[0].Header.Number != 1 || blocks[1].Header.Number != 2 {
+		t.Fatal("canonical blocks 1 and 2 were suppose to be returned")
+	}
+
+	err = store.TruncateCanonical(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.CanonicalBlock(1)
+	if err == nil {
+		t.Fatal("truncated canonical block 1 was suppose to be missing")
+	}
+}
+
+func TestConvertBlocksDb_Bolt(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	state, err := NewStateFromDisk(dataDir, BackendJSONLines)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), andrejKey)
+	block0 := addTestBlock(t, state, Hash{}, 0, babayaga)
+	block0Hash, _ := block0.Hash()
+	block1 := addTestBlock(t, state, block0Hash, 1, babayaga, tx)
+	block1Hash, _ := block1.Hash()
+	balances := state.Balances
+	state.Close()
+
+	err = ConvertBlocksDb(dataDir, BackendBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = NewStateFromDisk(dataDir, BackendBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if state.LatestBlockHash() != block1Hash {
+		t.Fatal("converted state was suppose to have the same chain tip")
+	}
+
+	if !reflect.DeepEqual(state.Balances, balances) {
+		t.Fatal("converted state was suppose to have the same balances")
+	}
+
+	txHash, _ := tx.Hash()
+	txBlockHash, err := state.store.TXBlockHash(txHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if txBlockHash != block1Hash {
+		t.Fatal("TX was suppose to be indexed in block 1")
+	}
+
+	// the db is locked by the open state
+	_, err = NewBoltBlockStore(dataDir)
+	if err == nil {
+		t.Fatal("bolt db in use was not suppose to open twice")
+	}
+}
+
+func TestJSONLinesBlockStore_RecoversTornWriteAndDetectsBitRot(t *testing.T) {
+	dataDir, _ := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	store, err := NewJSONLinesBlockStore(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	miner := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	parent := Hash{}
+	for number := uint64(0); number < 2; number++ {
+		b := newTestBlock(t, parent, number, 0, number, 1, miner, Hash{}, []SignedTx{})
+		parent, _ = b.Hash()
+
+		err = store.Append(parent, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	dbFilePath := getBlocksDbFilePath(dataDir)
+	blocksDb, err := ioutil.ReadFile(dbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash in the middle of appending the 3rd block
+	err = ioutil.WriteFile(dbFilePath, append(blocksDb, []byte(`{"hash":"0000`)...), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logs := &bytes.Buffer{}
+	log, err := logger.New(logs, logger.LevelWarn, logger.FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewJSONLinesBlockStoreWithLogger(dataDir, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(logs.String(), "Truncating partially written record") {
+		t.Fatal("the torn record truncation was suppose to be logged into the injected logger")
+	}
+
+	count := 0
+	err = store.ForEach(func(_ Hash, _ Block) bool {
+		count++
+		return true
+	})
+	store.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 2 {
+		t.Fatalf("2 blocks were suppose to remain after the torn write, not %d", count)
+	}
+
+	truncatedBlocksDb, err := ioutil.ReadFile(dbFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(truncatedBlocksDb, blocksDb) {
+		t.Fatal("the torn record was suppose to be truncated")
+	}
+
+	corruptions := []struct {
+		name        string
+		expectedErr string
+		corrupt     func(record *blockRecord)
+	}{
+		// flip a bit of the 2nd block TX root, keeping the record checksum
+		{"block bit rot", "Checksum mismatch", func(record *blockRecord) { record.Value[len(record.Value)-5] ^= 1 }},
+		{"hash bit rot", "Checksum mismatch", func(record *blockRecord) { record.Key[0] ^= 1 }},
+		{"dropped checksum", "Missing checksum", func(record *blockRecord) { record.Checksum = nil }},
+		// a legacy record checksums only the block, its key must be the block hash
+		{"legacy hash bit rot", "Hash mismatch", func(record *blockRecord) {
+			checksum := crc32.ChecksumIEEE(record.Value)
+			record.Key[0] ^= 1
+			record.Checksum = &checksum
+			record.Format = 0
+		}},
+	}
+	for _, c := range corruptions {
+		err := forEachTestCorruptedRecord(t, dataDir, blocksDb, c.corrupt)
+		if err == nil || !strings.Contains(err.Error(), "block '1'") || !strings.Contains(err.Error(), c.expectedErr) {
+			t.Fatalf("%s of block 1 was suppose to be reported as '%s', not: %v", c.name, c.expectedErr, err)
+		}
+	}
+
+	err = forEachTestCorruptedRecord(t, dataDir, blocksDb, func(record *blockRecord) {
+		checksum := crc32.ChecksumIEEE(record.Value)
+		record.Checksum = &checksum
+		record.Format = 0
+	})
+	if err != nil {
+		t.Fatalf("legacy record was suppose to be readable, got: %v", err)
+	}
+}
+
+// forEachTestCorruptedRecord rewrites the 2nd block.db record and iterates the store
+func forEachTestCorruptedRecord(t *testing.T, dataDir string, blocksDb []byte, corrupt func(record *blockRecord)) error {
+	lines := bytes.Split(blocksDb, []byte("\n"))
+
+	var record blockRecord
+	err := json.Unmarshal(lines[1], &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt(&record)
+	lines[1], err = json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the hash index is rebuilt from the corrupted block.db
+	for _, path := range []string{getBlocksDbFilePath(dataDir), getBlocksHashIndexFilePath(dataDir)} {
+		err = os.Remove(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = ioutil.WriteFile(getBlocksDbFilePath(dataDir), bytes.Join(lines, []byte("\n")), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := NewJSONLinesBlockStore(dataDir)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return store.ForEach(func(_ Hash, _ Block) bool { return true })
+}
+
+func TestBlockStore_IndexesCanonicalTXs(t *testing.T) {
+	for _, backend := range []string{BackendJSONLines, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			testBlockStoreIndexesCanonicalTXs(t, backend)
+		})
+	}
+}
+
+func testBlockStoreIndexesCanonicalTXs(t *testing.T, backend string) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	store, err := OpenBlockStore(dataDir, backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	txs := make([]SignedTx, 0)
+	txHashes := make([]Hash, 0)
+	hashes := make([]Hash, 0)
+	parent := Hash{}
+	for number := uint64(0); number < 3; number++ {
+		tx := signTestTx(t, NewTx(andrej, babayaga, 1, uint(number+1), ""), andrejKey)
+		txHash, _ := tx.Hash()
+		txs = append(txs, tx)
+		txHashes = append(txHashes, txHash)
+
+		b := newTestBlock(t, parent, number, 0, number, 1, babayaga, Hash{}, []SignedTx{tx})
+		parent, _ = b.Hash()
+		hashes = append(hashes, parent)
+
+		err = store.Append(parent, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the 3rd block becomes canonical after the first lookup, which builds the JSON lines index
+		if number < 2 {
+			err = store.SetCanonical(number, parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	blockHash, err := store.TXBlockHash(txHashes[1])
+	if err != nil || blockHash != hashes[1] {
+		t.Fatalf("TX was suppose to be indexed in block 1, got '%x', %v", blockHash, err)
+	}
+
+	err = store.SetCanonical(2, hashes[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blockHash, err = store.TXBlockHash(txHashes[2])
+	if err != nil || blockHash != hashes[2] {
+		t.Fatalf("TX was suppose to be indexed in block 2, got '%x', %v", blockHash, err)
+	}
+
+	// a competing block 1 includes the TX of block 2
+	fork := newTestBlock(t, hashes[0], 1, 1, 1, 1, babayaga, Hash{}, []SignedTx{txs[2]})
+	forkHash, _ := fork.Hash()
+	err = store.Append(forkHash, fork)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = store.SetCanonical(1, forkHash)
+	if err == nil {
+		err = store.TruncateCanonical(2)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = store.TXBlockHash(txHashes[1])
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("TX of the replaced block 1 was suppose to be unindexed, got %v", err)
+	}
+
+	blockHash, err = store.TXBlockHash(txHashes[2])
+	if err != nil || blockHash != forkHash {
+		t.Fatalf("TX was suppose to be indexed in the competing block 1, got '%x', %v", blockHash, err)
+	}
+}
@@ -0,0 +1,30 @@
+package database
+
+import "testing"
+
+func TestRetargetDifficulty(t *testing.T) {
+	const expected = uint64(100)
+
+	cases := []struct {
+		name       string
+		actual     uint64
+		difficulty uint64
+	}{
+		{"on target", 100, 1000},
+		{"twice faster", 50, 2000},
+		{"twice slower", 200, 500},
+		{"clamped faster", 1, 4000},
+		{"clamped slower", 10000, 250},
+	}
+
+	for _, c := range cases {
+		difficulty := retargetDifficulty(1000, c.actual, expected, 1)
+		if difficulty != c.difficulty {
+			t.Errorf("%s: expected difficulty %d, got %d", c.name, c.difficulty, difficulty)
+		}
+	}
+
+	if difficulty := retargetDifficulty(1000, 10000, expected, 800); difficulty != 800 {
+		t.Errorf("difficulty can't drop below minimal difficulty, got %d", difficulty)
+	}
+}
@@ -0,0 +1,423 @@
+package database
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBlocksBucket  = []byte("blocks")
+	boltOrderBucket   = []byte("order")
+	boltHeightsBucket = []byte("heights")
+	boltTXsBucket     = []byte("txs")
+	// account balances and nonces after the tip block of the state bucket
+	boltBalancesBucket = []byte("balances")
+	boltNoncesBucket   = []byte("nonces")
+	boltStateBucket    = []byte("state")
+	// boltStateTipKey keys hash and height of the block the stored balances are of
+	boltStateTipKey = []byte("tip")
+	// boltStateWorkKey keys cumulative work of the chain up to the block the stored balances are of
+	boltStateWorkKey = []byte("work")
+)
+
+// boltOpenTimeout limits waiting for the db lock held by another process on the same data dir
+const boltOpenTimeout = time.Second
+
+// boltBlockStore keeps blocks in an embedded bbolt key value db
+// together with the canonical height index, TX index and account balances
+type boltBlockStore struct {
+	db *bolt.DB
+}
+
+// NewBoltBlockStore opens the bbolt db in the data dir
+func NewBoltBlockStore(dataDir string) (BlockStore, error) {
+	db, err := bolt.Open(getBoltDbFilePath(dataDir), 0600, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("can't open bolt db '%s', is another process using the data dir? %w", getBoltDbFilePath(dataDir), err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{boltBlocksBucket, boltOrderBucket, boltHeightsBucket, boltTXsBucket, boltBalancesBucket, boltNoncesBucket, boltStateBucket} {
+			_, err := tx.CreateBucketIfNotExists(bucket)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &boltBlockStore{db}, nil
+}
+
+func (bs *boltBlockStore) Append(hash Hash, b Block) error {
+	encoded, err := b.Encode()
+	if err != nil {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		order := tx.Bucket(boltOrderBucket)
+
+		seq, err := order.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		err = order.Put(uint64Key(seq), hash[:])
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltBlocksBucket).Put(hash[:], encoded)
+	})
+}
+
+func (bs *boltBlockStore) Block(hash Hash) (Block, error) {
+	var b Block
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		b, err = boltBlock(tx, hash)
+		return err
+	})
+
+	return b, err
+}
+
+// SetCanonical also indexes the block TXs by their hash
+func (bs *boltBlockStore) SetCanonical(number uint64, hash Hash) error {
+	isSet := false
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		isSet = bytesToHash(tx.Bucket(boltHeightsBucket).Get(uint64Key(number))) == hash
+		return nil
+	})
+	if err != nil || isSet {
+		return err
+	}
+
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		b, err := boltBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+
+		err = unindexBoltTXs(tx, number)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Bucket(boltHeightsBucket).Put(uint64Key(number), hash[:])
+		if err != nil {
+			return err
+		}
+
+		for _, signedTx := range b.TXs {
+			txHash, err := signedTx.Hash()
+			if err != nil {
+				return err
+			}
+
+			err = tx.Bucket(boltTXsBucket).Put(txHash[:], hash[:])
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (bs *boltBlockStore) TruncateCanonical(number uint64) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		heights := tx.Bucket(boltHeightsBucket)
+
+		toDelete := make([]uint64, 0)
+		c := heights.Cursor()
+		for k, _ := c.Seek(uint64Key(number)); k != nil; k, _ = c.Next() {
+			toDelete = append(toDelete, binary.BigEndian.Uint64(k))
+		}
+
+		for _, height := range toDelete {
+			err := unindexBoltTXs(tx, height)
+			if err != nil {
+				return err
+			}
+
+			err = heights.Delete(uint64Key(height))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (bs *boltBlockStore) CanonicalBlock(number uint64) (Block, error) {
+	blocks, err := bs.CanonicalBlocks(number, number+1)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return blocks[0], nil
+}
+
+func (bs *boltBlockStore) CanonicalBlocks(from, to uint64) ([]Block, error) {
+	blocks := make([]Block, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltHeightsBucket).Cursor()
+
+		number := from
+		for k, v := c.Seek(uint64Key(from)); number < to; k, v = c.Next() {
+			if k == nil || binary.BigEndian.Uint64(k) != number {
+				return fmt.Errorf("canonical block '%d' not found", number)
+			}
+
+			b, err := boltBlock(tx, bytesToHash(v))
+			if err != nil {
+				return err
+			}
+
+			blocks = append(blocks, b)
+			number++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return blocks, nil
+}
+
+func (bs *boltBlockStore) CanonicalHashes(from, to uint64) ([]Hash, error) {
+	hashes := make([]Hash, 0)
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltHeightsBucket).Cursor()
+
+		number := from
+		for k, v := c.Seek(uint64Key(from)); number < to; k, v = c.Next() {
+			if k == nil || binary.BigEndian.Uint64(k) != number {
+				return fmt.Errorf("canonical block '%d' not found", number)
+			}
+
+			hashes = append(hashes, bytesToHash(v))
+			number++
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return hashes, nil
+}
+
+func (bs *boltBlockStore) ForEach(fn func(hash Hash, b Block) bool) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltOrderBucket).Cursor()
+		return forEachBoltBlock(tx, c, c.First, fn)
+	})
+}
+
+// ForEachAfter finds the block append order walking back from the last appended block
+func (bs *boltBlockStore) ForEachAfter(hash Hash, fn func(hash Hash, b Block) bool) error {
+	return bs.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltOrderBucket).Cursor()
+
+		k, v := c.Last()
+		for k != nil && bytesToHash(v) != hash {
+			k, v = c.Prev()
+		}
+		if k == nil {
+			return fmt.Errorf("block '%x' not found", hash)
+		}
+
+		return forEachBoltBlock(tx, c, c.Next, fn)
+	})
+}
+
+// TXBlockHash return hash of the canonical block which includes the TX
+func (bs *boltBlockStore) TXBlockHash(txHash Hash) (Hash, error) {
+	var blockHash Hash
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(boltTXsBucket).Get(txHash[:])
+		if v == nil {
+			return fmt.Errorf("TX '%x' %w", txHash, ErrNotFound)
+		}
+
+		blockHash = bytesToHash(v)
+		return nil
+	})
+
+	return blockHash, err
+}
+
+// PutBalances replaces the stored account balances and nonces with the snapshot
+func (bs *boltBlockStore) PutBalances(snapshot Snapshot) error {
+	return bs.db.Update(func(tx *bolt.Tx) error {
+		for bucket, values := range map[string]map[Account]uint{string(boltBalancesBucket): snapshot.Balances, string(boltNoncesBucket): snapshot.Nonces} {
+			err := tx.DeleteBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+
+			b, err := tx.CreateBucket([]byte(bucket))
+			if err != nil {
+				return err
+			}
+
+			for acc, value := range values {
+				err = b.Put(acc[:], uint64Key(uint64(value)))
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		tip := make([]byte, len(snapshot.Hash)+8)
+		copy(tip, snapshot.Hash[:])
+		binary.BigEndian.PutUint64(tip[len(snapshot.Hash):], snapshot.Height)
+
+		err := tx.Bucket(boltStateBucket).Put(boltStateTipKey, tip)
+		if err != nil {
+			return err
+		}
+
+		return tx.Bucket(boltStateBucket).Put(boltStateWorkKey, snapshot.Work.Bytes())
+	})
+}
+
+// Balances return the stored account balances and nonces, false is returned when none are stored
+func (bs *boltBlockStore) Balances() (Snapshot, bool, error) {
+	snapshot := Snapshot{
+		Balances: make(map[Account]uint),
+		Nonces:   make(map[Account]uint),
+	}
+	isStored := false
+
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		tip := tx.Bucket(boltStateBucket).Get(boltStateTipKey)
+		if tip == nil {
+			return nil
+		}
+
+		if len(tip) != len(snapshot.Hash)+8 {
+			return fmt.Errorf("stored balances tip of %d bytes is corrupted", len(tip))
+		}
+		snapshot.Hash = bytesToHash(tip[:len(snapshot.Hash)])
+		snapshot.Height = binary.BigEndian.Uint64(tip[len(snapshot.Hash):])
+
+		if work := tx.Bucket(boltStateBucket).Get(boltStateWorkKey); work != nil {
+			snapshot.Work = new(big.Int).SetBytes(work)
+		}
+
+		for bucket, values := range map[string]map[Account]uint{string(boltBalancesBucket): snapshot.Balances, string(boltNoncesBucket): snapshot.Nonces} {
+			err := tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+				if len(k) != len(Account{}) || len(v) != 8 {
+					return fmt.Errorf("stored %s entry '%x' is corrupted", bucket, k)
+				}
+
+				values[common.BytesToAddress(k)] = uint(binary.BigEndian.Uint64(v))
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		isStored = true
+		return nil
+	})
+
+	return snapshot, isStored, err
+}
+
+func (bs *boltBlockStore) Close() error {
+	return bs.db.Close()
+}
+
+func boltBlock(tx *bolt.Tx, hash Hash) (Block, error) {
+	encoded := tx.Bucket(boltBlocksBucket).Get(hash[:])
+	if encoded == nil {
+		return Block{}, fmt.Errorf("block '%x' not found", hash)
+	}
+
+	return DecodeBlock(encoded)
+}
+
+// forEachBoltBlock iterates over blocks of the order bucket cursor from its first position
+func forEachBoltBlock(tx *bolt.Tx, c *bolt.Cursor, first func() ([]byte, []byte), fn func(hash Hash, b Block) bool) error {
+	for _, v := first(); v != nil; _, v = c.Next() {
+		hash := bytesToHash(v)
+
+		b, err := boltBlock(tx, hash)
+		if err != nil {
+			return err
+		}
+
+		if !fn(hash, b) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// unindexBoltTXs drops TX index of the canonical block at the height
+func unindexBoltTXs(tx *bolt.Tx, number uint64) error {
+	hash := tx.Bucket(boltHeightsBucket).Get(uint64Key(number))
+	if hash == nil {
+		return nil
+	}
+
+	b, err := boltBlock(tx, bytesToHash(hash))
+	if err != nil {
+		return err
+	}
+
+	for _, signedTx := range b.TXs {
+		txHash, err := signedTx.Hash()
+		if err != nil {
+			return err
+		}
+
+		// the TX may be already indexed in a block of the new canonical chain
+		if !bytes.Equal(tx.Bucket(boltTXsBucket).Get(txHash[:]), hash) {
+			continue
+		}
+
+		err = tx.Bucket(boltTXsBucket).Delete(txHash[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func bytesToHash(b []byte) Hash {
+	var hash Hash
+	copy(hash[:], b)
+
+	return hash
+}
+
+func uint64Key(v uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, v)
+
+	return key
+}
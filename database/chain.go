@@ -0,0 +1,563 @@
+package database
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+)
+
+// maxReorgDepth is how many canonical blocks a reorg can roll back
+const maxReorgDepth = 100
+
+// blockMeta is a known block header with the cumulative
+// proof of work of its branch, the block included
+type blockMeta struct {
+	header BlockHeader
+	work   *big.Int
+}
+
+// accountUndo is account state before a block was applied
+type accountUndo struct {
+	balance    uint
+	hasBalance bool
+	nonce      uint
+	hasNonce   bool
+}
+
+// blockUndo is state of every account touched by a block before it was applied
+type blockUndo map[Account]accountUndo
+
+// importBlock applies the fork choice rule to a new block without persisting it.
+// It returns true when the block caused a chain reorganization.
+func (s *State) importBlock(b Block, blockHash Hash) (bool, error) {
+	if s.hasBlock(blockHash) {
+		return false, nil
+	}
+
+	if !s.hasGenesisBlock || b.Header.Parent == s.latestBlockHash {
+		err := s.applyCanonicalBlock(b, blockHash)
+		return false, err
+	}
+
+	parent, err := s.validateSideBlock(b)
+	if err != nil {
+		return false, err
+	}
+
+	s.blocks[blockHash] = blockMeta{b.Header, cumulativeWork(parent.work, b.Header.Difficulty)}
+
+	if s.blocks[blockHash].work.Cmp(s.blocks[s.latestBlockHash].work) <= 0 {
+		return false, nil
+	}
+
+	err = s.reorg(b, blockHash)
+	if err != nil {
+		delete(s.blocks, blockHash)
+		return false, err
+	}
+
+	return true, nil
+}
+
+// forgetBlock reverts importBlock of a block which couldn't be persisted
+func (s *State) forgetBlock(blockHash Hash, oldTipHash Hash, reorged bool) {
+	if reorged {
+		oldTip, err := s.loadBlock(oldTipHash)
+		if err == nil {
+			_ = s.reorg(oldTip, oldTipHash)
+		}
+	} else if s.latestBlockHash == blockHash {
+		s.revertCanonicalBlock()
+	}
+
+	delete(s.blocks, blockHash)
+	s.orphanedTXs = nil
+}
+
+// applyCanonicalBlock validates the block on top of the canonical chain
+// and makes it the new chain tip
+func (s *State) applyCanonicalBlock(b Block, blockHash Hash) error {
+	pendingState := s.copy()
+
+	// validate block meta + payload
+	err := applyBlock(b, pendingState)
+	if err != nil {
+		return err
+	}
+
+	undo := make(blockUndo)
+	touched := []Account{b.Header.Miner}
+	for _, tx := range b.TXs {
+		touched = append(touched, tx.From, tx.To)
+	}
+
+	for _, acc := range touched {
+		balance, hasBalance := s.Balances[acc]
+		nonce, hasNonce := s.Account2Nonce[acc]
+		undo[acc] = accountUndo{balance, hasBalance, nonce, hasNonce}
+	}
+
+	parentWork := big.NewInt(0)
+	if s.hasGenesisBlock {
+		parentWork = s.blocks[s.latestBlockHash].work
+	}
+
+	s.Balances = pendingState.Balances
+	s.Account2Nonce = pendingState.Account2Nonce
+	s.latestBlockHash = blockHash
+	s.latestBlock = b
+	s.hasGenesisBlock = true
+
+	s.blocks[blockHash] = blockMeta{b.Header, cumulativeWork(parentWork, b.Header.Difficulty)}
+	s.canonical = append(s.canonical, blockHash)
+	s.undos[blockHash] = undo
+
+	if b.Header.Number >= maxReorgDepth {
+		delete(s.undos, s.canonical[b.Header.Number-maxReorgDepth])
+	}
+
+	return nil
+}
+
+// revertCanonicalBlock rolls back the chain tip to its parent
+func (s *State) revertCanonicalBlock() {
+	undo := s.undos[s.latestBlockHash]
+	for acc, prev := range undo {
+		delete(s.Balances, acc)
+		if prev.hasBalance {
+			s.Balances[acc] = prev.balance
+		}
+
+		delete(s.Account2Nonce, acc)
+		if prev.hasNonce {
+			s.Account2Nonce[acc] = prev.nonce
+		}
+	}
+
+	delete(s.undos, s.latestBlockHash)
+	s.canonical = s.canonical[:len(s.canonical)-1]
+
+	if s.storedCanonical > len(s.canonical) {
+		s.storedCanonical = len(s.canonical)
+	}
+
+	if len(s.canonical) == 0 {
+		s.latestBlock = Block{}
+		s.latestBlockHash = Hash{}
+		s.hasGenesisBlock = false
+		return
+	}
+
+	s.latestBlockHash = s.canonical[len(s.canonical)-1]
+
+	latestBlock, err := s.store.Block(s.latestBlockHash)
+	if err != nil {
+		// only the header of the intermediate tip is needed to apply next blocks
+		latestBlock = Block{Header: s.blocks[s.latestBlockHash].header}
+	}
+	s.latestBlock = latestBlock
+}
+
+// validateSideBlock verifies header of a block which doesn't extend the chain tip,
+// its TXs are validated only once its branch becomes canonical
+func (s *State) validateSideBlock(b Block) (blockMeta, error) {
+	if b.Header.Parent.IsEmpty() && b.Header.Number == 0 {
+		err := validateBlockHeader(b.Header, BlockHeader{}, false, s.genesis.Difficulty)
+		if err != nil {
+			return blockMeta{}, err
+		}
+
+		return blockMeta{work: big.NewInt(0)}, validateBlockTXRoot(b)
+	}
+
+	parent, isKnown := s.blocks[b.Header.Parent]
+	if !isKnown {
+		return blockMeta{}, fmt.Errorf("unknown parent block '%x' of block '%d'", b.Header.Parent, b.Header.Number)
+	}
+
+	if b.Header.Number != parent.header.Number+1 {
+		return blockMeta{}, fmt.Errorf("next expected block must be '%d' not '%d'", parent.header.Number+1, b.Header.Number)
+	}
+
+	err := validateBlockHeader(b.Header, parent.header, true, s.difficultyAfter(parent.header))
+	if err != nil {
+		return blockMeta{}, err
+	}
+
+	return parent, validateBlockTXRoot(b)
+}
+
+// reorg rolls the canonical chain back to the common ancestor with
+// the new tip branch and re-applies the branch blocks
+func (s *State) reorg(newTip Block, newTipHash Hash) error {
+	branch := []Hash{newTipHash}
+	ancestor := newTip.Header.Parent
+	for !ancestor.IsEmpty() && !s.isCanonical(ancestor) {
+		branch = append([]Hash{ancestor}, branch...)
+		ancestor = s.blocks[ancestor].header.Parent
+	}
+
+	var forkNumber uint64
+	if !ancestor.IsEmpty() {
+		number, _ := s.blockNumber(ancestor)
+		forkNumber = number + 1
+	}
+
+	if uint64(len(s.canonical))-forkNumber > maxReorgDepth {
+		return fmt.Errorf("reorg of %d blocks exceeds max depth of %d blocks", uint64(len(s.canonical))-forkNumber, maxReorgDepth)
+	}
+
+	branchBlocks, err := s.loadBlocks(branch[:len(branch)-1])
+	if err != nil {
+		return err
+	}
+	branchBlocks = append(branchBlocks, newTip)
+
+	oldBlocks, err := s.loadBlocks(s.canonical[forkNumber:])
+	if err != nil {
+		return err
+	}
+
+	for uint64(len(s.canonical)) > forkNumber {
+		s.revertCanonicalBlock()
+	}
+
+	for i, b := range branchBlocks {
+		err := s.applyCanonicalBlock(b, branch[i])
+		if err != nil {
+			for uint64(len(s.canonical)) > forkNumber {
+				s.revertCanonicalBlock()
+			}
+
+			for _, oldBlock := range oldBlocks {
+				oldHash, _ := oldBlock.Hash()
+				_ = s.applyCanonicalBlock(oldBlock, oldHash)
+			}
+
+			return fmt.Errorf("reorg to block '%x' failed. %s", newTipHash, err.Error())
+		}
+	}
+
+	minedTXs := make(map[Hash]bool)
+	for _, b := range branchBlocks {
+		for _, tx := range b.TXs {
+			txHash, _ := tx.Hash()
+			minedTXs[txHash] = true
+		}
+	}
+
+	for _, b := range oldBlocks {
+		for _, tx := range b.TXs {
+			txHash, _ := tx.Hash()
+			if !minedTXs[txHash] {
+				s.orphanedTXs = append(s.orphanedTXs, tx)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *State) isCanonical(hash Hash) bool {
+	number, isKnown := s.blockNumber(hash)
+	if !isKnown || number >= uint64(len(s.canonical)) {
+		return false
+	}
+
+	return s.canonical[number] == hash
+}
+
+// blockNumber return number of a known block, loaded or not
+func (s *State) blockNumber(hash Hash) (uint64, bool) {
+	if meta, isKnown := s.blocks[hash]; isKnown {
+		return meta.header.Number, true
+	}
+
+	number, isKnown := s.unloaded[hash]
+	return number, isKnown
+}
+
+// blockHeader return header of a known block, reading the store for an unloaded block
+func (s *State) blockHeader(hash Hash) (BlockHeader, error) {
+	if meta, isKnown := s.blocks[hash]; isKnown {
+		return meta.header, nil
+	}
+
+	b, err := s.loadBlock(hash)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	return b.Header, nil
+}
+
+// difficultyAfter return difficulty of the block following the parent
+func (s *State) difficultyAfter(parent BlockHeader) uint64 {
+	return difficultyAfter(s.genesis, parent, func(hash Hash) BlockHeader {
+		header, _ := s.blockHeader(hash)
+		return header
+	})
+}
+
+// HeadersVerifier verifies a chain of headers following a known block page by page.
+// The headers must link to each other, have the retargeted difficulty and meet it,
+// so a peer chain can be checked before its blocks are downloaded.
+type HeadersVerifier struct {
+	state    *State
+	verified map[Hash]BlockHeader
+	lastHash Hash
+}
+
+// NewHeadersVerifier will return verifier of headers following the state blocks
+func (s *State) NewHeadersVerifier() *HeadersVerifier {
+	return &HeadersVerifier{state: s, verified: make(map[Hash]BlockHeader)}
+}
+
+// Verify verifies the headers following the headers verified so far and return their hashes
+func (v *HeadersVerifier) Verify(headers []BlockHeader) ([]Hash, error) {
+	v.state.mu.RLock()
+	defer v.state.mu.RUnlock()
+
+	hashes := make([]Hash, 0, len(headers))
+	for _, h := range headers {
+		err := v.verify(h)
+		if err != nil {
+			return nil, err
+		}
+
+		hash, err := h.Hash()
+		if err != nil {
+			return nil, err
+		}
+
+		v.verified[hash] = h
+		v.lastHash = hash
+		hashes = append(hashes, hash)
+	}
+
+	return hashes, nil
+}
+
+func (v *HeadersVerifier) verify(h BlockHeader) error {
+	if len(v.verified) > 0 && h.Parent != v.lastHash {
+		return fmt.Errorf("header '%d' doesn't link to its previous header", h.Number)
+	}
+
+	if len(v.verified) == 0 && h.Parent.IsEmpty() && h.Number == 0 {
+		return validateBlockHeader(h, BlockHeader{}, false, v.state.genesis.Difficulty)
+	}
+
+	if len(v.verified) == 0 && !v.state.hasBlock(h.Parent) {
+		return fmt.Errorf("unknown parent block '%x' of header '%d'", h.Parent, h.Number)
+	}
+
+	parent := v.header(h.Parent)
+	if h.Number != parent.Number+1 {
+		return fmt.Errorf("next expected header must be '%d' not '%d'", parent.Number+1, h.Number)
+	}
+
+	return validateBlockHeader(h, parent, true, difficultyAfter(v.state.genesis, parent, v.header))
+}
+
+// header return a verified header or header of a known block
+func (v *HeadersVerifier) header(hash Hash) BlockHeader {
+	if h, isVerified := v.verified[hash]; isVerified {
+		return h
+	}
+
+	h, _ := v.state.blockHeader(hash)
+	return h
+}
+
+// difficultyAfter return difficulty of the block following the parent,
+// the retarget interval start is found by walking the parent branch back
+func difficultyAfter(gen genesis, parent BlockHeader, header func(hash Hash) BlockHeader) uint64 {
+	interval := gen.RetargetInterval
+	if (parent.Number+1)%interval != 0 {
+		return parent.Difficulty
+	}
+
+	intervalStart := parent
+	for i := uint64(1); i < interval; i++ {
+		intervalStart = header(intervalStart.Parent)
+	}
+
+	actualTimespan := parent.Time - intervalStart.Time
+	expectedTimespan := (interval - 1) * gen.TargetBlockTime
+
+	return retargetDifficulty(parent.Difficulty, actualTimespan, expectedTimespan, gen.Difficulty)
+}
+
+// loadBlock reads a stored block by its hash
+func (s *State) loadBlock(hash Hash) (Block, error) {
+	return s.store.Block(hash)
+}
+
+// loadBlocks reads stored blocks in the order of the hashes
+func (s *State) loadBlocks(hashes []Hash) ([]Block, error) {
+	blocks := make([]Block, 0, len(hashes))
+	for _, hash := range hashes {
+		b, err := s.store.Block(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		blocks = append(blocks, b)
+	}
+
+	return blocks, nil
+}
+
+// storeCanonical writes canonical chain changes to the store height index,
+// and the balances when the store keeps them
+func (s *State) storeCanonical() error {
+	for i := s.storedCanonical; i < len(s.canonical); i++ {
+		err := s.store.SetCanonical(uint64(i), s.canonical[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	err := s.store.TruncateCanonical(uint64(len(s.canonical)))
+	if err != nil {
+		return err
+	}
+
+	s.storedCanonical = len(s.canonical)
+
+	// the balances are stored as of the oldest block a reorg can roll back to,
+	// so the blocks after it are replayed on load and can still be reorganized
+	if balancesStore, ok := s.store.(BalancesStore); ok && len(s.canonical) > maxReorgDepth {
+		snapshot, err := s.reorgSafeSnapshot()
+		if err != nil {
+			return err
+		}
+
+		return balancesStore.PutBalances(snapshot)
+	}
+
+	return nil
+}
+
+// GetBlocksAfter will get at most limit canonical blocks following the block hash.
+// No blocks follow a block of a side branch, an unknown block is an error.
+func (s *State) GetBlocksAfter(blockHash Hash, limit uint64) ([]Block, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	from := uint64(0)
+	if !blockHash.IsEmpty() {
+		if !s.hasBlock(blockHash) {
+			return nil, fmt.Errorf("unknown block '%x'", blockHash)
+		}
+
+		if !s.isCanonical(blockHash) {
+			return []Block{}, nil
+		}
+
+		number, _ := s.blockNumber(blockHash)
+		from = number + 1
+	}
+
+	to := uint64(len(s.canonical))
+	if to-from > limit {
+		to = from + limit
+	}
+
+	return s.store.CanonicalBlocks(from, to)
+}
+
+// BlockLocator return canonical block hashes from the tip back to the first block,
+// dense near the tip and exponentially sparser further back
+func (s *State) BlockLocator() []Hash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return blockLocator(s.canonical)
+}
+
+// GetHeadersAfter return headers of up to limit canonical blocks following the block
+func (s *State) GetHeadersAfter(blockHash Hash, limit uint64) ([]BlockHeader, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	from := uint64(0)
+	if !blockHash.IsEmpty() {
+		if !s.isCanonical(blockHash) {
+			return []BlockHeader{}, nil
+		}
+
+		number, _ := s.blockNumber(blockHash)
+		from = number + 1
+	}
+
+	to := uint64(len(s.canonical))
+	if to-from > limit {
+		to = from + limit
+	}
+
+	headers := make([]BlockHeader, 0, to-from)
+	for _, hash := range s.canonical[from:to] {
+		header, err := s.blockHeader(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		headers = append(headers, header)
+	}
+
+	return headers, nil
+}
+
+func blockLocator(canonical []Hash) []Hash {
+	locator := make([]Hash, 0)
+
+	step := 1
+	for i := len(canonical) - 1; i >= 0; i -= step {
+		locator = append(locator, canonical[i])
+
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	if len(canonical) > 0 && locator[len(locator)-1] != canonical[0] {
+		locator = append(locator, canonical[0])
+	}
+
+	return locator
+}
+
+func cumulativeWork(parentWork *big.Int, difficulty uint64) *big.Int {
+	return new(big.Int).Add(parentWork, new(big.Int).SetUint64(difficulty))
+}
+
+// retargetDifficulty scales difficulty by how much faster or slower
+// the interval blocks were mined than expected, at most 4 times per interval
+func retargetDifficulty(difficulty, actualTimespan, expectedTimespan, minDifficulty uint64) uint64 {
+	if actualTimespan < expectedTimespan/4 {
+		actualTimespan = expectedTimespan / 4
+	}
+
+	if actualTimespan > expectedTimespan*4 {
+		actualTimespan = expectedTimespan * 4
+	}
+
+	if actualTimespan == 0 {
+		actualTimespan = 1
+	}
+
+	next := new(big.Int).SetUint64(difficulty)
+	next.Mul(next, new(big.Int).SetUint64(expectedTimespan))
+	next.Div(next, new(big.Int).SetUint64(actualTimespan))
+
+	if !next.IsUint64() {
+		return math.MaxUint64
+	}
+
+	if next.Uint64() < minDifficulty {
+		return minDifficulty
+	}
+
+	return next.Uint64()
+}
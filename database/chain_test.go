@@ -0,0 +1,296 @@
+package database
+
+import (
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestState_AddBlockReorganizesToMoreWork(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+	caesar := NewAccount("0x6fdc0d8d15ae6b4ebf45c52fd2aafbcbb19a65c8")
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx1 := signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), andrejKey)
+	tx2 := signTestTx(t, NewTx(andrej, babayaga, 20, 2, ""), andrejKey)
+
+	// caesar mines a competing branch from block 0 without tx2 on a separate node
+	forkDataDir := copyTestDataDir(t, dataDir)
+	defer os.RemoveAll(forkDataDir)
+
+	forkState, err := NewStateFromDisk(forkDataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forkState.Close()
+
+	block0 := addTestBlock(t, state, Hash{}, 0, babayaga, tx1)
+	block0Hash, _ := block0.Hash()
+	block1 := addTestBlock(t, state, block0Hash, 1, babayaga, tx2)
+	block1Hash, _ := block1.Hash()
+
+	_, err = forkState.AddBlock(block0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sideBlock1 := addTestBlock(t, forkState, block0Hash, 1, caesar)
+	sideBlock1Hash, _ := sideBlock1.Hash()
+
+	_, err = state.AddBlock(sideBlock1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.LatestBlockHash() != block1Hash {
+		t.Fatal("a branch with equal work must not reorganize the chain")
+	}
+
+	sideBlock2 := addTestBlock(t, forkState, sideBlock1Hash, 2, caesar)
+	sideBlock2Hash, _ := sideBlock2.Hash()
+
+	_, err = state.AddBlock(sideBlock2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.LatestBlockHash() != sideBlock2Hash {
+		t.Fatal("the branch with more work was suppose to become canonical")
+	}
+
+	if state.Balances[babayaga] != tx1.Value+BlockReward+tx1.Fee {
+		t.Fatalf("babayaga balance was suppose to be rolled back to %d, not %d", tx1.Value+BlockReward+tx1.Fee, state.Balances[babayaga])
+	}
+
+	if state.Balances[caesar] != 2*BlockReward {
+		t.Fatalf("caesar was suppose to receive 2 block rewards, not %d TBB", state.Balances[caesar])
+	}
+
+	if state.GetNextAccountNonce(andrej) != 2 {
+		t.Fatal("andrej nonce was suppose to be rolled back to tx1")
+	}
+
+	orphaned := state.PopOrphanedTXs()
+	if len(orphaned) != 1 || orphaned[0].Nonce != tx2.Nonce {
+		t.Fatal("tx2 was suppose to be orphaned by the reorg")
+	}
+
+	blocks, err := state.GetBlocksAfter(block0Hash, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 2 || blocks[0].Header.Miner != caesar || blocks[1].Header.Miner != caesar {
+		t.Fatal("canonical blocks after block 0 were suppose to be caesar's branch")
+	}
+
+	blocks, err = state.GetBlocksAfter(block0Hash, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 1 || blocks[0].Header.Number != 1 {
+		t.Fatal("a page of 1 block after block 0 was suppose to hold only block 1")
+	}
+
+	blocks, err = state.GetBlocksAfter(block1Hash, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != 0 {
+		t.Fatal("no canonical blocks were suppose to follow a side branch block")
+	}
+
+	_, err = state.GetBlocksAfter(Hash{0x01}, 10)
+	if err == nil {
+		t.Fatal("blocks after an unknown block were suppose to be an error")
+	}
+
+	state.Close()
+
+	// replaying the stored blocks must choose the same branch
+	state, err = NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if state.LatestBlockHash() != sideBlock2Hash {
+		t.Fatal("restarted state was suppose to keep the branch with more work")
+	}
+
+	if state.Balances[caesar] != 2*BlockReward {
+		t.Fatalf("restarted state caesar balance was suppose to be %d, not %d", 2*BlockReward, state.Balances[caesar])
+	}
+}
+
+func TestHeadersVerifier_VerifiesPagesOfHeaders(t *testing.T) {
+	dataDir, _ := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	peerDataDir := copyTestDataDir(t, dataDir)
+	defer os.RemoveAll(peerDataDir)
+
+	peerState, err := NewStateFromDisk(peerDataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerState.Close()
+
+	block0 := addTestBlock(t, peerState, Hash{}, 0, babayaga)
+	block0Hash, _ := block0.Hash()
+	block1 := addTestBlock(t, peerState, block0Hash, 1, babayaga)
+	block1Hash, _ := block1.Hash()
+	block2 := addTestBlock(t, peerState, block1Hash, 2, babayaga)
+	block2Hash, _ := block2.Hash()
+
+	_, err = state.AddBlock(block0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := state.NewHeadersVerifier()
+	for i, b := range []Block{block1, block2} {
+		hashes, err := verifier.Verify([]BlockHeader{b.Header})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(hashes) != 1 || hashes[0] != []Hash{block1Hash, block2Hash}[i] {
+			t.Fatalf("page %d was suppose to be verified following the previous page", i)
+		}
+	}
+
+	_, err = state.NewHeadersVerifier().Verify([]BlockHeader{block2.Header})
+	if err == nil {
+		t.Fatal("header with an unknown parent was suppose to be rejected")
+	}
+
+	forgedHeader := block1.Header
+	forgedHeader.Difficulty = 2
+	_, err = state.NewHeadersVerifier().Verify([]BlockHeader{forgedHeader})
+	if err == nil || !strings.Contains(err.Error(), "difficulty") {
+		t.Fatalf("header with a wrong difficulty was suppose to be rejected, got %v", err)
+	}
+
+	_, err = state.NewHeadersVerifier().Verify([]BlockHeader{block1.Header, block1.Header})
+	if err == nil {
+		t.Fatal("headers not linking to each other were suppose to be rejected")
+	}
+}
+
+func createTestDataDir(t *testing.T) (string, *ecdsa.PrivateKey) {
+	dataDir, err := ioutil.TempDir("", "tbb_database_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	privKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesisJSON, err := json.Marshal(genesis{
+		Balances:   map[Account]uint{crypto.PubkeyToAddress(privKey.PublicKey): 1000000},
+		Difficulty: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(getDatabaseDirPath(dataDir), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(getDatabaseDirPath(dataDir), "genesis.json"), genesisJSON, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return dataDir, privKey
+}
+
+func signTestTx(t *testing.T, tx Tx, privKey *ecdsa.PrivateKey) SignedTx {
+	signedTx, err := SignTx(tx, privKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signedTx
+}
+
+// copyTestDataDir return a new data dir with the same genesis
+func copyTestDataDir(t *testing.T, dataDir string) string {
+	genesisJSON, err := ioutil.ReadFile(getGenesisJSONFilePath(dataDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	copyDataDir, err := ioutil.TempDir("", "tbb_database_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(getDatabaseDirPath(copyDataDir), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(getGenesisJSONFilePath(copyDataDir), genesisJSON, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return copyDataDir
+}
+
+// addTestBlock adds a block mined at the trivial test difficulty
+// on top of the chain tip
+func newTestBlock(t *testing.T, parent Hash, number uint64, nonce uint32, time uint64, difficulty uint64, miner Account, stateRoot Hash, txs []SignedTx) Block {
+	b, err := NewBlock(parent, number, nonce, time, difficulty, miner, stateRoot, txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
+
+func addTestBlock(t *testing.T, s *State, parent Hash, number uint64, miner Account, txs ...SignedTx) Block {
+	stateRoot, err := s.NextStateRoot(miner, txs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestBlock(t, parent, number, 0, s.LatestBlock().Header.Time, 1, miner, stateRoot, txs)
+
+	_, err = s.AddBlock(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return b
+}
@@ -0,0 +1,278 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// encodingVersion prefixes every binary encoded TX, header and block.
+// The RLP field lists below are frozen per version, adding a field
+// to the Go structs doesn't change the encoding until the version is bumped.
+const encodingVersion = byte(2)
+
+// legacyEncodingVersion encoded blocks before headers committed to the state root,
+// its blocks are still decoded so the chains stored before version 2 stay readable
+const legacyEncodingVersion = byte(1)
+
+type txRLP struct {
+	From  Account
+	To    Account
+	Value uint64
+	Fee   uint64
+	Nonce uint64
+	Data  string
+	Time  uint64
+}
+
+type signedTxRLP struct {
+	Tx  txRLP
+	Sig []byte
+}
+
+type headerRLP struct {
+	Parent     Hash
+	Number     uint64
+	Nonce      uint32
+	Time       uint64
+	Difficulty uint64
+	Miner      Account
+	TXRoot     Hash
+	StateRoot  Hash
+}
+
+type legacyHeaderRLP struct {
+	Parent     Hash
+	Number     uint64
+	Nonce      uint32
+	Time       uint64
+	Difficulty uint64
+	Miner      Account
+	TXRoot     Hash
+}
+
+type accountRLP struct {
+	Account Account
+	Balance uint64
+	Nonce   uint64
+}
+
+type blockRLP struct {
+	Header headerRLP
+	TXs    []signedTxRLP
+}
+
+type legacyBlockRLP struct {
+	Header legacyHeaderRLP
+	TXs    []signedTxRLP
+}
+
+// Encode return binary encoding of the TX the sender signs
+func (t Tx) Encode() ([]byte, error) {
+	return encodeVersioned(t.Version, t.rlp())
+}
+
+// Encode return binary encoding of the TX with its signature
+func (t SignedTx) Encode() ([]byte, error) {
+	return encodeVersioned(t.Version, t.rlp())
+}
+
+// Encode return binary encoding of the block header
+func (h BlockHeader) Encode() ([]byte, error) {
+	if h.Version == legacyEncodingVersion {
+		return encodeVersioned(h.Version, h.legacyRLP())
+	}
+
+	return encodeVersioned(h.Version, h.rlp())
+}
+
+// Encode return binary encoding of the block stored on disk
+func (b Block) Encode() ([]byte, error) {
+	txs := make([]signedTxRLP, 0, len(b.TXs))
+	for _, tx := range b.TXs {
+		txs = append(txs, tx.rlp())
+	}
+
+	if b.Header.Version == legacyEncodingVersion {
+		return encodeVersioned(b.Header.Version, legacyBlockRLP{b.Header.legacyRLP(), txs})
+	}
+
+	return encodeVersioned(b.Header.Version, blockRLP{b.Header.rlp(), txs})
+}
+
+// DecodeBlock decodes the binary encoding of a block,
+// a legacy block keeps its version to be hashed the same way
+func DecodeBlock(data []byte) (Block, error) {
+	version, err := decodedVersion(data)
+	if err != nil {
+		return Block{}, err
+	}
+
+	var decoded blockRLP
+	if version == legacyEncodingVersion {
+		var legacy legacyBlockRLP
+		err = rlp.DecodeBytes(data[1:], &legacy)
+		decoded = blockRLP{legacy.Header.header(), legacy.TXs}
+	} else {
+		err = rlp.DecodeBytes(data[1:], &decoded)
+	}
+	if err != nil {
+		return Block{}, err
+	}
+
+	header := decoded.Header.header()
+	header.Version = versionField(version)
+
+	txs := make([]SignedTx, 0, len(decoded.TXs))
+	for _, tx := range decoded.TXs {
+		txs = append(txs, NewSignedTx(
+			Tx{
+				From:    tx.Tx.From,
+				To:      tx.Tx.To,
+				Value:   uint(tx.Tx.Value),
+				Fee:     uint(tx.Tx.Fee),
+				Nonce:   uint(tx.Tx.Nonce),
+				Data:    tx.Tx.Data,
+				Time:    tx.Tx.Time,
+				Version: header.Version,
+			},
+			tx.Sig,
+		))
+	}
+
+	return Block{
+		Header: header,
+		TXs:    txs,
+	}, nil
+}
+
+// DecodeBlockHeader decodes the binary encoding of a block header
+func DecodeBlockHeader(data []byte) (BlockHeader, error) {
+	version, err := decodedVersion(data)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	var decoded headerRLP
+	if version == legacyEncodingVersion {
+		var legacy legacyHeaderRLP
+		err = rlp.DecodeBytes(data[1:], &legacy)
+		decoded = legacy.header()
+	} else {
+		err = rlp.DecodeBytes(data[1:], &decoded)
+	}
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	header := decoded.header()
+	header.Version = versionField(version)
+
+	return header, nil
+}
+
+func (t Tx) rlp() txRLP {
+	return txRLP{
+		From:  t.From,
+		To:    t.To,
+		Value: uint64(t.Value),
+		Fee:   uint64(t.Fee),
+		Nonce: uint64(t.Nonce),
+		Data:  t.Data,
+		Time:  t.Time,
+	}
+}
+
+func (t SignedTx) rlp() signedTxRLP {
+	return signedTxRLP{t.Tx.rlp(), t.Sig}
+}
+
+func (h BlockHeader) rlp() headerRLP {
+	return headerRLP{
+		Parent:     h.Parent,
+		Number:     h.Number,
+		Nonce:      h.Nonce,
+		Time:       h.Time,
+		Difficulty: h.Difficulty,
+		Miner:      h.Miner,
+		TXRoot:     h.TXRoot,
+		StateRoot:  h.StateRoot,
+	}
+}
+
+func (h BlockHeader) legacyRLP() legacyHeaderRLP {
+	return legacyHeaderRLP{
+		Parent:     h.Parent,
+		Number:     h.Number,
+		Nonce:      h.Nonce,
+		Time:       h.Time,
+		Difficulty: h.Difficulty,
+		Miner:      h.Miner,
+		TXRoot:     h.TXRoot,
+	}
+}
+
+func (h legacyHeaderRLP) header() headerRLP {
+	return headerRLP{
+		Parent:     h.Parent,
+		Number:     h.Number,
+		Nonce:      h.Nonce,
+		Time:       h.Time,
+		Difficulty: h.Difficulty,
+		Miner:      h.Miner,
+		TXRoot:     h.TXRoot,
+	}
+}
+
+func (h headerRLP) header() BlockHeader {
+	return BlockHeader{
+		Parent:     h.Parent,
+		Number:     h.Number,
+		Nonce:      h.Nonce,
+		Time:       h.Time,
+		Difficulty: h.Difficulty,
+		Miner:      h.Miner,
+		TXRoot:     h.TXRoot,
+		StateRoot:  h.StateRoot,
+	}
+}
+
+// encodeVersioned prefixes the RLP encoding with the version field, zero is the current version
+func encodeVersioned(version byte, val interface{}) ([]byte, error) {
+	if version == 0 {
+		version = encodingVersion
+	}
+
+	if version != encodingVersion && version != legacyEncodingVersion {
+		return nil, fmt.Errorf("unsupported binary encoding version '%d'", version)
+	}
+
+	encoded, err := rlp.EncodeToBytes(val)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{version}, encoded...), nil
+}
+
+// decodedVersion return the supported version the data is encoded with
+func decodedVersion(data []byte) (byte, error) {
+	if len(data) == 0 {
+		return 0, fmt.Errorf("empty binary encoding")
+	}
+
+	if data[0] != encodingVersion && data[0] != legacyEncodingVersion {
+		return 0, fmt.Errorf("unsupported binary encoding version '%d'", data[0])
+	}
+
+	return data[0], nil
+}
+
+// versionField return the version field of a decoded TX or header, zero is the current version
+func versionField(version byte) byte {
+	if version == encodingVersion {
+		return 0
+	}
+
+	return version
+}
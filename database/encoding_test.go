@@ -0,0 +1,266 @@
+package database
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// golden vectors pin the version 2 binary encoding, they must never change
+const (
+	goldenTxHex        = "02f8399409ee50f2f37fcba1845de6fe5c762e83e65e755c9422ba1f80452e6220c7cc6ea2d1e3eeddac5f694a0a320186726577617264845f5e1000"
+	goldenTxHash       = "2c992023133cad82e524e9ca8da1d00bb882a0650365587a6c4018e3bcf7fd81"
+	goldenSignedTxHex  = "02f87ef8399409ee50f2f37fcba1845de6fe5c762e83e65e755c9422ba1f80452e6220c7cc6ea2d1e3eeddac5f694a0a320186726577617264845f5e1000b841000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40"
+	goldenSignedTxHash = "3be2e360ca6008a79227b638269bad0636003ae2e3761a69cfd1d1cf6603fcd8"
+	goldenHeaderHex    = "02f884a0ff00000000000000000000000000000000000000000000000000000000000000012a845f5e100a84010000009422ba1f80452e6220c7cc6ea2d1e3eeddac5f694aa0e149d817bf8ead4bac539e28013095ff6e24caaa4ff871d3e8234f8b939af08ea000000000000000000000000000000000000000000000000000000000000000ee"
+	goldenBlockHash    = "111ad04f05be046f5548eac2efb9beff2edf349978daa4b59417af844c5879ae"
+	goldenBlockHex     = "02f90189f884a0ff00000000000000000000000000000000000000000000000000000000000000012a845f5e100a84010000009422ba1f80452e6220c7cc6ea2d1e3eeddac5f694aa0e149d817bf8ead4bac539e28013095ff6e24caaa4ff871d3e8234f8b939af08ea000000000000000000000000000000000000000000000000000000000000000eef90100f87ef8399409ee50f2f37fcba1845de6fe5c762e83e65e755c9422ba1f80452e6220c7cc6ea2d1e3eeddac5f694a0a320186726577617264845f5e1000b841000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40f87ef8399409ee50f2f37fcba1845de6fe5c762e83e65e755c9422ba1f80452e6220c7cc6ea2d1e3eeddac5f694a0a320186726577617264845f5e1000b841000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40"
+)
+
+// golden vectors pin the legacy version 1 binary encoding, they must never change
+const (
+	goldenV1TxHex        = "01f8399409ee50f2f37fcba1845de6fe5c762e83e65e755c9422ba1f80452e6220c7cc6ea2d1e3eeddac5f694a0a320186726577617264845f5e1000"
+	goldenV1TxHash       = "9458e4471b5b3bca2c5026bbda5a98bea333575b04a12e99556f521453698132"
+	goldenV1SignedTxHex  = "01f87ef8399409ee50f2f37fcba1845de6fe5c762e83e65e755c9422ba1f80452e6220c7cc6ea2d1e3eeddac5f694a0a320186726577617264845f5e1000b841000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40"
+	goldenV1SignedTxHash = "00064af94201416a009d9e009cdc29c2a05fd79676b19a8ffdea28d7be6fd8ee"
+	goldenV1HeaderHex    = "01f863a0ff00000000000000000000000000000000000000000000000000000000000000012a845f5e100a84010000009422ba1f80452e6220c7cc6ea2d1e3eeddac5f694aa0310b8e8399968794670068c60f7bce36847a3c9758d8c9a54a2f5c0601b4303a"
+	goldenV1BlockHash    = "5b7caefe34a90de45dbf650a1b51848dfba3666cd6b3e9d49415ec0b047f3508"
+	goldenV1BlockHex     = "01f90168f863a0ff00000000000000000000000000000000000000000000000000000000000000012a845f5e100a84010000009422ba1f80452e6220c7cc6ea2d1e3eeddac5f694aa0310b8e8399968794670068c60f7bce36847a3c9758d8c9a54a2f5c0601b4303af90100f87ef8399409ee50f2f37fcba1845de6fe5c762e83e65e755c9422ba1f80452e6220c7cc6ea2d1e3eeddac5f694a0a320186726577617264845f5e1000b841000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40f87ef8399409ee50f2f37fcba1845de6fe5c762e83e65e755c9422ba1f80452e6220c7cc6ea2d1e3eeddac5f694a0a320186726577617264845f5e1000b841000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f40"
+)
+
+func TestEncode_GoldenVectors(t *testing.T) {
+	tx := goldenTx()
+	b := goldenBlock()
+	v1Tx := goldenV1Tx()
+	v1Block := goldenV1Block()
+
+	tests := []struct {
+		name   string
+		encode func() ([]byte, error)
+		hash   func() (Hash, error)
+		hex    string
+		hashed string
+	}{
+		{"tx", tx.Tx.Encode, tx.Tx.Hash, goldenTxHex, goldenTxHash},
+		{"signed tx", tx.Encode, tx.Hash, goldenSignedTxHex, goldenSignedTxHash},
+		{"header", b.Header.Encode, b.Hash, goldenHeaderHex, goldenBlockHash},
+		{"block", b.Encode, nil, goldenBlockHex, ""},
+		{"v1 tx", v1Tx.Tx.Encode, v1Tx.Tx.Hash, goldenV1TxHex, goldenV1TxHash},
+		{"v1 signed tx", v1Tx.Encode, v1Tx.Hash, goldenV1SignedTxHex, goldenV1SignedTxHash},
+		{"v1 header", v1Block.Header.Encode, v1Block.Hash, goldenV1HeaderHex, goldenV1BlockHash},
+		{"v1 block", v1Block.Encode, nil, goldenV1BlockHex, ""},
+	}
+
+	for _, tt := range tests {
+		encoded, err := tt.encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hex.EncodeToString(encoded) != tt.hex {
+			t.Errorf("%s encoding was suppose to be %s, not %x", tt.name, tt.hex, encoded)
+		}
+
+		if tt.hash == nil {
+			continue
+		}
+
+		hash, err := tt.hash()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if hash.Hex() != tt.hashed {
+			t.Errorf("%s hash was suppose to be %s, not %s", tt.name, tt.hashed, hash.Hex())
+		}
+	}
+}
+
+func TestDecodeBlock(t *testing.T) {
+	for _, golden := range []struct {
+		hex   string
+		block Block
+	}{
+		{goldenBlockHex, goldenBlock()},
+		{goldenV1BlockHex, goldenV1Block()},
+	} {
+		encoded, err := hex.DecodeString(golden.hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := DecodeBlock(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(b, golden.block) {
+			t.Fatalf("decoded version %d block was suppose to equal the encoded block", encoded[0])
+		}
+
+		header, err := DecodeBlockHeader(mustTestEncode(t, b.Header.Encode))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(header, golden.block.Header) {
+			t.Fatalf("decoded version %d header was suppose to equal the encoded header", encoded[0])
+		}
+
+		_, err = DecodeBlock(append([]byte{encodingVersion + 1}, encoded[1:]...))
+		if err == nil {
+			t.Fatal("block of an unknown encoding version was suppose to be rejected")
+		}
+
+		if !bytes.Equal(mustTestEncode(t, b.Encode), encoded) {
+			t.Fatalf("decoded version %d block was suppose to encode to the same bytes", encoded[0])
+		}
+	}
+}
+
+func mustTestEncode(t *testing.T, encode func() ([]byte, error)) []byte {
+	encoded, err := encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded
+}
+
+func goldenTx() SignedTx {
+	sig := make([]byte, 65)
+	for i := range sig {
+		sig[i] = byte(i)
+	}
+
+	return NewSignedTx(
+		Tx{
+			From:  NewAccount("0x09ee50f2f37fcba1845de6fe5c762e83e65e755c"),
+			To:    NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a"),
+			Value: 10,
+			Fee:   MinTxFee,
+			Nonce: 1,
+			Data:  "reward",
+			Time:  1600000000,
+		},
+		sig,
+	)
+}
+
+// goldenBlock pins only the encoding, its TX root is a fixed value
+// and the repeated TX wouldn't be valid in a chain
+func goldenBlock() Block {
+	parent := Hash{}
+	parent[0] = 0xff
+
+	txRoot := Hash{}
+	_ = txRoot.UnmarshalText([]byte("e149d817bf8ead4bac539e28013095ff6e24caaa4ff871d3e8234f8b939af08e"))
+
+	stateRoot := Hash{}
+	stateRoot[31] = 0xee
+
+	return Block{
+		Header: BlockHeader{
+			Parent:     parent,
+			Number:     1,
+			Nonce:      42,
+			Time:       1600000010,
+			Difficulty: 1 << 24,
+			Miner:      NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a"),
+			TXRoot:     txRoot,
+			StateRoot:  stateRoot,
+		},
+		TXs: []SignedTx{goldenTx(), goldenTx()},
+	}
+}
+
+// goldenV1Block is the golden block encoded before headers committed to the state root
+func goldenV1Block() Block {
+	b := goldenBlock()
+
+	_ = b.Header.TXRoot.UnmarshalText([]byte("310b8e8399968794670068c60f7bce36847a3c9758d8c9a54a2f5c0601b4303a"))
+	b.Header.StateRoot = Hash{}
+	b.Header.Version = legacyEncodingVersion
+	b.TXs = []SignedTx{goldenV1Tx(), goldenV1Tx()}
+
+	return b
+}
+
+func goldenV1Tx() SignedTx {
+	tx := goldenTx()
+	tx.Version = legacyEncodingVersion
+
+	return tx
+}
+
+func TestState_ReplaysLegacyBlocks(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a legacy block stored before headers committed to the state root
+	legacyTx := NewTx(andrej, babayaga, 10, 1, "")
+	legacyTx.Version = legacyEncodingVersion
+	legacyTXs := []SignedTx{signTestTx(t, legacyTx, andrejKey)}
+
+	legacyTXRoot, err := legacyTXsMerkleRoot(legacyTXs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacyBlock := Block{
+		Header: BlockHeader{Difficulty: 1, Miner: babayaga, TXRoot: legacyTXRoot, Version: legacyEncodingVersion},
+		TXs:    legacyTXs,
+	}
+	legacyBlockHash, err := state.AddBlock(legacyBlock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block1 := addTestBlock(t, state, legacyBlockHash, 1, babayaga, signTestTx(t, NewTx(andrej, babayaga, 10, 2, ""), andrejKey))
+	block1Hash, _ := block1.Hash()
+
+	// legacy blocks can't follow the current version blocks
+	legacyBlock.Header.Parent = block1Hash
+	legacyBlock.Header.Number = 2
+	legacyBlock.TXs = []SignedTx{}
+	legacyBlock.Header.TXRoot = Hash{}
+	_, err = state.AddBlock(legacyBlock)
+	if err == nil || !strings.Contains(err.Error(), "can't follow") {
+		t.Fatalf("legacy block following a version 2 block was suppose to be rejected, got %v", err)
+	}
+
+	balances := state.Balances
+	state.Close()
+
+	state, err = NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if state.LatestBlockHash() != block1Hash || !reflect.DeepEqual(state.Balances, balances) {
+		t.Fatal("chain with legacy blocks was suppose to be replayed from the disk")
+	}
+
+	b, err := state.GetBlock(legacyBlockHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Block.Header.Version != legacyEncodingVersion || b.Block.TXs[0].Version != legacyEncodingVersion {
+		t.Fatal("stored legacy block was suppose to keep its version")
+	}
+}
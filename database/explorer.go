@@ -0,0 +1,166 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNotFound is returned when a looked up block, TX or account isn't known
+var ErrNotFound = errors.New("not found")
+
+// BlockInfo is a known block with its position in the chain.
+// Confirmations counts the canonical blocks since the block, the block included,
+// a block of a side branch has none.
+type BlockInfo struct {
+	Hash          Hash
+	Block         Block
+	IsCanonical   bool
+	Confirmations uint64
+}
+
+// TXInfo is a TX of a canonical block with the block including it
+type TXInfo struct {
+	TX            SignedTx
+	BlockHash     Hash
+	BlockNumber   uint64
+	Confirmations uint64
+}
+
+// AccountInfo is an account state after the latest block
+type AccountInfo struct {
+	Account     Account
+	Balance     uint
+	Nonce       uint
+	BlockHash   Hash
+	BlockNumber uint64
+}
+
+// GetBlock return a known block by its hash, canonical or in a side branch
+func (s *State) GetBlock(hash Hash) (BlockInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasBlock(hash) {
+		return BlockInfo{}, fmt.Errorf("block '%x' %w", hash, ErrNotFound)
+	}
+
+	b, err := s.loadBlock(hash)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+
+	return s.blockInfo(hash, b), nil
+}
+
+// GetCanonicalBlock return the canonical block of the number
+func (s *State) GetCanonicalBlock(number uint64) (BlockInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if number >= uint64(len(s.canonical)) {
+		return BlockInfo{}, fmt.Errorf("canonical block '%d' %w", number, ErrNotFound)
+	}
+
+	hash := s.canonical[number]
+	b, err := s.loadBlock(hash)
+	if err != nil {
+		return BlockInfo{}, err
+	}
+
+	return s.blockInfo(hash, b), nil
+}
+
+// GetCanonicalBlocks return the canonical blocks numbered from and up to the numbers,
+// both included, the range is cut at the latest block
+func (s *State) GetCanonicalBlocks(from uint64, to uint64) ([]BlockInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if to >= uint64(len(s.canonical)) {
+		to = uint64(len(s.canonical)) - 1
+	}
+	if len(s.canonical) == 0 || from > to {
+		return []BlockInfo{}, nil
+	}
+
+	blocks, err := s.store.CanonicalBlocks(from, to+1)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]BlockInfo, 0, len(blocks))
+	for i, b := range blocks {
+		infos = append(infos, s.blockInfo(s.canonical[from+uint64(i)], b))
+	}
+
+	return infos, nil
+}
+
+// GetTX return a TX of the canonical chain with the block including it
+func (s *State) GetTX(txHash Hash) (TXInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, err := s.findCanonicalTXBlock(txHash)
+	if err != nil {
+		return TXInfo{}, err
+	}
+
+	blockHash, err := b.Hash()
+	if err != nil {
+		return TXInfo{}, err
+	}
+
+	for _, tx := range b.TXs {
+		hash, err := tx.Hash()
+		if err != nil {
+			return TXInfo{}, err
+		}
+
+		if hash == txHash {
+			return TXInfo{
+				TX:            tx,
+				BlockHash:     blockHash,
+				BlockNumber:   b.Header.Number,
+				Confirmations: s.blockInfo(blockHash, b).Confirmations,
+			}, nil
+		}
+	}
+
+	return TXInfo{}, fmt.Errorf("TX '%x' %w", txHash, ErrNotFound)
+}
+
+// GetAccount return the account balance and nonce after the latest block.
+// Accounts without balance and TXs aren't part of the state.
+func (s *State) GetAccount(acc Account) (AccountInfo, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	balance, hasBalance := s.Balances[acc]
+	nonce, hasNonce := s.Account2Nonce[acc]
+	if !hasBalance && !hasNonce {
+		return AccountInfo{}, fmt.Errorf("account '%s' %w", acc.String(), ErrNotFound)
+	}
+
+	return AccountInfo{
+		Account:     acc,
+		Balance:     balance,
+		Nonce:       nonce,
+		BlockHash:   s.latestBlockHash,
+		BlockNumber: s.latestBlock.Header.Number,
+	}, nil
+}
+
+func (s *State) blockInfo(hash Hash, b Block) BlockInfo {
+	info := BlockInfo{
+		Hash:        hash,
+		Block:       b,
+		IsCanonical: s.isCanonical(hash),
+	}
+
+	if info.IsCanonical {
+		info.Confirmations = s.latestBlock.Header.Number - b.Header.Number + 1
+	}
+
+	return info
+}
@@ -0,0 +1,135 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestState_ExplorerLookups(t *testing.T) {
+	for _, backend := range []string{BackendJSONLines, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			dataDir, andrejKey := createTestDataDir(t)
+			defer os.RemoveAll(dataDir)
+
+			andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+			babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+			caesar := NewAccount("0x6fdc0d8d15ae6b4ebf45c52fd2aafbcbb19a65c8")
+
+			state, err := NewStateFromDisk(dataDir, backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer state.Close()
+
+			forkDataDir := copyTestDataDir(t, dataDir)
+			defer os.RemoveAll(forkDataDir)
+
+			forkState, err := NewStateFromDisk(forkDataDir, backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer forkState.Close()
+
+			tx1 := signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), andrejKey)
+			tx2 := signTestTx(t, NewTx(andrej, babayaga, 20, 2, ""), andrejKey)
+
+			block0 := addTestBlock(t, state, Hash{}, 0, babayaga, tx1)
+			block0Hash, _ := block0.Hash()
+			block1 := addTestBlock(t, state, block0Hash, 1, babayaga, tx2)
+			block1Hash, _ := block1.Hash()
+			block2 := addTestBlock(t, state, block1Hash, 2, babayaga)
+			block2Hash, _ := block2.Hash()
+
+			// an equal work branch of caesar stays aside
+			_, err = forkState.AddBlock(block0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sideBlock1 := addTestBlock(t, forkState, block0Hash, 1, caesar)
+			sideBlock1Hash, err := state.AddBlock(sideBlock1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			block, err := state.GetBlock(block0Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !block.IsCanonical || block.Confirmations != 3 || block.Block.Header.Number != 0 {
+				t.Fatalf("block 0 was suppose to be canonical with 3 confirmations, got %+v", block)
+			}
+
+			block, err = state.GetBlock(sideBlock1Hash)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.IsCanonical || block.Confirmations != 0 {
+				t.Fatal("side branch block was not suppose to be canonical nor confirmed")
+			}
+
+			_, err = state.GetBlock(Hash{0x01})
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("unknown block was suppose to be not found, got %v", err)
+			}
+
+			block, err = state.GetCanonicalBlock(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if block.Hash != block1Hash || block.Confirmations != 2 {
+				t.Fatalf("canonical block 1 was suppose to be andrej's block with 2 confirmations, got %+v", block)
+			}
+
+			_, err = state.GetCanonicalBlock(3)
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("block 3 was suppose to be not found, got %v", err)
+			}
+
+			blocks, err := state.GetCanonicalBlocks(1, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != 2 || blocks[0].Hash != block1Hash || blocks[1].Hash != block2Hash {
+				t.Fatal("blocks range was suppose to be cut at the latest block 2")
+			}
+
+			tx, err := state.GetTX(mustTestTxHash(t, tx1))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tx.BlockHash != block0Hash || tx.BlockNumber != 0 || tx.Confirmations != 3 || tx.TX.Nonce != tx1.Nonce {
+				t.Fatalf("tx1 was suppose to be in block 0 with 3 confirmations, got %+v", tx)
+			}
+
+			_, err = state.GetTX(Hash{0x01})
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("unknown TX was suppose to be not found, got %v", err)
+			}
+
+			acc, err := state.GetAccount(andrej)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if acc.Nonce != 2 || acc.Balance != 1000000-tx1.Cost()-tx2.Cost() || acc.BlockHash != block2Hash {
+				t.Fatalf("andrej account state was not as expected, got %+v", acc)
+			}
+
+			_, err = state.GetAccount(caesar)
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("caesar has no canonical state and was suppose to be not found, got %v", err)
+			}
+		})
+	}
+}
+
+func mustTestTxHash(t *testing.T, tx SignedTx) Hash {
+	hash, err := tx.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return hash
+}
@@ -1,24 +1,30 @@
 package database
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 )
 
 func initDataDirIfNotExists(dataDir string) error {
-	if fileExist(getGenesisJSONFilePath(dataDir)) {
-		return nil
-	}
-
 	err := os.MkdirAll(getDatabaseDirPath(dataDir), os.ModePerm)
 	if err != nil {
 		return err
 	}
 
-	err = writeGenesisToDisk(getGenesisJSONFilePath(dataDir))
-	if err != nil {
-		return err
+	if !fileExist(getGenesisJSONFilePath(dataDir)) {
+		err = writeGenesisToDisk(getGenesisJSONFilePath(dataDir))
+		if err != nil {
+			return err
+		}
+	}
+
+	if !fileExist(getBlocksDbFilePath(dataDir)) {
+		err = writeEmptyBlocksDbToDisk(getBlocksDbFilePath(dataDir))
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
@@ -36,6 +42,30 @@ func getBlocksDbFilePath(dataDir string) string {
 	return filepath.Join(getDatabaseDirPath(dataDir), "block.db")
 }
 
+func getBlocksHashIndexFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "block_hash.idx")
+}
+
+func getBlocksHeightIndexFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "block_height.idx")
+}
+
+func getHeadersDbFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "headers.db")
+}
+
+func getBoltDbFilePath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "chain.bolt")
+}
+
+func getSnapshotsDirPath(dataDir string) string {
+	return filepath.Join(getDatabaseDirPath(dataDir), "snapshots")
+}
+
+func getSnapshotFilePath(dataDir string, height uint64) string {
+	return filepath.Join(getSnapshotsDirPath(dataDir), fmt.Sprintf("snapshot_%d.json", height))
+}
+
 func fileExist(filePath string) bool {
 	_, err := os.Stat(filePath)
 	if err != nil && os.IsNotExist(err) {
@@ -5,16 +5,32 @@ import (
 	"io/ioutil"
 )
 
+const (
+	// DefaultDifficulty is initial and minimal mining difficulty
+	// when genesis doesn't configure one
+	DefaultDifficulty = uint64(1 << 24)
+	// DefaultTargetBlockTime is seconds expected between two blocks
+	DefaultTargetBlockTime = uint64(10)
+	// DefaultRetargetInterval is number of blocks between difficulty adjustments
+	DefaultRetargetInterval = uint64(10)
+)
+
 type genesis struct {
-	Balances map[Account]uint `json:"balances"`
+	Balances         map[Account]uint `json:"balances"`
+	Difficulty       uint64           `json:"difficulty"`
+	TargetBlockTime  uint64           `json:"target_block_time"`
+	RetargetInterval uint64           `json:"retarget_interval"`
 }
 
 var genesisJSON = `
 {
 	"genesis_time": "2019-03-18T00:00:00.000000000Z",
 	"chain_id": "the-blockchain-bar-ledger",
+	"difficulty": 16777216,
+	"target_block_time": 10,
+	"retarget_interval": 10,
 	"balances": {
-	  "andrej": 1000000
+	  "0x09ee50f2f37fcba1845de6fe5c762e83e65e755c": 1000000
 	}
 }`
 
@@ -30,6 +46,18 @@ func loadGenesis(path string) (genesis, error) {
 		return genesis{}, err
 	}
 
+	if loadedGenesis.Difficulty == 0 {
+		loadedGenesis.Difficulty = DefaultDifficulty
+	}
+
+	if loadedGenesis.TargetBlockTime == 0 {
+		loadedGenesis.TargetBlockTime = DefaultTargetBlockTime
+	}
+
+	if loadedGenesis.RetargetInterval < 2 {
+		loadedGenesis.RetargetInterval = DefaultRetargetInterval
+	}
+
 	return loadedGenesis, nil
 }
 
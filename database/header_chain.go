@@ -0,0 +1,338 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math/big"
+	"os"
+	"sync"
+
+	"the-blockchain-bar/logger"
+)
+
+// headerRecord is a headers.db line, the value is the binary encoded header
+type headerRecord struct {
+	Key      Hash   `json:"hash"`
+	Value    []byte `json:"header"`
+	Checksum uint32 `json:"checksum"`
+}
+
+// HeaderChain is the chain of block headers followed by a light node.
+// Headers are validated by their proof of work and parent links only,
+// balances and TXs are verified with Merkle proofs against the header roots.
+// HeaderChain is safe for concurrent use.
+type HeaderChain struct {
+	mu      sync.RWMutex
+	dbFile  *os.File
+	genesis genesis
+
+	// every known header, canonical and side branches
+	headers map[Hash]blockMeta
+	// canonical chain header hashes indexed by block number
+	canonical []Hash
+}
+
+// NewHeaderChainFromDisk loads the headers.db in the data dir
+// replaying the fork choice of every stored header
+func NewHeaderChainFromDisk(dataDir string) (*HeaderChain, error) {
+	return NewHeaderChainFromDiskWithLogger(dataDir, logger.Default())
+}
+
+// NewHeaderChainFromDiskWithLogger loads the headers.db in the data dir
+// replaying the fork choice of every stored header, logging into the logger
+func NewHeaderChainFromDiskWithLogger(dataDir string, log logger.Logger) (*HeaderChain, error) {
+	err := initDataDirIfNotExists(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	gen, err := loadGenesis(getGenesisJSONFilePath(dataDir))
+	if err != nil {
+		return nil, err
+	}
+
+	dbFile, err := os.OpenFile(getHeadersDbFilePath(dataDir), os.O_APPEND|os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	hc := &HeaderChain{
+		dbFile:    dbFile,
+		genesis:   gen,
+		headers:   make(map[Hash]blockMeta),
+		canonical: make([]Hash, 0),
+	}
+
+	err = truncateTornRecord(dbFile, "headers.db", log)
+	if err == nil {
+		err = hc.load()
+	}
+	if err != nil {
+		dbFile.Close()
+		return nil, err
+	}
+
+	return hc, nil
+}
+
+// LatestHeader return header of the canonical chain tip
+func (hc *HeaderChain) LatestHeader() BlockHeader {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	if len(hc.canonical) == 0 {
+		return BlockHeader{}
+	}
+
+	return hc.headers[hc.latestHash()].header
+}
+
+// LatestHash return hash of the canonical chain tip
+func (hc *HeaderChain) LatestHash() Hash {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	return hc.latestHash()
+}
+
+func (hc *HeaderChain) latestHash() Hash {
+	if len(hc.canonical) == 0 {
+		return Hash{}
+	}
+
+	return hc.canonical[len(hc.canonical)-1]
+}
+
+// LatestWork return cumulative proof of work of the canonical chain
+func (hc *HeaderChain) LatestWork() *big.Int {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	if len(hc.canonical) == 0 {
+		return big.NewInt(0)
+	}
+
+	return new(big.Int).Set(hc.headers[hc.latestHash()].work)
+}
+
+// HasHeader check if a header is known, canonical or in a side branch
+func (hc *HeaderChain) HasHeader(hash Hash) bool {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	_, isKnown := hc.headers[hash]
+	return isKnown
+}
+
+// CanonicalHeader return header of the block if it's in the canonical chain
+func (hc *HeaderChain) CanonicalHeader(hash Hash) (BlockHeader, bool) {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	return hc.canonicalHeader(hash)
+}
+
+func (hc *HeaderChain) canonicalHeader(hash Hash) (BlockHeader, bool) {
+	meta, isKnown := hc.headers[hash]
+	if !isKnown || meta.header.Number >= uint64(len(hc.canonical)) || hc.canonical[meta.header.Number] != hash {
+		return BlockHeader{}, false
+	}
+
+	return meta.header, true
+}
+
+// BlockLocator return canonical header hashes from the tip back to the first block,
+// dense near the tip and exponentially sparser further back
+func (hc *HeaderChain) BlockLocator() []Hash {
+	hc.mu.RLock()
+	defer hc.mu.RUnlock()
+
+	return blockLocator(hc.canonical)
+}
+
+// AddHeader validates and persists a new header, the canonical chain
+// switches to its branch when the branch has more cumulative work
+func (hc *HeaderChain) AddHeader(h BlockHeader) (Hash, error) {
+	hash, err := h.Hash()
+	if err != nil {
+		return Hash{}, err
+	}
+
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	if _, isKnown := hc.headers[hash]; isKnown {
+		return hash, nil
+	}
+
+	meta, err := hc.validateHeader(h)
+	if err != nil {
+		return Hash{}, err
+	}
+
+	err = hc.append(hash, h)
+	if err != nil {
+		return Hash{}, err
+	}
+
+	hc.insertHeader(hash, meta)
+
+	return hash, nil
+}
+
+// Close will close the headers.db
+func (hc *HeaderChain) Close() error {
+	hc.mu.Lock()
+	defer hc.mu.Unlock()
+
+	return hc.dbFile.Close()
+}
+
+// validateHeader verifies the header against its parent
+// and return the header with cumulative work of its branch
+func (hc *HeaderChain) validateHeader(h BlockHeader) (blockMeta, error) {
+	if h.Parent.IsEmpty() && h.Number == 0 {
+		err := validateBlockHeader(h, BlockHeader{}, false, hc.genesis.Difficulty)
+		if err != nil {
+			return blockMeta{}, err
+		}
+
+		return blockMeta{h, cumulativeWork(big.NewInt(0), h.Difficulty)}, nil
+	}
+
+	parent, isKnown := hc.headers[h.Parent]
+	if !isKnown {
+		return blockMeta{}, fmt.Errorf("unknown parent block '%x' of block '%d'", h.Parent, h.Number)
+	}
+
+	if h.Number != parent.header.Number+1 {
+		return blockMeta{}, fmt.Errorf("next expected block must be '%d' not '%d'", parent.header.Number+1, h.Number)
+	}
+
+	expectedDifficulty := difficultyAfter(hc.genesis, parent.header, func(hash Hash) BlockHeader {
+		return hc.headers[hash].header
+	})
+
+	err := validateBlockHeader(h, parent.header, true, expectedDifficulty)
+	if err != nil {
+		return blockMeta{}, err
+	}
+
+	return blockMeta{h, cumulativeWork(parent.work, h.Difficulty)}, nil
+}
+
+// insertHeader indexes a validated header and moves
+// the canonical chain to its branch when it has more work
+func (hc *HeaderChain) insertHeader(hash Hash, meta blockMeta) {
+	hc.headers[hash] = meta
+
+	if len(hc.canonical) > 0 && meta.work.Cmp(hc.headers[hc.latestHash()].work) <= 0 {
+		return
+	}
+
+	branch := make([]Hash, 0)
+	for ancestor := hash; ; {
+		if _, isCanonical := hc.canonicalHeader(ancestor); isCanonical {
+			break
+		}
+
+		branch = append(branch, ancestor)
+
+		parent := hc.headers[ancestor].header.Parent
+		if parent.IsEmpty() {
+			break
+		}
+		ancestor = parent
+	}
+
+	hc.canonical = hc.canonical[:meta.header.Number+1-uint64(len(branch))]
+	for i := len(branch) - 1; i >= 0; i-- {
+		hc.canonical = append(hc.canonical, branch[i])
+	}
+}
+
+func (hc *HeaderChain) append(hash Hash, h BlockHeader) error {
+	info, err := hc.dbFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	encoded, err := h.Encode()
+	if err != nil {
+		return err
+	}
+
+	recordJSON, err := json.Marshal(headerRecord{hash, encoded, crc32.ChecksumIEEE(encoded)})
+	if err != nil {
+		return err
+	}
+
+	_, err = hc.dbFile.Write(append(recordJSON, '\n'))
+	if err == nil {
+		err = hc.dbFile.Sync()
+	}
+	if err != nil {
+		// drop the partially written record so next appends start on a new line
+		hc.dbFile.Truncate(info.Size())
+		return err
+	}
+
+	return nil
+}
+
+func (hc *HeaderChain) load() error {
+	info, err := hc.dbFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	reader := bufio.NewReader(io.NewSectionReader(hc.dbFile, 0, info.Size()))
+	offset := int64(0)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		recordOffset := offset
+		offset += int64(len(line))
+
+		if len(line) == 1 {
+			continue
+		}
+
+		var record headerRecord
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			return fmt.Errorf("corrupted headers.db record at offset %d. %s", recordOffset, err.Error())
+		}
+
+		if crc32.ChecksumIEEE(record.Value) != record.Checksum {
+			return fmt.Errorf("corrupted headers.db record at offset %d. Checksum mismatch", recordOffset)
+		}
+
+		h, err := DecodeBlockHeader(record.Value)
+		if err != nil {
+			return fmt.Errorf("corrupted headers.db record at offset %d. %s", recordOffset, err.Error())
+		}
+
+		hash, err := h.Hash()
+		if err != nil {
+			return err
+		}
+
+		meta, err := hc.validateHeader(h)
+		if err != nil {
+			return fmt.Errorf("invalid header '%d' at headers.db offset %d. %s", h.Number, recordOffset, err.Error())
+		}
+
+		hc.insertHeader(hash, meta)
+	}
+}
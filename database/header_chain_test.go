@@ -0,0 +1,147 @@
+package database
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestHeaderChain_FollowsMoreWorkAndVerifiesProofs(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+	caesar := NewAccount("0x6fdc0d8d15ae6b4ebf45c52fd2aafbcbb19a65c8")
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	forkDataDir := copyTestDataDir(t, dataDir)
+	defer os.RemoveAll(forkDataDir)
+
+	forkState, err := NewStateFromDisk(forkDataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forkState.Close()
+
+	tx1 := signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), andrejKey)
+
+	block0 := addTestBlock(t, state, Hash{}, 0, babayaga, tx1)
+	block0Hash, _ := block0.Hash()
+	block1 := addTestBlock(t, state, block0Hash, 1, babayaga)
+	block1Hash, _ := block1.Hash()
+
+	_, err = forkState.AddBlock(block0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sideBlock1 := addTestBlock(t, forkState, block0Hash, 1, caesar)
+	sideBlock1Hash, _ := sideBlock1.Hash()
+	sideBlock2 := addTestBlock(t, forkState, sideBlock1Hash, 2, caesar)
+	sideBlock2Hash, _ := sideBlock2.Hash()
+
+	lightDataDir := copyTestDataDir(t, dataDir)
+	defer os.RemoveAll(lightDataDir)
+
+	headers, err := NewHeaderChainFromDisk(lightDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphanHeader := sideBlock2.Header
+	_, err = headers.AddHeader(orphanHeader)
+	if err == nil {
+		t.Fatal("header with an unknown parent was suppose to be rejected")
+	}
+
+	for _, b := range []Block{block0, block1, sideBlock1} {
+		_, err = headers.AddHeader(b.Header)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if headers.LatestHash() != block1Hash {
+		t.Fatal("a branch with equal work must not reorganize the header chain")
+	}
+
+	forgedHeader := sideBlock2.Header
+	forgedHeader.Difficulty = 2
+	_, err = headers.AddHeader(forgedHeader)
+	if err == nil {
+		t.Fatal("header with a wrong difficulty was suppose to be rejected")
+	}
+
+	_, err = headers.AddHeader(sideBlock2.Header)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if headers.LatestHash() != sideBlock2Hash {
+		t.Fatal("the branch with more work was suppose to become the canonical header chain")
+	}
+
+	if _, isCanonical := headers.CanonicalHeader(block1Hash); isCanonical {
+		t.Fatal("block 1 was suppose to leave the canonical header chain")
+	}
+
+	accountProof, err := forkState.GetAccountProof(caesar)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, isCanonical := headers.CanonicalHeader(accountProof.BlockHash)
+	if !isCanonical {
+		t.Fatal("account proof was suppose to be of the header chain tip")
+	}
+
+	isValid, err := VerifyAccountProof(accountProof, header.StateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isValid || accountProof.Balance != 2*BlockReward {
+		t.Fatal("caesar balance proof was suppose to match the header state root")
+	}
+
+	accountProof.Balance = 1000
+	isValid, err = VerifyAccountProof(accountProof, header.StateRoot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if isValid {
+		t.Fatal("forged caesar balance was suppose to fail the proof")
+	}
+
+	tx1Hash, _ := tx1.Hash()
+	txProof, err := forkState.GetTXProof(tx1Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, isCanonical = headers.CanonicalHeader(txProof.BlockHash)
+	if !isCanonical || !VerifyMerkleProof(tx1Hash, header.TXRoot, txProof.Proof) {
+		t.Fatal("tx1 proof was suppose to match the header TX root")
+	}
+
+	headers.Close()
+
+	// replaying the stored headers must choose the same branch
+	headers, err = NewHeaderChainFromDisk(lightDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer headers.Close()
+
+	if headers.LatestHash() != sideBlock2Hash || headers.LatestHeader().Number != 2 {
+		t.Fatal("restarted header chain was suppose to keep the branch with more work")
+	}
+}
@@ -0,0 +1,342 @@
+package database
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"sort"
+)
+
+const (
+	// merkleLeafPrefix and merkleNodePrefix separate leaf and inner node hashes,
+	// so an inner node can't be proven as a leaf
+	merkleLeafPrefix = byte(0x00)
+	merkleNodePrefix = byte(0x01)
+)
+
+// MerkleProofStep is a sibling hash on the path from a leaf to the Merkle root
+type MerkleProofStep struct {
+	Hash Hash `json:"hash"`
+	// IsLeft tells the sibling is hashed on the left side
+	IsLeft bool `json:"is_left"`
+}
+
+// MerkleRoot return root of the Merkle tree over the hashes,
+// the last node of a level with an odd count is promoted to the next level as is
+func MerkleRoot(hashes []Hash) Hash {
+	if len(hashes) == 0 {
+		return Hash{}
+	}
+
+	level := merkleLeaves(hashes)
+	for len(level) > 1 {
+		level = merkleParentLevel(level)
+	}
+
+	return level[0]
+}
+
+// NewMerkleProof return sibling hashes proving the hash at the index is in the tree
+func NewMerkleProof(hashes []Hash, index int) ([]MerkleProofStep, error) {
+	if index < 0 || index >= len(hashes) {
+		return nil, fmt.Errorf("leaf %d is out of the %d Merkle tree leaves", index, len(hashes))
+	}
+
+	proof := make([]MerkleProofStep, 0)
+
+	level := merkleLeaves(hashes)
+	for len(level) > 1 {
+		// a promoted node has no sibling on its level
+		sibling := index ^ 1
+		if sibling < len(level) {
+			proof = append(proof, MerkleProofStep{level[sibling], sibling < index})
+		}
+
+		level = merkleParentLevel(level)
+		index /= 2
+	}
+
+	return proof, nil
+}
+
+// VerifyMerkleProof check if the proof leads from the leaf hash to the root
+func VerifyMerkleProof(leaf Hash, root Hash, proof []MerkleProofStep) bool {
+	hash := merkleLeaf(leaf)
+	for _, step := range proof {
+		if step.IsLeft {
+			hash = merkleParent(step.Hash, hash)
+		} else {
+			hash = merkleParent(hash, step.Hash)
+		}
+	}
+
+	return hash == root
+}
+
+// TXsMerkleRoot return Merkle root of the TX hashes, a TX can't be included twice
+func TXsMerkleRoot(txs []SignedTx) (Hash, error) {
+	hashes, err := txHashes(txs)
+	if err != nil {
+		return Hash{}, err
+	}
+
+	isIncluded := make(map[Hash]bool, len(hashes))
+	for _, hash := range hashes {
+		if isIncluded[hash] {
+			return Hash{}, fmt.Errorf("duplicate TX '%x'", hash)
+		}
+
+		isIncluded[hash] = true
+	}
+
+	return MerkleRoot(hashes), nil
+}
+
+// legacyTXsMerkleRoot return TX root of the legacy blocks, their tree hashed leaves
+// and inner nodes the same way and paired the last node of an odd level with itself
+func legacyTXsMerkleRoot(txs []SignedTx) (Hash, error) {
+	hashes, err := txHashes(txs)
+	if err != nil || len(hashes) == 0 {
+		return Hash{}, err
+	}
+
+	level := hashes
+	for len(level) > 1 {
+		parents := make([]Hash, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			right := level[i]
+			if i+1 < len(level) {
+				right = level[i+1]
+			}
+
+			parents = append(parents, sha256.Sum256(append(level[i][:], right[:]...)))
+		}
+
+		level = parents
+	}
+
+	return level[0], nil
+}
+
+// StateMerkleRoot return Merkle root of the accounts ordered by address,
+// accounts without balance and TXs aren't part of the state
+func StateMerkleRoot(balances map[Account]uint, nonces map[Account]uint) (Hash, error) {
+	_, hashes, err := stateLeaves(balances, nonces)
+	if err != nil {
+		return Hash{}, err
+	}
+
+	return MerkleRoot(hashes), nil
+}
+
+// AccountLeafHash return hash of the account state tree leaf
+func AccountLeafHash(acc Account, balance uint, nonce uint) (Hash, error) {
+	encoded, err := encodeVersioned(0, accountRLP{acc, uint64(balance), uint64(nonce)})
+	if err != nil {
+		return Hash{}, err
+	}
+
+	return sha256.Sum256(encoded), nil
+}
+
+// stateLeaves return accounts of the state tree ordered by address with their leaf hashes
+func stateLeaves(balances map[Account]uint, nonces map[Account]uint) ([]Account, []Hash, error) {
+	accounts := make([]Account, 0, len(balances))
+	for acc, balance := range balances {
+		if balance > 0 || nonces[acc] > 0 {
+			accounts = append(accounts, acc)
+		}
+	}
+
+	for acc, nonce := range nonces {
+		if _, hasBalance := balances[acc]; !hasBalance && nonce > 0 {
+			accounts = append(accounts, acc)
+		}
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return bytes.Compare(accounts[i][:], accounts[j][:]) < 0
+	})
+
+	hashes := make([]Hash, 0, len(accounts))
+	for _, acc := range accounts {
+		hash, err := AccountLeafHash(acc, balances[acc], nonces[acc])
+		if err != nil {
+			return nil, nil, err
+		}
+
+		hashes = append(hashes, hash)
+	}
+
+	return accounts, hashes, nil
+}
+
+func txHashes(txs []SignedTx) ([]Hash, error) {
+	hashes := make([]Hash, 0, len(txs))
+	for _, tx := range txs {
+		txHash, err := tx.Hash()
+		if err != nil {
+			return nil, err
+		}
+
+		hashes = append(hashes, txHash)
+	}
+
+	return hashes, nil
+}
+
+func merkleLeaves(hashes []Hash) []Hash {
+	leaves := make([]Hash, 0, len(hashes))
+	for _, hash := range hashes {
+		leaves = append(leaves, merkleLeaf(hash))
+	}
+
+	return leaves
+}
+
+func merkleParentLevel(level []Hash) []Hash {
+	parents := make([]Hash, 0, (len(level)+1)/2)
+	for i := 0; i < len(level); i += 2 {
+		if i+1 == len(level) {
+			parents = append(parents, level[i])
+			break
+		}
+
+		parents = append(parents, merkleParent(level[i], level[i+1]))
+	}
+
+	return parents
+}
+
+func merkleLeaf(hash Hash) Hash {
+	return sha256.Sum256(append([]byte{merkleLeafPrefix}, hash[:]...))
+}
+
+func merkleParent(left Hash, right Hash) Hash {
+	node := make([]byte, 0, 1+2*len(left))
+	node = append(node, merkleNodePrefix)
+	node = append(node, left[:]...)
+
+	return sha256.Sum256(append(node, right[:]...))
+}
+
+// TXProof is a Merkle proof of a TX included in a canonical block
+type TXProof struct {
+	TXHash      Hash
+	BlockHash   Hash
+	BlockNumber uint64
+	TXRoot      Hash
+	Proof       []MerkleProofStep
+}
+
+// GetTXProof return Merkle proof of the TX in the canonical chain
+func (s *State) GetTXProof(txHash Hash) (TXProof, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	b, err := s.findCanonicalTXBlock(txHash)
+	if err != nil {
+		return TXProof{}, err
+	}
+
+	hashes, err := txHashes(b.TXs)
+	if err != nil {
+		return TXProof{}, err
+	}
+
+	for i, hash := range hashes {
+		if hash != txHash {
+			continue
+		}
+
+		proof, err := NewMerkleProof(hashes, i)
+		if err != nil {
+			return TXProof{}, err
+		}
+
+		blockHash, err := b.Hash()
+		if err != nil {
+			return TXProof{}, err
+		}
+
+		return TXProof{
+			TXHash:      txHash,
+			BlockHash:   blockHash,
+			BlockNumber: b.Header.Number,
+			TXRoot:      b.Header.TXRoot,
+			Proof:       proof,
+		}, nil
+	}
+
+	return TXProof{}, fmt.Errorf("TX '%x' %w", txHash, ErrNotFound)
+}
+
+// findCanonicalTXBlock return the canonical block including the TX, looked up in the store TX index
+func (s *State) findCanonicalTXBlock(txHash Hash) (Block, error) {
+	blockHash, err := s.store.TXBlockHash(txHash)
+	if err != nil {
+		return Block{}, err
+	}
+
+	return s.store.Block(blockHash)
+}
+
+// AccountProof is a Merkle proof of an account balance and nonce
+// in the state committed by a canonical block
+type AccountProof struct {
+	Account     Account
+	Balance     uint
+	Nonce       uint
+	BlockHash   Hash
+	BlockNumber uint64
+	StateRoot   Hash
+	Proof       []MerkleProofStep
+}
+
+// GetAccountProof return Merkle proof of the account state after the latest block.
+// Accounts without balance and TXs aren't part of the state and can't be proven.
+func (s *State) GetAccountProof(acc Account) (AccountProof, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasGenesisBlock {
+		return AccountProof{}, fmt.Errorf("no block commits to the account state yet")
+	}
+
+	accounts, hashes, err := stateLeaves(s.Balances, s.Account2Nonce)
+	if err != nil {
+		return AccountProof{}, err
+	}
+
+	i := sort.Search(len(accounts), func(i int) bool {
+		return bytes.Compare(accounts[i][:], acc[:]) >= 0
+	})
+	if i == len(accounts) || accounts[i] != acc {
+		return AccountProof{}, fmt.Errorf("account '%s' not found in the state", acc.String())
+	}
+
+	proof, err := NewMerkleProof(hashes, i)
+	if err != nil {
+		return AccountProof{}, err
+	}
+
+	return AccountProof{
+		Account:     acc,
+		Balance:     s.Balances[acc],
+		Nonce:       s.Account2Nonce[acc],
+		BlockHash:   s.latestBlockHash,
+		BlockNumber: s.latestBlock.Header.Number,
+		StateRoot:   s.latestBlock.Header.StateRoot,
+		Proof:       proof,
+	}, nil
+}
+
+// VerifyAccountProof check if the proof leads from the account state to the state root
+func VerifyAccountProof(p AccountProof, stateRoot Hash) (bool, error) {
+	leaf, err := AccountLeafHash(p.Account, p.Balance, p.Nonce)
+	if err != nil {
+		return false, err
+	}
+
+	return VerifyMerkleProof(leaf, stateRoot, p.Proof), nil
+}
@@ -0,0 +1,160 @@
+package database
+
+import (
+	"crypto/sha256"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestNewMerkleProof(t *testing.T) {
+	for leaves := 1; leaves <= 7; leaves++ {
+		hashes := make([]Hash, 0)
+		for i := 0; i < leaves; i++ {
+			hashes = append(hashes, sha256.Sum256([]byte{byte(i)}))
+		}
+
+		root := MerkleRoot(hashes)
+
+		for i, hash := range hashes {
+			proof, err := NewMerkleProof(hashes, i)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !VerifyMerkleProof(hash, root, proof) {
+				t.Fatalf("proof of leaf %d out of %d leaves was suppose to be valid", i, leaves)
+			}
+
+			if VerifyMerkleProof(sha256.Sum256([]byte("forged")), root, proof) {
+				t.Fatalf("proof of leaf %d out of %d leaves was suppose to be invalid for another leaf", i, leaves)
+			}
+		}
+	}
+}
+
+func TestMerkleRoot_ResistsMutations(t *testing.T) {
+	a := sha256.Sum256([]byte("a"))
+	b := sha256.Sum256([]byte("b"))
+	c := sha256.Sum256([]byte("c"))
+
+	if MerkleRoot([]Hash{a, b, c}) == MerkleRoot([]Hash{a, b, c, c}) {
+		t.Fatal("repeating the last leaf was not suppose to keep the root")
+	}
+
+	// the inner node of a and b proven as a leaf of the tree [ab, c]
+	root := MerkleRoot([]Hash{a, b, c})
+	proof, err := NewMerkleProof([]Hash{a, b, c}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	innerNode := merkleParent(merkleLeaf(a), merkleLeaf(b))
+	if VerifyMerkleProof(innerNode, root, proof[1:]) {
+		t.Fatal("inner node was not suppose to be provable as a leaf")
+	}
+}
+
+func TestState_AddBlockRejectsDuplicateTXs(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	tx := signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), andrejKey)
+
+	_, err = NewBlock(Hash{}, 0, 0, 0, 1, babayaga, Hash{}, []SignedTx{tx, tx})
+	if err == nil {
+		t.Fatal("new block with a repeated TX was suppose to be rejected")
+	}
+
+	b := newTestBlock(t, Hash{}, 0, 0, 0, 1, babayaga, Hash{}, []SignedTx{tx})
+	b.TXs = append(b.TXs, tx)
+
+	_, err = state.AddBlock(b)
+	if err == nil || !strings.Contains(err.Error(), "duplicate TX") {
+		t.Fatalf("block with a repeated TX was suppose to be rejected, got %v", err)
+	}
+}
+
+func TestState_AddBlockRejectsTXsNotInTXRoot(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	tx1 := signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), andrejKey)
+	tx2 := signTestTx(t, NewTx(andrej, babayaga, 20, 1, ""), andrejKey)
+
+	stateRoot, err := state.NextStateRoot(babayaga, []SignedTx{tx1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b := newTestBlock(t, Hash{}, 0, 0, 0, 1, babayaga, stateRoot, []SignedTx{tx1})
+	b.TXs = []SignedTx{tx2}
+
+	_, err = state.AddBlock(b)
+	if err == nil {
+		t.Fatal("block with TXs not matching the header TX root was suppose to be rejected")
+	}
+
+	b.TXs = []SignedTx{tx1}
+	blockHash, err := state.AddBlock(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx1Hash, _ := tx1.Hash()
+	proof, err := state.GetTXProof(tx1Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if proof.BlockHash != blockHash || !VerifyMerkleProof(tx1Hash, b.Header.TXRoot, proof.Proof) {
+		t.Fatal("TX proof was suppose to verify against the block TX root")
+	}
+}
+
+func TestState_AddBlockRejectsWrongStateRoot(t *testing.T) {
+	dataDir, _ := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	// the state root of a block crediting the reward to another miner
+	stateRoot, err := state.NextStateRoot(NewAccount("0x6fdc0d8d15ae6b4ebf45c52fd2aafbcbb19a65c8"), []SignedTx{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = state.AddBlock(newTestBlock(t, Hash{}, 0, 0, 0, 1, babayaga, stateRoot, []SignedTx{}))
+	if err == nil {
+		t.Fatal("block with a state root not matching the applied block was suppose to be rejected")
+	}
+
+	if state.Balances[babayaga] != 0 {
+		t.Fatal("rejected block reward was not suppose to be credited")
+	}
+}
@@ -0,0 +1,392 @@
+package database
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"the-blockchain-bar/fs"
+)
+
+const (
+	// snapshotInterval is number of blocks between periodic state snapshots
+	snapshotInterval = 500
+	// snapshotsKept is how many most recent snapshots are kept in the data dir
+	snapshotsKept = 2
+)
+
+// Snapshot is the state after a canonical block. Snapshots are taken
+// maxReorgDepth blocks behind the tip, where the chain can't be reorganized anymore.
+type Snapshot struct {
+	Hash   Hash   `json:"hash"`
+	Height uint64 `json:"height"`
+	// Work is cumulative proof of work of the chain up to the snapshot block
+	Work     *big.Int         `json:"work"`
+	Balances map[Account]uint `json:"balances"`
+	Nonces   map[Account]uint `json:"nonces"`
+}
+
+// snapshotFile is the snapshot on disk, the checksum is CRC-32 of the snapshot JSON
+type snapshotFile struct {
+	Snapshot json.RawMessage `json:"snapshot"`
+	Checksum uint32          `json:"checksum"`
+}
+
+// WriteSnapshot writes snapshot of the state after the oldest canonical block
+// which can still be rolled back to, and removes the old snapshots
+func (s *State) WriteSnapshot() (Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeSnapshot()
+}
+
+func (s *State) writeSnapshot() (Snapshot, error) {
+	snapshot, err := s.reorgSafeSnapshot()
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	err = writeSnapshot(s.dataDir, snapshot)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	heights, err := listSnapshotHeights(s.dataDir)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	for j := snapshotsKept; j < len(heights); j++ {
+		os.Remove(getSnapshotFilePath(s.dataDir, heights[j]))
+	}
+
+	return snapshot, nil
+}
+
+// reorgSafeSnapshot return the state after the oldest canonical block which can still be rolled back to
+func (s *State) reorgSafeSnapshot() (Snapshot, error) {
+	balances := make(map[Account]uint)
+	for acc, balance := range s.Balances {
+		balances[acc] = balance
+	}
+
+	nonces := make(map[Account]uint)
+	for acc, nonce := range s.Account2Nonce {
+		nonces[acc] = nonce
+	}
+
+	// roll the copied state back with the undos of the recent blocks
+	i := len(s.canonical) - 1
+	for ; i >= 0; i-- {
+		undo, hasUndo := s.undos[s.canonical[i]]
+		if !hasUndo {
+			break
+		}
+
+		for acc, prev := range undo {
+			delete(balances, acc)
+			if prev.hasBalance {
+				balances[acc] = prev.balance
+			}
+
+			delete(nonces, acc)
+			if prev.hasNonce {
+				nonces[acc] = prev.nonce
+			}
+		}
+	}
+
+	if i < 0 {
+		return Snapshot{}, fmt.Errorf("chain of %d blocks is too short to snapshot, snapshots are taken %d blocks behind the tip", len(s.canonical), maxReorgDepth)
+	}
+
+	return Snapshot{
+		Hash:     s.canonical[i],
+		Height:   uint64(i),
+		Work:     new(big.Int).Set(s.blocks[s.canonical[i]].work),
+		Balances: balances,
+		Nonces:   nonces,
+	}, nil
+}
+
+// loadSnapshotState restores the state from the balances kept by the store, or from the most
+// recent snapshot of a canonical block, and replays the blocks appended after it. Canonical hashes
+// up to the snapshot come from the store height index, only headers of the blocks a reorg
+// or retarget can reach are loaded. It returns false when there is no valid snapshot.
+func (s *State) loadSnapshotState() (bool, error) {
+	snapshots, err := s.readSnapshots()
+	if err != nil || len(snapshots) == 0 {
+		return false, err
+	}
+
+	var snapshot Snapshot
+	var canonical []Hash
+	var window []Block
+	for _, snapshot = range snapshots {
+		canonical, window, err = s.loadSnapshotCanonicalChain(snapshot)
+		if err == nil {
+			err = validateSnapshotStateRoot(snapshot, window[len(window)-1].Header)
+		}
+		if err == nil {
+			err = validateSnapshotWork(snapshot, window)
+		}
+		if err != nil {
+			s.log.Warn("Skipping invalid snapshot", "height", snapshot.Height, "err", err)
+			canonical = nil
+			continue
+		}
+
+		break
+	}
+
+	if canonical == nil {
+		return false, nil
+	}
+
+	windowStart := snapshot.Height + 1 - uint64(len(window))
+	for number, hash := range canonical[:windowStart] {
+		s.unloaded[hash] = uint64(number)
+	}
+
+	// the cumulative work counts from the genesis block
+	// so it can be compared with the work peers announce
+	work := windowParentWork(snapshot, window)
+	for i, b := range window {
+		work = cumulativeWork(work, b.Header.Difficulty)
+		s.blocks[canonical[windowStart+uint64(i)]] = blockMeta{b.Header, work}
+	}
+
+	s.Balances = snapshot.Balances
+	s.Account2Nonce = snapshot.Nonces
+	s.canonical = canonical
+	s.storedCanonical = len(canonical)
+	s.latestBlock = window[len(window)-1]
+	s.latestBlockHash = snapshot.Hash
+	s.hasGenesisBlock = true
+
+	var importErr error
+	err = s.store.ForEachAfter(snapshot.Hash, func(hash Hash, b Block) bool {
+		// branches forking before the window can't be reorganized to
+		if _, isLoaded := s.blocks[b.Header.Parent]; !isLoaded {
+			return true
+		}
+
+		_, importErr = s.importBlock(b, hash)
+		return importErr == nil
+	})
+	if err != nil {
+		return false, err
+	}
+	if importErr != nil {
+		return false, importErr
+	}
+
+	return true, nil
+}
+
+// readSnapshots return the balances kept by the store followed by
+// the snapshot files from the most recent, unreadable ones are skipped
+func (s *State) readSnapshots() ([]Snapshot, error) {
+	snapshots := make([]Snapshot, 0)
+
+	if balancesStore, ok := s.store.(BalancesStore); ok {
+		snapshot, isStored, err := balancesStore.Balances()
+		if err != nil {
+			s.log.Warn("Skipping invalid stored balances", "err", err)
+		} else if isStored {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+
+	heights, err := listSnapshotHeights(s.dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, height := range heights {
+		snapshot, err := readSnapshot(getSnapshotFilePath(s.dataDir, height))
+		if err != nil {
+			s.log.Warn("Skipping invalid snapshot", "height", height, "err", err)
+			continue
+		}
+
+		snapshots = append(snapshots, snapshot)
+	}
+
+	return snapshots, nil
+}
+
+// loadSnapshotCanonicalChain return canonical block hashes up to the snapshot block
+// and the blocks of the window ending with the snapshot block
+func (s *State) loadSnapshotCanonicalChain(snapshot Snapshot) ([]Hash, []Block, error) {
+	canonical, err := s.store.CanonicalHashes(0, snapshot.Height+1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if canonical[snapshot.Height] != snapshot.Hash {
+		return nil, nil, fmt.Errorf("block '%x' isn't canonical at height %d", snapshot.Hash, snapshot.Height)
+	}
+
+	windowSize := uint64(maxReorgDepth)
+	if s.genesis.RetargetInterval > windowSize {
+		windowSize = s.genesis.RetargetInterval
+	}
+
+	windowStart := uint64(0)
+	if snapshot.Height+1 > windowSize {
+		windowStart = snapshot.Height + 1 - windowSize
+	}
+
+	window, err := s.store.CanonicalBlocks(windowStart, snapshot.Height+1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for i, b := range window {
+		number := windowStart + uint64(i)
+		if b.Header.Number != number || (i > 0 && b.Header.Parent != canonical[number-1]) {
+			return nil, nil, fmt.Errorf("canonical block '%x' at height %d isn't stored", canonical[number], number)
+		}
+	}
+
+	hash, err := window[len(window)-1].Hash()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if hash != snapshot.Hash {
+		return nil, nil, fmt.Errorf("canonical block at height %d isn't the snapshot block '%x'", snapshot.Height, snapshot.Hash)
+	}
+
+	return canonical, window, nil
+}
+
+func writeSnapshot(dataDir string, snapshot Snapshot) error {
+	snapshotJSON, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+
+	fileJSON, err := json.Marshal(snapshotFile{snapshotJSON, crc32.ChecksumIEEE(snapshotJSON)})
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(getSnapshotsDirPath(dataDir), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	return fs.WriteFileSynced(getSnapshotFilePath(dataDir, snapshot.Height), fileJSON)
+}
+
+// validateSnapshotStateRoot verifies the snapshot accounts against the block state root
+func validateSnapshotStateRoot(snapshot Snapshot, header BlockHeader) error {
+	stateRoot, err := StateMerkleRoot(snapshot.Balances, snapshot.Nonces)
+	if err != nil {
+		return err
+	}
+
+	if stateRoot != header.StateRoot {
+		return fmt.Errorf("state root '%x' doesn't match block state root '%x'", stateRoot, header.StateRoot)
+	}
+
+	return nil
+}
+
+// validateSnapshotWork verifies the snapshot cumulative work covers at least the work of the window blocks
+func validateSnapshotWork(snapshot Snapshot, window []Block) error {
+	if snapshot.Work == nil {
+		return fmt.Errorf("snapshot has no cumulative work")
+	}
+
+	if windowParentWork(snapshot, window).Sign() < 0 {
+		return fmt.Errorf("cumulative work '%s' is less than work of the blocks up to the snapshot", snapshot.Work.String())
+	}
+
+	return nil
+}
+
+// windowParentWork return cumulative work of the window first block parent,
+// the snapshot work without the work of the window blocks
+func windowParentWork(snapshot Snapshot, window []Block) *big.Int {
+	work := new(big.Int).Set(snapshot.Work)
+	for _, b := range window {
+		work.Sub(work, new(big.Int).SetUint64(b.Header.Difficulty))
+	}
+
+	return work
+}
+
+func readSnapshot(path string) (Snapshot, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	var file snapshotFile
+	err = json.Unmarshal(content, &file)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if crc32.ChecksumIEEE(file.Snapshot) != file.Checksum {
+		return Snapshot{}, fmt.Errorf("checksum mismatch")
+	}
+
+	var snapshot Snapshot
+	err = json.Unmarshal(file.Snapshot, &snapshot)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	if snapshot.Balances == nil {
+		snapshot.Balances = make(map[Account]uint)
+	}
+
+	if snapshot.Nonces == nil {
+		snapshot.Nonces = make(map[Account]uint)
+	}
+
+	return snapshot, nil
+}
+
+// listSnapshotHeights return heights of the snapshots in the data dir, most recent first
+func listSnapshotHeights(dataDir string) ([]uint64, error) {
+	files, err := ioutil.ReadDir(getSnapshotsDirPath(dataDir))
+	if os.IsNotExist(err) {
+		return []uint64{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	heights := make([]uint64, 0)
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, "snapshot_") || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+
+		height, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, "snapshot_"), ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		heights = append(heights, height)
+	}
+
+	sort.Slice(heights, func(i, j int) bool {
+		return heights[i] > heights[j]
+	})
+
+	return heights, nil
+}
@@ -0,0 +1,262 @@
+package database
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestState_RestoresFromSnapshot(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+	marker := NewAccount("0x6fdc0d8d15ae6b4ebf45c52fd2aafbcbb19a65c8")
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := Hash{}
+	for number := uint64(0); number < maxReorgDepth+5; number++ {
+		txs := []SignedTx{}
+		if number%10 == 1 {
+			txs = append(txs, signTestTx(t, NewTx(andrej, babayaga, 10, state.GetNextAccountNonce(andrej), ""), andrejKey))
+		}
+
+		stateRoot, err := state.NextStateRoot(babayaga, txs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// blocks mined in the target block time keep the trivial test difficulty
+		parent, err = state.AddBlock(newTestBlock(t, parent, number, 0, number*DefaultTargetBlockTime, 1, babayaga, stateRoot, txs))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	snapshot, err := state.WriteSnapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if snapshot.Height != 4 {
+		t.Fatalf("snapshot was suppose to be taken %d blocks behind the tip at height 4, not %d", maxReorgDepth, snapshot.Height)
+	}
+
+	balances := state.Balances
+	nonces := state.Account2Nonce
+	state.Close()
+
+	state, err = NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state.LatestBlockHash() != parent {
+		t.Fatal("restored state was suppose to replay blocks after the snapshot up to the tip")
+	}
+
+	if !reflect.DeepEqual(state.Balances, balances) || !reflect.DeepEqual(state.Account2Nonce, nonces) {
+		t.Fatal("restored state was suppose to have the same balances and nonces")
+	}
+
+	blocks, err := state.GetBlocksAfter(Hash{}, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(blocks) != maxReorgDepth+5 {
+		t.Fatalf("restored state was suppose to have %d canonical blocks, not %d", maxReorgDepth+5, len(blocks))
+	}
+	state.Close()
+
+	// a snapshot not matching the block state root must be skipped
+	snapshot.Balances[marker] = 1
+	err = writeSnapshot(dataDir, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, hasMarker := state.Balances[marker]; hasMarker || !reflect.DeepEqual(state.Balances, balances) {
+		t.Fatal("state was suppose to be replayed from the first block when the snapshot is forged")
+	}
+	state.Close()
+
+	err = ioutil.WriteFile(getSnapshotFilePath(dataDir, snapshot.Height), []byte(`{"snapshot":{}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err = NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if !reflect.DeepEqual(state.Balances, balances) {
+		t.Fatal("state was suppose to be replayed from the first block when the snapshot is corrupted")
+	}
+}
+
+func TestState_RestoresFromSnapshotWithoutLoadingOldBlocks(t *testing.T) {
+	for _, backend := range []string{BackendJSONLines, BackendBolt} {
+		t.Run(backend, func(t *testing.T) {
+			dataDir, _ := createTestDataDir(t)
+			defer os.RemoveAll(dataDir)
+
+			babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+			state, err := NewStateFromDisk(dataDir, backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			blockHashes := make([]Hash, 0)
+			parent := Hash{}
+			for number := uint64(0); number < 2*maxReorgDepth+10; number++ {
+				stateRoot, err := state.NextStateRoot(babayaga, []SignedTx{})
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				parent, err = state.AddBlock(newTestBlock(t, parent, number, 0, number*DefaultTargetBlockTime, 1, babayaga, stateRoot, []SignedTx{}))
+				if err != nil {
+					t.Fatal(err)
+				}
+				blockHashes = append(blockHashes, parent)
+			}
+
+			snapshot, err := state.WriteSnapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			balances := state.Balances
+			work := state.LatestBlockWork()
+			state.Close()
+
+			state, err = NewStateFromDisk(dataDir, backend)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer state.Close()
+
+			// blocks before the reorg window of the snapshot block stay in the store
+			if len(state.unloaded) != int(snapshot.Height)+1-maxReorgDepth || len(state.blocks) != len(blockHashes)-len(state.unloaded) {
+				t.Fatalf("%d blocks before the snapshot window were not suppose to be loaded, got %d unloaded", snapshot.Height+1-maxReorgDepth, len(state.unloaded))
+			}
+
+			if state.LatestBlockHash() != parent || !reflect.DeepEqual(state.Balances, balances) {
+				t.Fatal("restored state was suppose to replay blocks after the snapshot up to the tip")
+			}
+
+			if state.LatestBlockWork().Cmp(work) != 0 {
+				t.Fatalf("restored cumulative work was suppose to count from the genesis block, %s instead of %s", state.LatestBlockWork(), work)
+			}
+
+			if !state.HasBlock(blockHashes[3]) {
+				t.Fatal("unloaded block was suppose to be known")
+			}
+
+			blocks, err := state.GetBlocksAfter(blockHashes[3], 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(blocks) != 2 || blocks[0].Header.Number != 4 {
+				t.Fatal("blocks after an unloaded block were suppose to be served")
+			}
+
+			headers, err := state.GetHeadersAfter(blockHashes[3], 5)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(headers) != 5 || headers[0].Parent != blockHashes[3] {
+				t.Fatal("5 headers after an unloaded block were suppose to be read from the store")
+			}
+
+			stateRoot, err := state.NextStateRoot(babayaga, []SignedTx{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			number := uint64(len(blockHashes))
+			_, err = state.AddBlock(newTestBlock(t, parent, number, 0, number*DefaultTargetBlockTime, 1, babayaga, stateRoot, []SignedTx{}))
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestState_RestoresFromBoltBalancesWithoutReplayingOldBlocks(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	state, err := NewStateFromDisk(dataDir, BackendBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parent := Hash{}
+	for number := uint64(0); number < 2*maxReorgDepth+10; number++ {
+		txs := []SignedTx{}
+		if number == 5 {
+			txs = append(txs, signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), andrejKey))
+		}
+
+		stateRoot, err := state.NextStateRoot(babayaga, txs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		parent, err = state.AddBlock(newTestBlock(t, parent, number, 0, number*DefaultTargetBlockTime, 1, babayaga, stateRoot, txs))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	balances := state.Balances
+	nonces := state.Account2Nonce
+	work := state.LatestBlockWork()
+
+	stored, isStored, err := state.store.(BalancesStore).Balances()
+	if err != nil || !isStored {
+		t.Fatalf("balances were suppose to be stored, got %v", err)
+	}
+	state.Close()
+
+	// the balances are stored as of the oldest block a reorg can roll back to
+	if stored.Height != 2*maxReorgDepth+9-maxReorgDepth {
+		t.Fatalf("balances were suppose to be stored %d blocks behind the tip, not at height %d", maxReorgDepth, stored.Height)
+	}
+
+	state, err = NewStateFromDisk(dataDir, BackendBolt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	if len(state.unloaded) != int(stored.Height)+1-maxReorgDepth {
+		t.Fatalf("%d blocks before the stored balances window were not suppose to be loaded, got %d unloaded", stored.Height+1-maxReorgDepth, len(state.unloaded))
+	}
+
+	if state.LatestBlockHash() != parent || !reflect.DeepEqual(state.Balances, balances) || !reflect.DeepEqual(state.Account2Nonce, nonces) {
+		t.Fatal("restored state was suppose to replay blocks after the stored balances up to the tip")
+	}
+
+	if state.LatestBlockWork().Cmp(work) != 0 {
+		t.Fatalf("restored cumulative work was suppose to count from the genesis block, %s instead of %s", state.LatestBlockWork(), work)
+	}
+}
@@ -1,28 +1,61 @@
 package database
 
 import (
-	"bufio"
-	"encoding/json"
 	"fmt"
-	"os"
+	"math/big"
 	"reflect"
-	"sort"
+	"sync"
+	"time"
+
+	"the-blockchain-bar/logger"
 )
 
+// maxFutureBlockTimeSeconds is how far ahead of the local clock a block can be
+const maxFutureBlockTimeSeconds = 2 * 60 * 60
+
 // State represent business logic for db component
 // Know all user balances
 // and who transferred tbb tokens to whom,
-// and how many were transferred
+// and how many were transferred.
+// State is safe for concurrent use, Balances and Account2Nonce
+// must only be read directly by the goroutine owning the state.
 type State struct {
+	mu  sync.RWMutex
+	log logger.Logger
+
 	Balances        map[Account]uint
-	dbFile          *os.File
+	Account2Nonce   map[Account]uint
+	dataDir         string
+	store           BlockStore
+	genesis         genesis
 	latestBlock     Block
 	latestBlockHash Hash
 	hasGenesisBlock bool
+
+	// every known block, canonical and side branches
+	blocks map[Hash]blockMeta
+	// numbers of the old canonical blocks left out of blocks when restored from a snapshot,
+	// their headers are read from the store on demand
+	unloaded map[Hash]uint64
+	// canonical chain block hashes indexed by block number
+	canonical []Hash
+	// count of canonical heights already written to the store height index
+	storedCanonical int
+	// account changes of the recent canonical blocks, to roll them back on reorg
+	undos map[Hash]blockUndo
+	// TXs of the blocks dropped from the canonical chain by the last reorgs
+	orphanedTXs []SignedTx
 }
 
 // NewStateFromDisk update transaction data
-func NewStateFromDisk(dataDir string) (*State, error) {
+// from blocks stored by the db backend
+func NewStateFromDisk(dataDir string, backend string) (*State, error) {
+	return NewStateFromDiskWithLogger(dataDir, backend, logger.Default())
+}
+
+// NewStateFromDiskWithLogger update transaction data
+// from blocks stored by the db backend, logging into the logger
+func NewStateFromDiskWithLogger(dataDir string, backend string, log logger.Logger) (*State, error) {
 	err := initDataDirIfNotExists(dataDir)
 	if err != nil {
 		return nil, err
@@ -38,62 +71,112 @@ func NewStateFromDisk(dataDir string) (*State, error) {
 		balances[account] = balance
 	}
 
-	dbFilePath := getBlocksDbFilePath(dataDir)
-	f, err := os.OpenFile(dbFilePath, os.O_APPEND|os.O_RDWR, 0600)
+	store, err := OpenBlockStoreWithLogger(dataDir, backend, log)
 	if err != nil {
 		return nil, err
 	}
 
-	scanner := bufio.NewScanner(f)
 	state := &State{
+		log:             log,
 		Balances:        balances,
-		dbFile:          f,
+		Account2Nonce:   make(map[Account]uint),
+		dataDir:         dataDir,
+		store:           store,
+		genesis:         gen,
 		latestBlock:     Block{},
 		latestBlockHash: Hash{},
 		hasGenesisBlock: false,
+		blocks:          make(map[Hash]blockMeta),
+		unloaded:        make(map[Hash]uint64),
+		canonical:       make([]Hash, 0),
+		undos:           make(map[Hash]blockUndo),
 	}
 
-	// Iterate over each the tx.db file's line by line
-	for scanner.Scan() {
-		err := scanner.Err()
-		if err != nil {
-			return nil, err
-		}
-
-		var blockFs BlockFS
-		blockFsJSON := scanner.Bytes()
-
-		if len(blockFsJSON) == 0 {
-			break
-		}
-
-		err = json.Unmarshal(blockFsJSON, &blockFs)
-		if err != nil {
-			return nil, err
+	// Restore the state from the latest snapshot,
+	// otherwise iterate over each stored block replaying the fork choice of every block
+	isRestored, err := state.loadSnapshotState()
+	if err == nil && !isRestored {
+		var importErr error
+		err = store.ForEach(func(hash Hash, b Block) bool {
+			_, importErr = state.importBlock(b, hash)
+			return importErr == nil
+		})
+		if err == nil {
+			err = importErr
 		}
+	}
+	if err == nil {
+		err = state.storeCanonical()
+	}
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
 
-		err = applyBlock(blockFs.Value, state)
-		if err != nil {
-			return nil, err
-		}
+	state.orphanedTXs = nil
 
-		state.latestBlock = blockFs.Value
-		state.latestBlockHash = blockFs.Key
-		state.hasGenesisBlock = true
-	}
 	return state, nil
 }
 
 // LatestBlock return latest block
 func (s *State) LatestBlock() Block {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return s.latestBlock
 }
 
 // LatestBlockHash return latest block hash
 func (s *State) LatestBlockHash() Hash {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return s.latestBlockHash
 }
 
+// LatestBlockWork return cumulative proof of work of the canonical chain
+func (s *State) LatestBlockWork() *big.Int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasGenesisBlock {
+		return big.NewInt(0)
+	}
+
+	return new(big.Int).Set(s.blocks[s.latestBlockHash].work)
+}
+
+// HasBlock check if a block is known, canonical or in a side branch
+func (s *State) HasBlock(hash Hash) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.hasBlock(hash)
+}
+
+func (s *State) hasBlock(hash Hash) bool {
+	_, isKnown := s.blocks[hash]
+	if !isKnown {
+		_, isKnown = s.unloaded[hash]
+	}
+
+	return isKnown
+}
+
+// GetBalances return copy of the account balances
+// together with hash of the block they are the state after
+func (s *State) GetBalances() (map[Account]uint, Hash) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	balances := make(map[Account]uint, len(s.Balances))
+	for acc, balance := range s.Balances {
+		balances[acc] = balance
+	}
+
+	return balances, s.latestBlockHash
+}
+
 // AddBlocks will add multiple blokcs
 func (s *State) AddBlocks(blocks []Block) error {
 	for _, b := range blocks {
@@ -106,110 +189,315 @@ func (s *State) AddBlocks(blocks []Block) error {
 	return nil
 }
 
-// AddBlock adds new block to blockchain
-// Bug: for the header
+// AddBlock adds new block to blockchain.
+// The block either extends the canonical chain, is kept in a side branch
+// or reorganizes the chain when its branch has more cumulative work.
 func (s *State) AddBlock(b Block) (Hash, error) {
-	pendingState := s.copy()
-
-	// validate block meta + payload
-	err := applyBlock(b, &pendingState)
+	blockHash, err := b.Hash()
 	if err != nil {
 		return Hash{}, err
 	}
 
-	blockHash, err := b.Hash()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.hasBlock(blockHash) {
+		return blockHash, nil
+	}
+
+	oldTipHash := s.latestBlockHash
+	reorged, err := s.importBlock(b, blockHash)
 	if err != nil {
 		return Hash{}, err
 	}
 
-	blockFs := BlockFS{blockHash, b}
-
-	blockFsJSON, err := json.Marshal(blockFs)
+	err = s.store.Append(blockHash, b)
 	if err != nil {
+		s.forgetBlock(blockHash, oldTipHash, reorged)
 		return Hash{}, err
 	}
 
-	fmt.Println("\nPersisting new Block to disk")
-	fmt.Printf("\t%s\n", blockFsJSON)
-
-	_, err = s.dbFile.Write(append(blockFsJSON, '\n'))
+	err = s.storeCanonical()
 	if err != nil {
 		return Hash{}, err
 	}
 
-	s.Balances = pendingState.Balances
-	s.latestBlockHash = blockHash
-	s.latestBlock = b
-	s.hasGenesisBlock = true
+	s.log.Debug("Persisted new block", "height", b.Header.Number, "hash", blockHash.Hex(), "txs", len(b.TXs), "canonical", s.latestBlockHash == blockHash)
+
+	if s.latestBlockHash == blockHash && b.Header.Number >= maxReorgDepth && b.Header.Number%snapshotInterval == 0 {
+		snapshot, err := s.writeSnapshot()
+		if err != nil {
+			s.log.Error("Writing state snapshot failed", "height", b.Header.Number, "err", err)
+		} else {
+			s.log.Info("Written state snapshot", "height", snapshot.Height, "hash", snapshot.Hash.Hex())
+		}
+	}
 
 	return blockHash, nil
 }
 
+// PopOrphanedTXs return TXs of blocks dropped from the canonical chain
+// by reorgs since the last call, so they can be mined again
+func (s *State) PopOrphanedTXs() []SignedTx {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	txs := s.orphanedTXs
+	s.orphanedTXs = nil
+
+	return txs
+}
+
 // NextBlockNumber will return next block header number
 func (s *State) NextBlockNumber() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if !s.hasGenesisBlock {
 		return uint64(0)
 	}
 
-	return s.LatestBlock().Header.Number + 1
+	return s.latestBlock.Header.Number + 1
+}
+
+// NextBlockDifficulty return difficulty the next block must be mined with.
+// Difficulty is retargeted every interval of blocks so the blocks
+// are mined in the genesis target block time on average.
+func (s *State) NextBlockDifficulty() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if !s.hasGenesisBlock {
+		return s.genesis.Difficulty
+	}
+
+	return s.difficultyAfter(s.latestBlock.Header)
+}
+
+// StateRoot return Merkle root of the account balances and nonces
+func (s *State) StateRoot() (Hash, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return StateMerkleRoot(s.Balances, s.Account2Nonce)
+}
+
+// NextStateRoot return state root after a block of the TXs
+// mined by the miner on top of the chain tip
+func (s *State) NextStateRoot(miner Account, txs []SignedTx) (Hash, error) {
+	s.mu.RLock()
+	pendingState := s.copy()
+	s.mu.RUnlock()
+
+	err := applyBlockPayload(Block{Header: BlockHeader{Miner: miner}, TXs: txs}, pendingState)
+	if err != nil {
+		return Hash{}, err
+	}
+
+	return pendingState.StateRoot()
+}
+
+// NextBlockHeader return header of a block of the TXs mined by the miner on top of the chain tip,
+// its parent, number, difficulty and state root are read from the same chain tip
+func (s *State) NextBlockHeader(miner Account, txs []SignedTx) (BlockHeader, error) {
+	s.mu.RLock()
+	header := BlockHeader{
+		Parent:     s.latestBlockHash,
+		Difficulty: s.genesis.Difficulty,
+		Miner:      miner,
+	}
+	if s.hasGenesisBlock {
+		header.Number = s.latestBlock.Header.Number + 1
+		header.Difficulty = s.difficultyAfter(s.latestBlock.Header)
+	}
+	pendingState := s.copy()
+	s.mu.RUnlock()
+
+	err := applyBlockPayload(Block{Header: header, TXs: txs}, pendingState)
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	header.StateRoot, err = pendingState.StateRoot()
+	if err != nil {
+		return BlockHeader{}, err
+	}
+
+	return header, nil
 }
 
-// Close will close tx db file
+// GetNextAccountNonce return nonce expected in the next account transaction
+func (s *State) GetNextAccountNonce(account Account) uint {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.Account2Nonce[account] + 1
+}
+
+// Close will close the block store
 func (s *State) Close() error {
-	return s.dbFile.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.store.Close()
 }
 
-func (s *State) copy() State {
-	c := State{}
+// copy return pending state to validate next block with,
+// the blocks index is shared and must not be modified by the copy
+func (s *State) copy() *State {
+	c := &State{}
+	c.log = s.log
 	c.hasGenesisBlock = s.hasGenesisBlock
+	c.genesis = s.genesis
+	c.blocks = s.blocks
+	c.unloaded = s.unloaded
 	c.latestBlock = s.latestBlock
 	c.latestBlockHash = s.latestBlockHash
 	c.Balances = make(map[Account]uint)
+	c.Account2Nonce = make(map[Account]uint)
 
 	for acc, balance := range s.Balances {
 		c.Balances[acc] = balance
 	}
 
+	for acc, nonce := range s.Account2Nonce {
+		c.Account2Nonce[acc] = nonce
+	}
+
 	return c
 }
 
 // applyBlock verifies if block can be added to the blockchain
 // Block meatadata are verified as well as transactions within (sufficient balances, etc).
 func applyBlock(b Block, s *State) error {
-	nextExpectedBlockNumber := s.latestBlock.Header.Number + 1
+	nextExpectedBlockNumber := s.NextBlockNumber()
 
 	if b.Header.Number != nextExpectedBlockNumber {
 		return fmt.Errorf("next expected block must be '%d' not '%d'", nextExpectedBlockNumber, b.Header.Number)
 	}
 
-	if s.hasGenesisBlock && s.latestBlock.Header.Number > 0 && !reflect.DeepEqual(b.Header.Parent, s.latestBlockHash) {
+	if s.hasGenesisBlock && !reflect.DeepEqual(b.Header.Parent, s.latestBlockHash) {
 		return fmt.Errorf("next block parent hash must be '%x' not '%x'", s.latestBlockHash, b.Header.Parent)
 	}
 
-	hash, err := b.Hash()
+	err := validateBlockHeader(b.Header, s.latestBlock.Header, s.hasGenesisBlock, s.NextBlockDifficulty())
+	if err != nil {
+		return err
+	}
+
+	err = validateBlockTXRoot(b)
+	if err != nil {
+		return err
+	}
+
+	err = applyBlockPayload(b, s)
+	if err != nil {
+		return err
+	}
+
+	// legacy headers don't commit to the state
+	if b.Header.Version == legacyEncodingVersion {
+		return nil
+	}
+
+	stateRoot, err := s.StateRoot()
+	if err != nil {
+		return err
+	}
+
+	if b.Header.StateRoot != stateRoot {
+		return fmt.Errorf("block state root must be '%x' not '%x'", stateRoot, b.Header.StateRoot)
+	}
+
+	return nil
+}
+
+// applyBlockPayload applies the block TXs and credits the miner
+func applyBlockPayload(b Block, s *State) error {
+	err := applyTXs(b.TXs, s)
+	if err != nil {
+		return err
+	}
+
+	fees, err := b.Fees()
+	if err != nil {
+		return err
+	}
+
+	reward, ok := addAmounts(BlockReward, fees)
+	if ok {
+		reward, ok = addAmounts(s.Balances[b.Header.Miner], reward)
+	}
+	if !ok {
+		return fmt.Errorf("block '%d' reward overflows miner '%s' balance", b.Header.Number, b.Header.Miner.String())
+	}
+	s.Balances[b.Header.Miner] = reward
+
+	return nil
+}
+
+// validateBlockHeader verifies block time and proof of work against the parent.
+// Legacy blocks can only be followed by legacy blocks.
+func validateBlockHeader(h BlockHeader, parent BlockHeader, hasParent bool, expectedDifficulty uint64) error {
+	if h.Version != 0 && h.Version != legacyEncodingVersion {
+		return fmt.Errorf("unsupported block encoding version '%d'", h.Version)
+	}
+
+	if h.Version == legacyEncodingVersion && hasParent && parent.Version != legacyEncodingVersion {
+		return fmt.Errorf("legacy block '%d' can't follow a version %d block", h.Number, encodingVersion)
+	}
+
+	if hasParent && h.Time < parent.Time {
+		return fmt.Errorf("next block time '%d' can't be before parent block time '%d'", h.Time, parent.Time)
+	}
+
+	if h.Time > uint64(time.Now().Unix())+maxFutureBlockTimeSeconds {
+		return fmt.Errorf("next block time '%d' is too far in the future", h.Time)
+	}
+
+	if h.Difficulty != expectedDifficulty {
+		return fmt.Errorf("next block difficulty must be '%d' not '%d'", expectedDifficulty, h.Difficulty)
+	}
+
+	hash, err := h.Hash()
 	if err != nil {
 		return err
 	}
 
-	if !IsBlockHashValid(hash) {
+	if !IsBlockHashValid(hash, h.Difficulty) {
 		return fmt.Errorf("invalid block hash %x", hash)
 	}
 
-	err = applyTXs(b.TXs, s)
+	return nil
+}
+
+// validateBlockTXRoot verifies the header commits to the block TXs
+// encoded with the header version
+func validateBlockTXRoot(b Block) error {
+	for _, tx := range b.TXs {
+		if tx.Version != b.Header.Version {
+			return fmt.Errorf("block TXs must be encoded with the block version '%d' not '%d'", b.Header.Version, tx.Version)
+		}
+	}
+
+	txRoot, err := TXsMerkleRoot(b.TXs)
+	if b.Header.Version == legacyEncodingVersion {
+		txRoot, err = legacyTXsMerkleRoot(b.TXs)
+	}
 	if err != nil {
 		return err
 	}
 
-	s.Balances[b.Header.Miner] += BlockReward
+	if b.Header.TXRoot != txRoot {
+		return fmt.Errorf("block TX root must be '%x' not '%x'", txRoot, b.Header.TXRoot)
+	}
+
 	return nil
 }
 
 // applyTXs will validate list of transaction
-func applyTXs(txs []Tx, s *State) error {
-	sort.Slice(txs, func(i, j int) bool {
-		return txs[i].Time < txs[j].Time
-	})
-
+// TXs are applied in the block order, so the account nonces must be ascending
+func applyTXs(txs []SignedTx, s *State) error {
 	for _, tx := range txs {
 		err := applyTx(tx, s)
 		if err != nil {
@@ -221,13 +509,45 @@ func applyTXs(txs []Tx, s *State) error {
 }
 
 // apply will change and validate the transaction
-func applyTx(tx Tx, s *State) error {
-	if tx.Value > s.Balances[tx.From] {
-		return fmt.Errorf("wrong TX. Sender '%s' balance is %d TBB. TX cost is %d TBB", tx.From, s.Balances[tx.From], tx.Value)
+func applyTx(tx SignedTx, s *State) error {
+	ok, err := tx.IsAuthentic()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("wrong TX. Sender '%s' is forged", tx.From.String())
+	}
+
+	expectedNonce := s.GetNextAccountNonce(tx.From)
+	if tx.Nonce != expectedNonce {
+		return fmt.Errorf("wrong TX. Sender '%s' next nonce must be '%d', not '%d'", tx.From.String(), expectedNonce, tx.Nonce)
 	}
 
-	s.Balances[tx.From] -= tx.Value
+	if tx.Fee < MinTxFee {
+		return fmt.Errorf("wrong TX. Fee must be at least %d TBB, not %d TBB", MinTxFee, tx.Fee)
+	}
+
+	if tx.IsCostOverflowing() {
+		return fmt.Errorf("wrong TX. Value %d TBB and fee %d TBB overflow the TX cost", tx.Value, tx.Fee)
+	}
+
+	if tx.Cost() > s.Balances[tx.From] {
+		return fmt.Errorf("wrong TX. Sender '%s' balance is %d TBB. TX cost is %d TBB", tx.From.String(), s.Balances[tx.From], tx.Cost())
+	}
+
+	// a TX to the sender itself only pays the fee
+	if tx.To != tx.From {
+		if _, ok := addAmounts(s.Balances[tx.To], tx.Value); !ok {
+			return fmt.Errorf("wrong TX. Value %d TBB overflows recipient '%s' balance", tx.Value, tx.To.String())
+		}
+	}
+
+	// the fee is credited to the miner in applyBlock
+	s.Balances[tx.From] -= tx.Cost()
 	s.Balances[tx.To] += tx.Value
 
+	s.Account2Nonce[tx.From] = tx.Nonce
+
 	return nil
 }
@@ -0,0 +1,127 @@
+package database
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestState_RejectsOverflowingTXs(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	// babayaga's balance can't take any more TBB
+	genesisJSON, err := json.Marshal(genesis{
+		Balances:   map[Account]uint{andrej: 100, babayaga: math.MaxUint - 10},
+		Difficulty: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(getDatabaseDirPath(dataDir), "genesis.json"), genesisJSON, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	miner := NewAccount("0x6fdc0d8d15ae6b4ebf45c52fd2aafbcbb19a65c8")
+	costOverflowTx := signTestTx(t, NewTx(andrej, miner, math.MaxUint-MinTxFee+11, 1, ""), andrejKey)
+	if !costOverflowTx.IsCostOverflowing() {
+		t.Fatal("TX cost was suppose to overflow")
+	}
+	recipientOverflowTx := signTestTx(t, NewTx(andrej, babayaga, 20, 1, ""), andrejKey)
+
+	for name, tx := range map[string]SignedTx{"cost": costOverflowTx, "recipient": recipientOverflowTx} {
+		_, err = state.NextStateRoot(miner, []SignedTx{tx})
+		if err == nil {
+			t.Fatalf("%s overflowing TX was suppose to be rejected", name)
+		}
+
+		b := newTestBlock(t, Hash{}, 0, 0, state.LatestBlock().Header.Time, 1, miner, Hash{}, []SignedTx{tx})
+		_, err = state.AddBlock(b)
+		if err == nil {
+			t.Fatalf("block with %s overflowing TX was suppose to be rejected", name)
+		}
+	}
+
+	if state.Balances[andrej] != 100 || state.Balances[babayaga] != math.MaxUint-10 || state.Balances[miner] != 0 {
+		t.Fatalf("balances were not suppose to change, got %v", state.Balances)
+	}
+}
+
+func TestBlock_FeesOverflow(t *testing.T) {
+	b := Block{TXs: []SignedTx{
+		{Tx: Tx{Fee: math.MaxUint}},
+		{Tx: Tx{Fee: 1}},
+	}}
+
+	_, err := b.Fees()
+	if err == nil {
+		t.Fatal("overflowing fees were suppose to be rejected")
+	}
+}
+
+func TestState_AddBlockRejectsForgedAndMalleatedTXs(t *testing.T) {
+	dataDir, andrejKey := createTestDataDir(t)
+	defer os.RemoveAll(dataDir)
+
+	state, err := NewStateFromDisk(dataDir, DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer state.Close()
+
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+
+	babayagaKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// babayaga signs a TX spending andrej's balance
+	forgedTx := signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), babayagaKey)
+
+	// the high S copy of a valid signature still recovers andrej but changes the TX hash
+	validTx := signTestTx(t, NewTx(andrej, babayaga, 10, 1, ""), andrejKey)
+	malleatedTx := SignedTx{Tx: validTx.Tx, Sig: make([]byte, len(validTx.Sig))}
+	copy(malleatedTx.Sig, validTx.Sig)
+	highS := new(big.Int).Sub(crypto.S256().Params().N, new(big.Int).SetBytes(validTx.Sig[32:64]))
+	highS.FillBytes(malleatedTx.Sig[32:64])
+	malleatedTx.Sig[64] ^= 1
+
+	txHash, _ := validTx.Tx.Hash()
+	pubKey, err := crypto.SigToPub(txHash[:], malleatedTx.Sig)
+	if err != nil || crypto.PubkeyToAddress(*pubKey) != andrej {
+		t.Fatal("high S signature was suppose to recover the sender")
+	}
+
+	validTxHash, _ := validTx.Hash()
+	malleatedTxHash, _ := malleatedTx.Hash()
+	if validTxHash == malleatedTxHash {
+		t.Fatal("high S copy was suppose to have another TX hash")
+	}
+
+	for name, tx := range map[string]SignedTx{"forged": forgedTx, "high S": malleatedTx} {
+		b := newTestBlock(t, Hash{}, 0, 0, state.LatestBlock().Header.Time, 1, babayaga, Hash{}, []SignedTx{tx})
+		_, err = state.AddBlock(b)
+		if err == nil || !strings.Contains(err.Error(), "is forged") {
+			t.Fatalf("block with %s TX was suppose to be rejected as forged, got %v", name, err)
+		}
+	}
+}
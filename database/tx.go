@@ -1,17 +1,25 @@
 package database
 
 import (
+	"crypto/ecdsa"
 	"crypto/sha256"
-	"encoding/json"
+	"math"
+	"math/big"
 	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
-// Account is an alias for customer represented in DB
-type Account string
+// MinTxFee is the lowest fee a TX must pay to the block miner
+const MinTxFee = uint(50)
+
+// Account is an address derived from the customer public key
+type Account = common.Address
 
-// NewAccount return new customer account
+// NewAccount return new customer account from its hex address
 func NewAccount(value string) Account {
-	return Account(value)
+	return common.HexToAddress(value)
 }
 
 // Tx represent each transaction in database
@@ -19,32 +27,123 @@ type Tx struct {
 	From  Account `json:"from"`
 	To    Account `json:"to"`
 	Value uint    `json:"value"`
+	Fee   uint    `json:"fee"`
+	Nonce uint    `json:"nonce"` // sender transaction count, starting at 1
 	Data  string  `json:"data"`
 	Time  uint64  `json:"time"`
+	// Version is the binary encoding the TX is hashed with, zero is the current version
+	Version byte `json:"version,omitempty"`
+}
+
+// SignedTx is a transaction signed by the sender private key
+type SignedTx struct {
+	Tx
+	Sig []byte `json:"signature"`
 }
 
-// NewTx return new transaction
-func NewTx(from Account, to Account, value uint, data string) Tx {
+// NewTx return new transaction paying the minimal fee
+func NewTx(from Account, to Account, value uint, nonce uint, data string) Tx {
 	return Tx{
 		From:  from,
 		To:    to,
 		Value: value,
+		Fee:   MinTxFee,
+		Nonce: nonce,
 		Data:  data,
 		Time:  uint64(time.Now().Unix()),
 	}
 }
 
+// NewSignedTx return new signed transaction
+func NewSignedTx(tx Tx, sig []byte) SignedTx {
+	return SignedTx{tx, sig}
+}
+
+// SignTx signs the transaction hash with the sender private key
+func SignTx(tx Tx, privKey *ecdsa.PrivateKey) (SignedTx, error) {
+	txHash, err := tx.Hash()
+	if err != nil {
+		return SignedTx{}, err
+	}
+
+	sig, err := crypto.Sign(txHash[:], privKey)
+	if err != nil {
+		return SignedTx{}, err
+	}
+
+	return NewSignedTx(tx, sig), nil
+}
+
+// Cost return total amount of TBB the sender is charged,
+// it's only meaningful for TXs whose cost isn't overflowing
+func (t Tx) Cost() uint {
+	return t.Value + t.Fee
+}
+
+// IsCostOverflowing check if the value and fee together exceed the largest amount of TBB
+func (t Tx) IsCostOverflowing() bool {
+	return t.Value > math.MaxUint-t.Fee
+}
+
+// addAmounts return sum of the TBB amounts, false is returned when the sum overflows
+func addAmounts(a uint, b uint) (uint, bool) {
+	if a > math.MaxUint-b {
+		return 0, false
+	}
+
+	return a + b, true
+}
+
 // IsReward check if transaction is eligible for a reward
 func (t Tx) IsReward() bool {
 	return t.Data == "reward"
 }
 
-// Hash return hash of txJSON
+// Hash return hash of the binary encoded transaction
 func (t Tx) Hash() (Hash, error) {
-	txJSON, err := json.Marshal(t)
+	encoded, err := t.Encode()
+	if err != nil {
+		return Hash{}, err
+	}
+
+	return sha256.Sum256(encoded), nil
+}
+
+// Hash return hash of the binary encoded signed transaction, signature included
+func (t SignedTx) Hash() (Hash, error) {
+	encoded, err := t.Encode()
 	if err != nil {
 		return Hash{}, err
 	}
 
-	return sha256.Sum256(txJSON), nil
+	return sha256.Sum256(encoded), nil
+}
+
+// IsAuthentic check if the signature was made by the sender account.
+// Only the canonical low S form of a signature is authentic, so a valid
+// signature can't be malleated into a copy of the TX with another hash.
+func (t SignedTx) IsAuthentic() (bool, error) {
+	if len(t.Sig) != crypto.SignatureLength {
+		return false, nil
+	}
+
+	r := new(big.Int).SetBytes(t.Sig[:32])
+	s := new(big.Int).SetBytes(t.Sig[32:64])
+	if !crypto.ValidateSignatureValues(t.Sig[64], r, s, true) {
+		return false, nil
+	}
+
+	txHash, err := t.Tx.Hash()
+	if err != nil {
+		return false, err
+	}
+
+	recoveredPubKey, err := crypto.SigToPub(txHash[:], t.Sig)
+	if err != nil {
+		return false, err
+	}
+
+	recoveredAccount := crypto.PubkeyToAddress(*recoveredPubKey)
+
+	return recoveredAccount == t.From, nil
 }
@@ -50,3 +50,28 @@ func homeDir() string {
 func RemoveDir(path string) error {
 	return os.RemoveAll(path)
 }
+
+// WriteFileSynced replaces the file atomically with the fsynced content
+func WriteFileSynced(path string, content []byte) error {
+	tmpPath := path + ".tmp"
+
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
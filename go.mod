@@ -1,5 +1,30 @@
 module the-blockchain-bar
 
-go 1.15
+go 1.22
 
-require github.com/spf13/cobra v1.0.0
+require (
+	github.com/ethereum/go-ethereum v1.10.23
+	github.com/prometheus/client_golang v1.19.0
+	github.com/spf13/cobra v1.0.0
+	go.etcd.io/bbolt v1.3.11
+	golang.org/x/term v0.19.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/btcsuite/btcd/btcec/v2 v2.2.0 // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/deckarep/golang-set v1.8.0 // indirect
+	github.com/decred/dcrd/dcrec/secp256k1/v4 v4.0.1 // indirect
+	github.com/go-stack/stack v1.8.0 // indirect
+	github.com/google/uuid v1.3.0 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/prometheus/client_model v0.5.0 // indirect
+	github.com/prometheus/common v0.48.0 // indirect
+	github.com/prometheus/procfs v0.12.0 // indirect
+	github.com/rjeczalik/notify v0.9.1 // indirect
+	github.com/spf13/pflag v1.0.5 // indirect
+	golang.org/x/crypto v0.22.0 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
+)
@@ -0,0 +1,89 @@
+package logger
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// FormatText formats records as logfmt key=value pairs
+	FormatText = "text"
+	// FormatJSON formats records as JSON objects, one per line
+	FormatJSON = "json"
+
+	// LevelDebug logs records useful for tracing the node internals
+	LevelDebug = "debug"
+	// LevelInfo logs records of the node progress, it's the default level
+	LevelInfo = "info"
+	// LevelWarn logs records of recoverable failures
+	LevelWarn = "warn"
+	// LevelError logs records of failures needing an operator
+	LevelError = "error"
+)
+
+// Logger writes leveled log records with structured key value fields, *slog.Logger implements it
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+var (
+	defaultMu     sync.RWMutex
+	defaultLogger Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo}))
+)
+
+// New will create a slog logger writing the records of the level and above in the text or json format
+func New(w io.Writer, level string, format string) (*slog.Logger, error) {
+	var slogLevel slog.Level
+	err := slogLevel.UnmarshalText([]byte(level))
+	if err != nil {
+		return nil, fmt.Errorf("invalid log level '%s', expected one of %s", level, strings.Join([]string{LevelDebug, LevelInfo, LevelWarn, LevelError}, ", "))
+	}
+
+	opts := &slog.HandlerOptions{Level: slogLevel}
+
+	switch format {
+	case FormatText:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format '%s', expected %s or %s", format, FormatText, FormatJSON)
+	}
+}
+
+// Discard return a logger dropping every record
+func Discard() Logger {
+	return slog.New(discardHandler{})
+}
+
+// Default return the logger used when none is injected,
+// it writes info and above records in text format to stderr until SetDefault is called
+func Default() Logger {
+	defaultMu.RLock()
+	defer defaultMu.RUnlock()
+
+	return defaultLogger
+}
+
+// SetDefault will replace the logger used when none is injected
+func SetDefault(log Logger) {
+	defaultMu.Lock()
+	defer defaultMu.Unlock()
+
+	defaultLogger = log
+}
+
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
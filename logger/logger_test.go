@@ -0,0 +1,68 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestNew_JSONRecordsOfLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	log, err := New(buf, LevelWarn, FormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Info("Found new blocks", "height", 1)
+	log.Warn("Peer was banned", "peer", "127.0.0.1:8081", "height", 2)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected only the warn record to be logged, got %d records", len(lines))
+	}
+
+	record := map[string]interface{}{}
+	err = json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if record["level"] != "WARN" || record["msg"] != "Peer was banned" {
+		t.Fatalf("unexpected record %s", lines[0])
+	}
+
+	if record["peer"] != "127.0.0.1:8081" || record["height"] != float64(2) {
+		t.Fatalf("structured fields missing in record %s", lines[0])
+	}
+}
+
+func TestNew_InvalidLevelAndFormat(t *testing.T) {
+	_, err := New(&bytes.Buffer{}, "verbose", FormatText)
+	if err == nil {
+		t.Fatal("invalid level should be rejected")
+	}
+
+	_, err = New(&bytes.Buffer{}, LevelInfo, "xml")
+	if err == nil {
+		t.Fatal("invalid format should be rejected")
+	}
+}
+
+func TestSetDefault(t *testing.T) {
+	defer SetDefault(Default())
+
+	buf := &bytes.Buffer{}
+	log, err := New(buf, LevelDebug, FormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	SetDefault(log)
+	Default().Debug("Mining pending TXs", "height", 3)
+
+	if !strings.Contains(buf.String(), "height=3") {
+		t.Fatalf("record not written by the set default logger, got '%s'", buf.String())
+	}
+}
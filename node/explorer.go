@@ -0,0 +1,250 @@
+package node
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"the-blockchain-bar/database"
+)
+
+const (
+	endPointBlocks             = "/blocks"
+	endPointBlocksQueryKeyFrom = "from"
+	endPointBlocksQueryKeyTo   = "to"
+	endPointBlockByHash        = "/blocks/{hash}"
+	endPointBlockByHeight      = "/blocks/height/{number}"
+	endPointTX                 = "/tx/{hash}"
+	endPointAccount            = "/accounts/{account}"
+	endPointPathKeyHash        = "hash"
+	endPointPathKeyNumber      = "number"
+	endPointPathKeyAccount     = "account"
+
+	// explorerMaxPageBlocks limits how many blocks a blocks range response holds
+	explorerMaxPageBlocks = 100
+)
+
+// BlockRes is a response with a known block. Confirmations counts the canonical
+// blocks since the block, the block included, a block of a side branch has none.
+type BlockRes struct {
+	Hash          database.Hash  `json:"hash"`
+	Block         database.Block `json:"block"`
+	Canonical     bool           `json:"canonical"`
+	Confirmations uint64         `json:"confirmations"`
+}
+
+// BlocksRes is a response with a range of canonical blocks.
+// More blocks follow the last block of the range when HasMore is set.
+type BlocksRes struct {
+	Blocks  []BlockRes `json:"blocks"`
+	HasMore bool       `json:"has_more"`
+}
+
+// TXRes is a response with a TX and the canonical block including it,
+// a pending TX has no block and no confirmations
+type TXRes struct {
+	Hash          database.Hash     `json:"hash"`
+	TX            database.SignedTx `json:"tx"`
+	Pending       bool              `json:"pending"`
+	BlockHash     database.Hash     `json:"block_hash"`
+	BlockNumber   uint64            `json:"block_number"`
+	Confirmations uint64            `json:"confirmations"`
+}
+
+// AccountRes is a response with an account state after the latest block
+type AccountRes struct {
+	Account     database.Account `json:"account"`
+	Balance     uint             `json:"balance"`
+	Nonce       uint             `json:"nonce"`
+	NextNonce   uint             `json:"next_nonce"`
+	BlockHash   database.Hash    `json:"block_hash"`
+	BlockNumber uint64           `json:"block_number"`
+}
+
+func blockByHashHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	hash, err := parseHashParam(r.PathValue(endPointPathKeyHash))
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	block, err := node.state.GetBlock(hash)
+	if err != nil {
+		writeLookupErrRes(w, err)
+		return
+	}
+
+	writeRes(w, newBlockRes(block))
+}
+
+func blockByHeightHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	numberRaw := r.PathValue(endPointPathKeyNumber)
+	number, err := strconv.ParseUint(numberRaw, 10, 64)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, fmt.Errorf("invalid block number '%s'", numberRaw))
+		return
+	}
+
+	block, err := node.state.GetCanonicalBlock(number)
+	if err != nil {
+		writeLookupErrRes(w, err)
+		return
+	}
+
+	writeRes(w, newBlockRes(block))
+}
+
+// blocksHandler serves canonical blocks numbered from and up to the query numbers, both included.
+// Without numbers the latest blocks are served, a range is cut at explorerMaxPageBlocks blocks.
+// A range starting after its end, like a page past the tip, has no blocks.
+func blocksHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	latest := node.state.LatestBlock().Header.Number
+
+	to, err := parseBlockNumberQuery(r, endPointBlocksQueryKeyTo, latest)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	from := uint64(0)
+	if to >= explorerMaxPageBlocks {
+		from = to - explorerMaxPageBlocks + 1
+	}
+	from, err = parseBlockNumberQuery(r, endPointBlocksQueryKeyFrom, from)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if from <= to && to-from >= explorerMaxPageBlocks {
+		to = from + explorerMaxPageBlocks - 1
+	}
+
+	blocks, err := node.state.GetCanonicalBlocks(from, to)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	res := BlocksRes{
+		Blocks: make([]BlockRes, 0, len(blocks)),
+	}
+	for _, block := range blocks {
+		res.Blocks = append(res.Blocks, newBlockRes(block))
+	}
+	res.HasMore = len(blocks) > 0 && blocks[len(blocks)-1].Block.Header.Number < node.state.LatestBlock().Header.Number
+
+	writeRes(w, res)
+}
+
+func txHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	hash, err := parseHashParam(r.PathValue(endPointPathKeyHash))
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	tx, err := node.state.GetTX(hash)
+	if errors.Is(err, database.ErrNotFound) {
+		pendingTX, isPending := node.getPendingTX(hash)
+		if isPending {
+			writeRes(w, TXRes{
+				Hash:    hash,
+				TX:      pendingTX,
+				Pending: true,
+			})
+			return
+		}
+	}
+	if err != nil {
+		writeLookupErrRes(w, err)
+		return
+	}
+
+	writeRes(w, TXRes{
+		Hash:          hash,
+		TX:            tx.TX,
+		BlockHash:     tx.BlockHash,
+		BlockNumber:   tx.BlockNumber,
+		Confirmations: tx.Confirmations,
+	})
+}
+
+func accountHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	accRaw := r.PathValue(endPointPathKeyAccount)
+	if !common.IsHexAddress(accRaw) {
+		writeErrResWithStatus(w, http.StatusBadRequest, fmt.Errorf("invalid account '%s'", accRaw))
+		return
+	}
+
+	acc, err := node.state.GetAccount(database.NewAccount(accRaw))
+	if err != nil {
+		writeLookupErrRes(w, err)
+		return
+	}
+
+	writeRes(w, AccountRes{
+		Account:     acc.Account,
+		Balance:     acc.Balance,
+		Nonce:       acc.Nonce,
+		NextNonce:   acc.Nonce + 1,
+		BlockHash:   acc.BlockHash,
+		BlockNumber: acc.BlockNumber,
+	})
+}
+
+func newBlockRes(block database.BlockInfo) BlockRes {
+	return BlockRes{
+		Hash:          block.Hash,
+		Block:         block.Block,
+		Canonical:     block.IsCanonical,
+		Confirmations: block.Confirmations,
+	}
+}
+
+// writeLookupErrRes responds with not found to an unknown block, TX or account
+func writeLookupErrRes(w http.ResponseWriter, err error) {
+	if errors.Is(err, database.ErrNotFound) {
+		writeErrResWithStatus(w, http.StatusNotFound, err)
+		return
+	}
+
+	writeErrRes(w, err)
+}
+
+// parseHashParam return the hash of 64 hex characters, optionally 0x prefixed
+func parseHashParam(raw string) (database.Hash, error) {
+	hash := database.Hash{}
+
+	hexRaw := strings.TrimPrefix(raw, "0x")
+	if len(hexRaw) != hex.EncodedLen(len(hash)) {
+		return database.Hash{}, fmt.Errorf("invalid hash '%s'", raw)
+	}
+
+	err := hash.UnmarshalText([]byte(hexRaw))
+	if err != nil {
+		return database.Hash{}, fmt.Errorf("invalid hash '%s'. %s", raw, err.Error())
+	}
+
+	return hash, nil
+}
+
+// parseBlockNumberQuery return the block number of the query key, or the default number without one
+func parseBlockNumberQuery(r *http.Request, key string, defaultNumber uint64) (uint64, error) {
+	numberRaw := r.URL.Query().Get(key)
+	if numberRaw == "" {
+		return defaultNumber, nil
+	}
+
+	number, err := strconv.ParseUint(numberRaw, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s block number '%s'", key, numberRaw)
+	}
+
+	return number, nil
+}
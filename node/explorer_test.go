@@ -0,0 +1,148 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+func TestNode_ExplorerEndpoints(t *testing.T) {
+	dataDir := filepath.Join(os.TempDir(), ".tbb_test_explorer")
+	err := fs.RemoveDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.RemoveDir(dataDir)
+
+	andrejKey, err := generateTestGenesis(dataDir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := database.NewAccount(testBabayagaAccount)
+
+	n := New(dataDir, database.DefaultBackend, "127.0.0.1", getFreeTestPort(t), andrej, nil)
+	n.state, err = database.NewStateFromDisk(dataDir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blockHashes := mineTestBlocks(t, n, andrejKey, babayaga, 3)
+	block0, err := n.state.GetCanonicalBlock(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	minedTXHash, _ := block0.Block.TXs[0].Hash()
+	n.state.Close()
+	n.state = nil
+
+	runErr := runTestNode(t, n)
+	defer shutdownTestNode(t, n, runErr)
+
+	pendingTX, err := database.SignTx(database.NewTx(andrej, babayaga, 1, 4, ""), andrejKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = n.AddPendingTX(pendingTX, n.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pendingTXHash, _ := pendingTX.Hash()
+
+	blockRes := BlockRes{}
+	getExplorerTestRes(t, n, fmt.Sprintf("/blocks/%s", blockHashes[1].Hex()), http.StatusOK, &blockRes)
+	if blockRes.Hash != blockHashes[1] || !blockRes.Canonical || blockRes.Confirmations != 2 {
+		t.Fatalf("block 1 was suppose to be canonical with 2 confirmations, got %+v", blockRes)
+	}
+
+	blockRes = BlockRes{}
+	getExplorerTestRes(t, n, "/blocks/height/2", http.StatusOK, &blockRes)
+	if blockRes.Hash != blockHashes[2] || blockRes.Confirmations != 1 {
+		t.Fatalf("block of height 2 was suppose to be the latest block, got %+v", blockRes)
+	}
+
+	blocksRes := BlocksRes{}
+	getExplorerTestRes(t, n, "/blocks?from=0&to=1", http.StatusOK, &blocksRes)
+	if len(blocksRes.Blocks) != 2 || blocksRes.Blocks[0].Hash != blockHashes[0] || !blocksRes.HasMore {
+		t.Fatalf("blocks 0 to 1 were suppose to be served with more blocks following, got %+v", blocksRes)
+	}
+
+	blocksRes = BlocksRes{}
+	getExplorerTestRes(t, n, "/blocks", http.StatusOK, &blocksRes)
+	if len(blocksRes.Blocks) != 3 || blocksRes.HasMore {
+		t.Fatalf("all 3 blocks were suppose to be served by default, got %d", len(blocksRes.Blocks))
+	}
+
+	// paging past the tip is an empty page
+	blocksRes = BlocksRes{}
+	getExplorerTestRes(t, n, "/blocks?from=3", http.StatusOK, &blocksRes)
+	if len(blocksRes.Blocks) != 0 || blocksRes.HasMore {
+		t.Fatalf("no blocks were suppose to be served after the tip, got %d", len(blocksRes.Blocks))
+	}
+
+	txRes := TXRes{}
+	getExplorerTestRes(t, n, fmt.Sprintf("/tx/%s", minedTXHash.Hex()), http.StatusOK, &txRes)
+	if txRes.Pending || txRes.BlockHash != blockHashes[0] || txRes.Confirmations != 3 {
+		t.Fatalf("TX of block 0 was suppose to have 3 confirmations, got %+v", txRes)
+	}
+
+	txRes = TXRes{}
+	getExplorerTestRes(t, n, fmt.Sprintf("/tx/0x%s", pendingTXHash.Hex()), http.StatusOK, &txRes)
+	if !txRes.Pending || txRes.Confirmations != 0 || txRes.TX.Nonce != 4 {
+		t.Fatalf("TX was suppose to be pending, got %+v", txRes)
+	}
+
+	accountRes := AccountRes{}
+	getExplorerTestRes(t, n, fmt.Sprintf("/accounts/%s", andrej.String()), http.StatusOK, &accountRes)
+	if accountRes.Nonce != 3 || accountRes.NextNonce != 4 || accountRes.BlockHash != blockHashes[2] {
+		t.Fatalf("andrej account was suppose to have used nonce 3, got %+v", accountRes)
+	}
+
+	errRes := ErrRes{}
+	getExplorerTestRes(t, n, fmt.Sprintf("/blocks/%s", database.Hash{0x01}.Hex()), http.StatusNotFound, &errRes)
+	getExplorerTestRes(t, n, "/blocks/height/3", http.StatusNotFound, &errRes)
+	getExplorerTestRes(t, n, fmt.Sprintf("/tx/%s", database.Hash{0x01}.Hex()), http.StatusNotFound, &errRes)
+	getExplorerTestRes(t, n, "/accounts/0x6fdc0d8d15ae6b4ebf45c52fd2aafbcbb19a65c8", http.StatusNotFound, &errRes)
+	getExplorerTestRes(t, n, "/blocks/xyz", http.StatusBadRequest, &errRes)
+	getExplorerTestRes(t, n, "/accounts/andrej", http.StatusBadRequest, &errRes)
+
+	res, err := http.Post(fmt.Sprintf("http://%s/blocks", n.info.TCPAddress()), "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Fatalf("explorer endpoints were suppose to serve only GET requests, got status %d", res.StatusCode)
+	}
+}
+
+func getExplorerTestRes(t *testing.T, n *Node, path string, expectedStatus int, resBody interface{}) {
+	res, err := http.Get(fmt.Sprintf("http://%s%s", n.info.TCPAddress(), path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != expectedStatus {
+		t.Fatalf("'%s' responded with %d instead of %d. %s", path, res.StatusCode, expectedStatus, body)
+	}
+
+	err = json.Unmarshal(body, resBody)
+	if err != nil {
+		t.Fatalf("'%s' response isn't JSON. %s", path, err)
+	}
+}
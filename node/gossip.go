@@ -0,0 +1,218 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"the-blockchain-bar/database"
+)
+
+const (
+	endPointGossipBlock = "/node/gossip/block"
+	endPointGossipTX    = "/node/gossip/tx"
+
+	// gossipSeenSeconds is how long an announced block is remembered,
+	// so announcements of the same block arriving from several peers don't loop
+	gossipSeenSeconds = 10 * 60
+	// gossipMaxSeenBlocks caps the remembered announced blocks, the oldest are forgotten first
+	gossipMaxSeenBlocks = 10000
+	// gossipMaxQueuedBlocks caps the announced blocks waiting for the sync loop,
+	// announcements arriving to a full queue are rejected and pulled by the next sync
+	gossipMaxQueuedBlocks = 100
+)
+
+// BlockAnnounceReq is a request announcing a new block by its header,
+// the block is downloaded in the background from the announcing peer if it's a known peer.
+// Anyone can send an announcement in the name of any peer.
+type BlockAnnounceReq struct {
+	Peer   PeerNode             `json:"peer"`
+	Header database.BlockHeader `json:"header"`
+}
+
+// TXAnnounceReq is a request announcing a new pending TX,
+// anyone can send an announcement in the name of any peer
+type TXAnnounceReq struct {
+	Peer PeerNode          `json:"peer"`
+	TX   database.SignedTx `json:"tx"`
+}
+
+// AnnounceRes is a response for a block or TX announcement,
+// Known is set when the node already knew the announced block or TX
+type AnnounceRes struct {
+	Known bool `json:"known"`
+}
+
+// blockAnnouncement is an announced block waiting to be downloaded from the known peer
+type blockAnnouncement struct {
+	peer   PeerNode
+	header database.BlockHeader
+}
+
+// queueAnnouncedBlock queues the block announced by a known peer for the sync loop,
+// false is returned for a known block. Blocks are downloaded only from known peers,
+// so an announcement can't make the node request an arbitrary host.
+func (n *Node) queueAnnouncedBlock(peer PeerNode, header database.BlockHeader) (bool, error) {
+	blockHash, err := header.Hash()
+	if err != nil {
+		return false, err
+	}
+
+	if n.state.HasBlock(blockHash) {
+		return false, nil
+	}
+
+	n.knownPeersMu.RLock()
+	knownPeer, isKnownPeer := n.knownPeers[peer.TCPAddress()]
+	n.knownPeersMu.RUnlock()
+	if !isKnownPeer || n.isSelf(peer) {
+		return false, fmt.Errorf("block '%x' announced by peer '%s' ignored, the peer isn't known", blockHash, peer.TCPAddress())
+	}
+
+	// the announcing peer isn't authenticated, so it isn't penalized for an invalid block
+	if !database.IsBlockHashValid(blockHash, header.Difficulty) {
+		return false, fmt.Errorf("block '%x' announced by peer '%s' rejected. %w. Hash doesn't meet the difficulty", blockHash, peer.TCPAddress(), errInvalidBlock)
+	}
+
+	if !n.markBlockAnnounced(blockHash) {
+		return false, nil
+	}
+
+	select {
+	case n.blockAnnouncements <- blockAnnouncement{knownPeer, header}:
+	default:
+		n.forgetBlockAnnounced(blockHash)
+		return false, fmt.Errorf("block '%x' announced by peer '%s' ignored, too many announcements are queued", blockHash, peer.TCPAddress())
+	}
+
+	return true, nil
+}
+
+// importAnnouncedBlock downloads the announced block from the peer
+// and relays the announcement to the other peers
+func (n *Node) importAnnouncedBlock(announcement blockAnnouncement) error {
+	blockHash, err := announcement.header.Hash()
+	if err != nil {
+		return err
+	}
+
+	if n.state.HasBlock(blockHash) {
+		return nil
+	}
+
+	n.log.Info("Peer announced new block", "height", announcement.header.Number, "hash", blockHash.Hex(), "peer", announcement.peer.TCPAddress())
+
+	err = n.syncBlocks([]peerStatus{{announcement.peer, StatusRes{Hash: blockHash, Number: announcement.header.Number}}})
+	if err != nil {
+		return err
+	}
+
+	if !n.state.HasBlock(blockHash) {
+		return nil
+	}
+
+	n.announceBlock(announcement.header, announcement.peer)
+
+	return nil
+}
+
+// markBlockAnnounced remembers the block was announced, false is returned
+// when it already was so the announcement isn't processed twice
+func (n *Node) markBlockAnnounced(blockHash database.Hash) bool {
+	n.announcedBlocksMu.Lock()
+	defer n.announcedBlocksMu.Unlock()
+
+	now := time.Now()
+	for hash, seenAt := range n.announcedBlocks {
+		if now.Sub(seenAt) > gossipSeenSeconds*time.Second {
+			delete(n.announcedBlocks, hash)
+		}
+	}
+
+	if _, isSeen := n.announcedBlocks[blockHash]; isSeen {
+		return false
+	}
+
+	// a flood of announced blocks forgets the oldest ones
+	if len(n.announcedBlocks) >= gossipMaxSeenBlocks {
+		oldestHash, oldestSeenAt := database.Hash{}, now
+		for hash, seenAt := range n.announcedBlocks {
+			if seenAt.Before(oldestSeenAt) {
+				oldestHash, oldestSeenAt = hash, seenAt
+			}
+		}
+		delete(n.announcedBlocks, oldestHash)
+	}
+
+	n.announcedBlocks[blockHash] = now
+	return true
+}
+
+// forgetBlockAnnounced forgets the block was announced, so its next announcement is processed
+func (n *Node) forgetBlockAnnounced(blockHash database.Hash) {
+	n.announcedBlocksMu.Lock()
+	defer n.announcedBlocksMu.Unlock()
+
+	delete(n.announcedBlocks, blockHash)
+}
+
+// announceBlock announces the block to connected peers except the one it came from
+func (n *Node) announceBlock(header database.BlockHeader, fromPeer PeerNode) {
+	blockHash, err := header.Hash()
+	if err != nil {
+		return
+	}
+	n.markBlockAnnounced(blockHash)
+
+	n.announce(endPointGossipBlock, BlockAnnounceReq{n.info, header}, fromPeer)
+}
+
+// announceTX announces the pending TX to connected peers except the one it came from
+func (n *Node) announceTX(tx database.SignedTx, fromPeer PeerNode) {
+	n.announce(endPointGossipTX, TXAnnounceReq{n.info, tx}, fromPeer)
+}
+
+// announce posts the announcement to every connected peer in the background,
+// announcements are best effort as the missed ones are pulled by the sync
+func (n *Node) announce(endpoint string, req interface{}, fromPeer PeerNode) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		n.log.Error("Encoding announcement failed", "endpoint", endpoint, "err", err)
+		return
+	}
+
+	for _, peer := range n.copyKnownPeers() {
+		if !peer.connected || n.isSelf(peer) || peer.TCPAddress() == fromPeer.TCPAddress() {
+			continue
+		}
+
+		go func(peer PeerNode) {
+			err := postPeerReq(peer, endpoint, reqJSON, &AnnounceRes{})
+			if err != nil {
+				n.log.Debug("Announcing to peer failed", "endpoint", endpoint, "peer", peer.TCPAddress(), "err", err)
+			}
+		}(peer)
+	}
+}
+
+// postPeerReq posts the JSON request to the peer endpoint, an error response is returned as error
+func postPeerReq(peer PeerNode, endpoint string, reqJSON []byte, resBody interface{}) error {
+	res, err := syncHTTPClient.Post(fmt.Sprintf("http://%s%s", peer.TCPAddress(), endpoint), "application/json", bytes.NewReader(reqJSON))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		errRes := ErrRes{}
+		err = readRes(res, &errRes)
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf("peer '%s' responded with error. %s", peer.TCPAddress(), errRes.Error)
+	}
+
+	return readRes(res, resBody)
+}
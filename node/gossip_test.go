@@ -0,0 +1,194 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+func TestNode_GossipImportsAndRelaysAnnouncementsOnce(t *testing.T) {
+	sourceDataDir := getTestDataDirPath()
+	err := fs.RemoveDir(sourceDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	andrejKey, err := generateTestGenesis(sourceDataDir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+
+	source := New(sourceDataDir, database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, nil)
+	source.state, err = database.NewStateFromDisk(sourceDataDir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.state.Close()
+
+	blockHashes := mineTestBlocks(t, source, andrejKey, database.NewAccount(testBabayagaAccount), 3)
+
+	sourceServer, sourcePeer := startTestPeer(t, source, false)
+	defer sourceServer.Close()
+
+	// the relay peer records announcements relayed by the target
+	relayed := make(chan string, 10)
+	relayMux := http.NewServeMux()
+	relayMux.HandleFunc(endPointGossipBlock, func(w http.ResponseWriter, r *http.Request) {
+		relayed <- r.URL.Path
+		writeRes(w, AnnounceRes{})
+	})
+	relayMux.HandleFunc(endPointGossipTX, func(w http.ResponseWriter, r *http.Request) {
+		relayed <- r.URL.Path
+		writeRes(w, AnnounceRes{})
+	})
+	relayServer := httptest.NewServer(relayMux)
+	defer relayServer.Close()
+
+	targetDataDir := filepath.Join(os.TempDir(), ".tbb_test_gossip")
+	target := newTestSyncNode(t, sourceDataDir, targetDataDir, 8086)
+	defer fs.RemoveDir(targetDataDir)
+	defer target.state.Close()
+
+	target.AddPeer(sourcePeer)
+	target.AddPeer(testServerPeer(t, relayServer))
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-target.newSyncedBlocks:
+			case <-target.newPendingTXs:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	announce := func(endpoint string, req interface{}, handler func(http.ResponseWriter, *http.Request, *Node)) AnnounceRes {
+		reqJSON, err := json.Marshal(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(http.MethodPost, endpoint, bytes.NewReader(reqJSON)), target)
+		if w.Code != http.StatusOK {
+			t.Fatalf("announcement to '%s' failed. %s", endpoint, w.Body.String())
+		}
+
+		res := AnnounceRes{}
+		_ = json.Unmarshal(w.Body.Bytes(), &res)
+
+		return res
+	}
+
+	expectRelayed := func(endpoint string) {
+		select {
+		case path := <-relayed:
+			if path != endpoint {
+				t.Fatalf("announcement was suppose to be relayed to '%s', not '%s'", endpoint, path)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("announcement was suppose to be relayed to '%s'", endpoint)
+		}
+	}
+
+	// blocks are downloaded only from known peers
+	unknownServer, unknownPeer := startTestPeer(t, source, false)
+	defer unknownServer.Close()
+
+	_, err = target.queueAnnouncedBlock(unknownPeer, source.state.LatestBlock().Header)
+	if err == nil || len(target.blockAnnouncements) != 0 {
+		t.Fatal("block announced by an unknown peer was not suppose to be queued")
+	}
+
+	blockReq := BlockAnnounceReq{sourcePeer, source.state.LatestBlock().Header}
+	if announce(endPointGossipBlock, blockReq, blockAnnounceHandler).Known {
+		t.Fatal("announced block was not suppose to be known")
+	}
+
+	// the sync loop downloads the queued block
+	err = target.importAnnouncedBlock(<-target.blockAnnouncements)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target.state.LatestBlockHash() != blockHashes[len(blockHashes)-1] {
+		t.Fatal("announced block was suppose to be downloaded from the announcing peer")
+	}
+	expectRelayed(endPointGossipBlock)
+
+	if !announce(endPointGossipBlock, blockReq, blockAnnounceHandler).Known {
+		t.Fatal("block announced again was suppose to be known")
+	}
+
+	tx, err := database.SignTx(database.NewTx(andrej, andrej, 1, target.state.GetNextAccountNonce(andrej), ""), andrejKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	txReq := TXAnnounceReq{sourcePeer, tx}
+	if announce(endPointGossipTX, txReq, txAnnounceHandler).Known {
+		t.Fatal("announced TX was not suppose to be known")
+	}
+	expectRelayed(endPointGossipTX)
+
+	if !announce(endPointGossipTX, txReq, txAnnounceHandler).Known {
+		t.Fatal("TX announced again was suppose to be known")
+	}
+
+	select {
+	case path := <-relayed:
+		t.Fatalf("known announcement was not suppose to be relayed again to '%s'", path)
+	case <-time.After(500 * time.Millisecond):
+	}
+
+	// anyone can announce an invalid TX in the name of the source peer
+	invalidTxReq := TXAnnounceReq{sourcePeer, database.SignedTx{Tx: tx.Tx, Sig: make([]byte, 65)}}
+	for i := 0; i < 5; i++ {
+		reqJSON, err := json.Marshal(invalidTxReq)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := httptest.NewRecorder()
+		txAnnounceHandler(w, httptest.NewRequest(http.MethodPost, endPointGossipTX, bytes.NewReader(reqJSON)), target)
+		if w.Code == http.StatusOK {
+			t.Fatal("invalid TX announcement was suppose to be rejected")
+		}
+	}
+
+	if target.peerScores[sourcePeer.TCPAddress()].score != 0 || target.IsBannedPeer(sourcePeer) {
+		t.Fatal("the peer named by unauthenticated announcements was not suppose to be penalized")
+	}
+}
+
+func TestNode_MarkBlockAnnouncedForgetsOldestBlocks(t *testing.T) {
+	n := New(getTestDataDirPath(), database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, nil)
+
+	first := database.Hash{0xff, 0xff, 0xff}
+	n.markBlockAnnounced(first)
+	for i := 0; i < gossipMaxSeenBlocks; i++ {
+		n.markBlockAnnounced(database.Hash{byte(i), byte(i >> 8)})
+	}
+
+	if len(n.announcedBlocks) != gossipMaxSeenBlocks {
+		t.Fatalf("%d announced blocks were suppose to be remembered, not %d", gossipMaxSeenBlocks, len(n.announcedBlocks))
+	}
+
+	if !n.markBlockAnnounced(first) {
+		t.Fatal("the oldest announced block was suppose to be forgotten")
+	}
+}
@@ -8,10 +8,14 @@ import (
 )
 
 func writeErrRes(w http.ResponseWriter, err error) {
+	writeErrResWithStatus(w, http.StatusInternalServerError, err)
+}
+
+func writeErrResWithStatus(w http.ResponseWriter, status int, err error) {
 	jsonErrRes, _ := json.Marshal(ErrRes{err.Error()})
 	w.Header().Set("Content-Type", "application/json")
 
-	w.WriteHeader(http.StatusInternalServerError)
+	w.WriteHeader(status)
 	w.Write(jsonErrRes)
 }
 
@@ -51,7 +55,7 @@ func readRes(r *http.Response, reqBody interface{}) error {
 
 	err = json.Unmarshal(reqBodyJSON, reqBody)
 	if err != nil {
-		return fmt.Errorf("unable to unmarshal response body. %s", err.Error())
+		return fmt.Errorf("unable to unmarshal response body. %w. %s", errMalformedRes, err.Error())
 	}
 
 	return nil
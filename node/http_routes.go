@@ -2,9 +2,12 @@ package node
 
 import (
 	"fmt"
+	"math/big"
 	"net/http"
 	"strconv"
 
+	"github.com/ethereum/go-ethereum/common"
+
 	"the-blockchain-bar/database"
 )
 
@@ -20,11 +23,16 @@ type BalanceRes struct {
 }
 
 // TxAddReq is a request to add a new transaction
+// signed by the sender private key
 type TxAddReq struct {
 	From  string `json:"from"`
 	To    string `json:"to"`
 	Value uint   `json:"value"`
+	Fee   uint   `json:"fee"`
+	Nonce uint   `json:"nonce"`
 	Data  string `json:"data"`
+	Time  uint64 `json:"time"`
+	Sig   []byte `json:"signature"`
 }
 
 // TxAddRes is a response for adding new transaction
@@ -32,17 +40,54 @@ type TxAddRes struct {
 	Success bool `json:"success"`
 }
 
+// TXProofRes is a response with Merkle proof of a TX included in a canonical block
+type TXProofRes struct {
+	TXHash      database.Hash              `json:"tx_hash"`
+	BlockHash   database.Hash              `json:"block_hash"`
+	BlockNumber uint64                     `json:"block_number"`
+	TXRoot      database.Hash              `json:"tx_root"`
+	Proof       []database.MerkleProofStep `json:"proof"`
+}
+
+// AccountProofRes is a response with Merkle proof of an account
+// balance and nonce in the state committed by a canonical block
+type AccountProofRes struct {
+	Account     database.Account           `json:"account"`
+	Balance     uint                       `json:"balance"`
+	Nonce       uint                       `json:"nonce"`
+	BlockHash   database.Hash              `json:"block_hash"`
+	BlockNumber uint64                     `json:"block_number"`
+	StateRoot   database.Hash              `json:"state_root"`
+	Proof       []database.MerkleProofStep `json:"proof"`
+}
+
 // StatusRes is a response for node status
 type StatusRes struct {
-	Hash       database.Hash       `json:"block_hash"`
-	Number     uint64              `json:"block_number"`
+	Hash   database.Hash `json:"block_hash"`
+	Number uint64        `json:"block_number"`
+	// Work is cumulative proof of work of the node canonical chain
+	Work       *big.Int            `json:"work"`
 	KnownPeers map[string]PeerNode `json:"peers_known"`
-	PendingTXs []database.Tx       `json:"pending_txs"`
+	PendingTXs []database.SignedTx `json:"pending_txs"`
+}
+
+// NextNonceRes is a response for the nonce expected in the next account TX
+type NextNonceRes struct {
+	Account database.Account `json:"account"`
+	Nonce   uint             `json:"nonce"`
 }
 
-// SyncRes is a response for sync blockchain
+// SyncRes is a response for sync blockchain, a page of canonical blocks.
+// More blocks follow the last block of the page when HasMore is set.
 type SyncRes struct {
-	Blocks []database.Block `json:"blocks"`
+	Blocks  []database.Block `json:"blocks"`
+	HasMore bool             `json:"has_more"`
+}
+
+// HeadersRes is a response with canonical block headers for light nodes
+type HeadersRes struct {
+	Headers []database.BlockHeader `json:"headers"`
+	HasMore bool                   `json:"has_more"`
 }
 
 // AddPeerRes is a response for add peer node
@@ -52,9 +97,11 @@ type AddPeerRes struct {
 }
 
 func listBalancesHandler(w http.ResponseWriter, r *http.Request, state *database.State) {
+	balances, hash := state.GetBalances()
+
 	writeRes(w, BalanceRes{
-		Hash:     state.LatestBlockHash(),
-		Balances: state.Balances,
+		Hash:     hash,
+		Balances: balances,
 	})
 }
 
@@ -66,11 +113,17 @@ func txAddHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 		return
 	}
 
-	tx := database.NewTx(
-		database.NewAccount(req.From),
-		database.NewAccount(req.To),
-		req.Value,
-		req.Data,
+	tx := database.NewSignedTx(
+		database.Tx{
+			From:  database.NewAccount(req.From),
+			To:    database.NewAccount(req.To),
+			Value: req.Value,
+			Fee:   req.Fee,
+			Nonce: req.Nonce,
+			Data:  req.Data,
+			Time:  req.Time,
+		},
+		req.Sig,
 	)
 
 	err = node.AddPendingTX(tx, node.info)
@@ -84,17 +137,82 @@ func txAddHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 	})
 }
 
+func txProofHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	reqHash := r.URL.Query().Get(endPointTXProofQueryKeyHash)
+
+	txHash := database.Hash{}
+	err := txHash.UnmarshalText([]byte(reqHash))
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	proof, err := node.state.GetTXProof(txHash)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, TXProofRes{
+		TXHash:      proof.TXHash,
+		BlockHash:   proof.BlockHash,
+		BlockNumber: proof.BlockNumber,
+		TXRoot:      proof.TXRoot,
+		Proof:       proof.Proof,
+	})
+}
+
+func balanceProofHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	accRaw := r.URL.Query().Get(endPointBalanceProofQueryKey)
+	if !common.IsHexAddress(accRaw) {
+		writeErrRes(w, fmt.Errorf("invalid account '%s'", accRaw))
+		return
+	}
+
+	proof, err := node.state.GetAccountProof(database.NewAccount(accRaw))
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, AccountProofRes{
+		Account:     proof.Account,
+		Balance:     proof.Balance,
+		Nonce:       proof.Nonce,
+		BlockHash:   proof.BlockHash,
+		BlockNumber: proof.BlockNumber,
+		StateRoot:   proof.StateRoot,
+		Proof:       proof.Proof,
+	})
+}
+
 func statusHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 	res := StatusRes{
 		Hash:       node.state.LatestBlockHash(),
 		Number:     node.state.LatestBlock().Header.Number,
-		KnownPeers: node.knownPeers,
+		Work:       node.state.LatestBlockWork(),
+		KnownPeers: node.copyKnownPeers(),
 		PendingTXs: node.getPendingTXsAsArray(),
 	}
 
 	writeRes(w, res)
 }
 
+func nextNonceHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	accRaw := r.URL.Query().Get(endPointNextNonceQueryKeyAcc)
+	if !common.IsHexAddress(accRaw) {
+		writeErrRes(w, fmt.Errorf("invalid account '%s'", accRaw))
+		return
+	}
+
+	acc := database.NewAccount(accRaw)
+
+	writeRes(w, NextNonceRes{
+		Account: acc,
+		Nonce:   node.state.GetNextAccountNonce(acc),
+	})
+}
+
 func syncHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 	reqHash := r.URL.Query().Get(endPointSyncQueryKeyFromBlock)
 
@@ -105,17 +223,122 @@ func syncHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 		return
 	}
 
-	blocks, err := database.GetBlocksAfter(hash, node.dataDir)
+	limit, err := queryLimit(r, endPointSyncQueryKeyLimit, syncMaxPageBlocks)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if !hash.IsEmpty() && !node.state.HasBlock(hash) {
+		writeErrResWithStatus(w, http.StatusNotFound, fmt.Errorf("unknown block '%x'", hash))
+		return
+	}
+
+	blocks, err := node.state.GetBlocksAfter(hash, limit)
 	if err != nil {
 		writeErrRes(w, err)
 		return
 	}
 
+	hasMore := len(blocks) > 0 && blocks[len(blocks)-1].Header.Number < node.state.LatestBlock().Header.Number
+
 	writeRes(w, SyncRes{
-		Blocks: blocks,
+		Blocks:  blocks,
+		HasMore: hasMore,
+	})
+}
+
+func headersHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	reqHash := r.URL.Query().Get(endPointHeadersQueryKeyFrom)
+
+	hash := database.Hash{}
+	err := hash.UnmarshalText([]byte(reqHash))
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	limit, err := queryLimit(r, endPointHeadersQueryKeyLimit, syncMaxPageHeaders)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	headers, err := node.state.GetHeadersAfter(hash, limit)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	hasMore := len(headers) > 0 && headers[len(headers)-1].Number < node.state.LatestBlock().Header.Number
+
+	writeRes(w, HeadersRes{
+		Headers: headers,
+		HasMore: hasMore,
+	})
+}
+
+// queryLimit return the page limit of the request capped by the max limit,
+// the max limit is returned when the request doesn't set one
+func queryLimit(r *http.Request, key string, maxLimit uint64) (uint64, error) {
+	limitRaw := r.URL.Query().Get(key)
+	if limitRaw == "" {
+		return maxLimit, nil
+	}
+
+	limit, err := strconv.ParseUint(limitRaw, 10, 64)
+	if err != nil || limit == 0 {
+		return 0, fmt.Errorf("invalid limit '%s'", limitRaw)
+	}
+
+	if limit > maxLimit {
+		return maxLimit, nil
+	}
+
+	return limit, nil
+}
+
+func peersHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	writeRes(w, PeersRes{
+		Peers: node.peersScores(),
 	})
 }
 
+func blockAnnounceHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	req := BlockAnnounceReq{}
+	err := readReq(r, &req)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	isNew, err := node.queueAnnouncedBlock(req.Peer, req.Header)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, AnnounceRes{Known: !isNew})
+}
+
+func txAnnounceHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	req := TXAnnounceReq{}
+	err := readReq(r, &req)
+	if err != nil {
+		writeErrResWithStatus(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// the announcing peer isn't authenticated, so it isn't penalized for an invalid TX
+	isNew, err := node.addPendingTX(req.TX, req.Peer)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, AnnounceRes{Known: !isNew})
+}
+
 func addPeerHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 	peerIP := r.URL.Query().Get(endPointAddPeerQueryKeyIP)
 	peerPortRaw := r.URL.Query().Get(endpointAddPeerQueryKeyPort)
@@ -142,9 +365,17 @@ func addPeerHandler(w http.ResponseWriter, r *http.Request, node *Node) {
 		true,
 	)
 
+	if node.IsBannedPeer(peer) {
+		writeRes(w, AddPeerRes{
+			Success: false,
+			Error:   fmt.Sprintf("peer '%s' is banned", peer.TCPAddress()),
+		})
+		return
+	}
+
 	node.AddPeer(peer)
 
-	fmt.Printf("Peer '%s' was added into KnownPeers\n", peer.TCPAddress())
+	node.log.Info("Peer was added into known peers", "peer", peer.TCPAddress())
 
 	writeRes(w, AddPeerRes{
 		Success: true,
@@ -0,0 +1,166 @@
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"the-blockchain-bar/database"
+)
+
+// shutdownTimeoutSeconds limits how long in-flight HTTP requests are waited for on shutdown
+const shutdownTimeoutSeconds = 10
+
+// beginRun registers the node as running so it can be shut down,
+// the returned context is cancelled once the node is shutting down
+func (n *Node) beginRun(ctx context.Context) (context.Context, error) {
+	n.runMu.Lock()
+	defer n.runMu.Unlock()
+
+	if n.stopRun != nil {
+		return nil, errors.New("node is already running")
+	}
+
+	runCtx, stopRun := context.WithCancel(ctx)
+	n.stopRun = stopRun
+	n.stopped = make(chan struct{})
+
+	return runCtx, nil
+}
+
+// endRun marks the node as stopped once everything it runs has finished
+func (n *Node) endRun() {
+	n.runMu.Lock()
+	defer n.runMu.Unlock()
+
+	n.stopRun()
+	n.stopRun = nil
+	close(n.stopped)
+}
+
+// Shutdown gracefully stops the running node. In-flight HTTP requests are drained,
+// then the sync and the mining are stopped, the peer book is stored and the state is closed.
+// Shutdown returns once Run returned or the context is done.
+func (n *Node) Shutdown(ctx context.Context) error {
+	n.runMu.Lock()
+	stopRun, stopped := n.stopRun, n.stopped
+	n.runMu.Unlock()
+
+	if stopRun == nil {
+		return nil
+	}
+
+	stopRun()
+
+	select {
+	case <-stopped:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// runBackground runs the sync and mining loops until the HTTP API is drained
+// and returns a function stopping them and waiting until they returned
+func (n *Node) runBackground(loops ...func(ctx context.Context)) func() {
+	ctx, stop := context.WithCancel(context.Background())
+
+	n.runMu.Lock()
+	n.backgroundDone = ctx.Done()
+	n.runMu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, loop := range loops {
+		wg.Add(1)
+		go func(loop func(ctx context.Context)) {
+			defer wg.Done()
+			loop(ctx)
+		}(loop)
+	}
+
+	return func() {
+		stop()
+		wg.Wait()
+	}
+}
+
+// serveAPI serves the API with the metrics, or the metrics on their own port when it's set.
+// When one of the servers fails the other one is stopped too.
+func (n *Node) serveAPI(ctx context.Context, mux *http.ServeMux) error {
+	if n.metricsPort == 0 {
+		mux.Handle(endPointMetrics, n.metrics.handler())
+		return n.serveHTTP(ctx, n.info.Port, mux)
+	}
+
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle(endPointMetrics, n.metrics.handler())
+
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	metricsErr := make(chan error, 1)
+	go func() {
+		err := n.serveHTTP(ctx, n.metricsPort, metricsMux)
+		if err != nil {
+			stop()
+		}
+		metricsErr <- err
+	}()
+
+	err := n.serveHTTP(ctx, n.info.Port, mux)
+	stop()
+
+	if mErr := <-metricsErr; mErr != nil && err == nil {
+		err = fmt.Errorf("metrics server failed. %w", mErr)
+	}
+
+	return err
+}
+
+// serveHTTP serves the handler on the port until the context is cancelled,
+// then it stops accepting connections and waits for in-flight requests
+func (n *Node) serveHTTP(ctx context.Context, port uint64, handler http.Handler) error {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: handler,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeoutSeconds*time.Second)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		_ = server.Close()
+		err = fmt.Errorf("in-flight requests were not finished in %ds. %w", shutdownTimeoutSeconds, err)
+	}
+	<-serveErr
+
+	return err
+}
+
+// notifySyncedBlock hands the synced block to the mining loop,
+// unless the loop already stopped because the node is shutting down
+func (n *Node) notifySyncedBlock(block database.Block) {
+	n.runMu.Lock()
+	backgroundDone := n.backgroundDone
+	n.runMu.Unlock()
+
+	select {
+	case n.newSyncedBlocks <- block:
+	case <-backgroundDone:
+	}
+}
@@ -0,0 +1,98 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+func TestNode_ShutdownStopsSeveralNodesInOneProcess(t *testing.T) {
+	nodes := make([]*Node, 2)
+	runErrs := make([]chan error, len(nodes))
+
+	for i := range nodes {
+		dataDir := filepath.Join(os.TempDir(), fmt.Sprintf(".tbb_test_lifecycle_%d", i))
+		err := fs.RemoveDir(dataDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer fs.RemoveDir(dataDir)
+
+		nodes[i] = New(dataDir, database.BackendBolt, "127.0.0.1", getFreeTestPort(t), database.Account{}, nil)
+		runErrs[i] = runTestNode(t, nodes[i])
+	}
+
+	for i, n := range nodes {
+		shutdownTestNode(t, n, runErrs[i])
+
+		_, err := os.Stat(getPeerBookFilePath(n.dataDir))
+		if err != nil {
+			t.Fatalf("peer book was suppose to be stored on shutdown. %s", err)
+		}
+
+		err = n.Shutdown(context.Background())
+		if err != nil {
+			t.Fatalf("shutting down a stopped node was not suppose to fail. %s", err)
+		}
+	}
+
+	// the stopped node released its port and closed the bolt db, so it can run again
+	restarted := New(nodes[0].dataDir, database.BackendBolt, nodes[0].info.IP, nodes[0].info.Port, database.Account{}, nil)
+	shutdownTestNode(t, restarted, runTestNode(t, restarted))
+}
+
+// runTestNode runs the node in the background until it serves its status
+func runTestNode(t *testing.T, n *Node) chan error {
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- n.Run(context.Background())
+	}()
+
+	for i := 0; i < 100; i++ {
+		_, err := queryPeerStatus(n.info)
+		if err == nil {
+			return runErr
+		}
+
+		select {
+		case err = <-runErr:
+			t.Fatalf("node '%s' was suppose to run. %s", n.info.TCPAddress(), err)
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+
+	t.Fatalf("node '%s' was suppose to serve its status", n.info.TCPAddress())
+	return nil
+}
+
+func shutdownTestNode(t *testing.T, n *Node, runErr chan error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := n.Shutdown(ctx)
+	if err != nil {
+		t.Fatalf("node '%s' was suppose to shut down. %s", n.info.TCPAddress(), err)
+	}
+
+	err = <-runErr
+	if err != nil {
+		t.Fatalf("node '%s' Run was suppose to return without error. %s", n.info.TCPAddress(), err)
+	}
+}
+
+func getFreeTestPort(t *testing.T) uint64 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	return uint64(listener.Addr().(*net.TCPAddr).Port)
+}
@@ -0,0 +1,282 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+
+	"the-blockchain-bar/database"
+)
+
+// lightProofMaxAgeBlocks limits how many blocks behind the synced header
+// chain tip an account proof can be, older proofs can return stale balances
+const lightProofMaxAgeBlocks = 6
+
+// runLight will run rest API of a light node, it syncs only the block headers
+// and serves balances and TXs fetched from full peers once their proofs
+// are verified against the synced headers
+func (n *Node) runLight(ctx context.Context) error {
+	headers, err := database.NewHeaderChainFromDiskWithLogger(n.dataDir, n.log)
+	if err != nil {
+		return err
+	}
+	defer headers.Close()
+
+	n.headers = headers
+
+	n.log.Info("Listening in light mode", "ip", n.info.IP, "port", n.info.Port, "height", headers.LatestHeader().Number, "hash", headers.LatestHash().Hex())
+
+	n.loadPeers()
+	defer n.storePeers()
+
+	stopBackground := n.runBackground(n.syncLight)
+	defer stopBackground()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(endPointBalanceProof, func(w http.ResponseWriter, r *http.Request) {
+		lightBalanceProofHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointTXProof, func(w http.ResponseWriter, r *http.Request) {
+		lightTXProofHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointStatus, func(w http.ResponseWriter, r *http.Request) {
+		lightStatusHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointPeers, func(w http.ResponseWriter, r *http.Request) {
+		peersHandler(w, r, n)
+	})
+
+	return n.serveAPI(ctx, mux)
+}
+
+func (n *Node) syncLight(ctx context.Context) {
+	ticker := time.NewTicker(10 * time.Second)
+
+	for {
+		select {
+		case <-ticker.C:
+			n.doSyncLight()
+			n.storePeers()
+		case <-ctx.Done():
+			ticker.Stop()
+			return
+		}
+	}
+}
+
+// doSyncLight syncs headers and peers from the first reachable peer.
+// A light node doesn't join peers KnownPeers as it can't serve blocks.
+func (n *Node) doSyncLight() {
+	start := time.Now()
+	defer func() {
+		n.metrics.syncDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	n.unbanExpiredPeers()
+
+	for _, peer := range n.copyKnownPeers() {
+		if n.isSelf(peer) {
+			continue
+		}
+
+		n.log.Debug("Searching for new peers and their headers", "peer", peer.TCPAddress())
+
+		status, err := queryPeerStatus(peer)
+		if err != nil {
+			n.log.Warn("Querying peer status failed", "peer", peer.TCPAddress(), "err", err)
+			n.penalizePeer(peer, err)
+			continue
+		}
+		n.rewardPeer(peer)
+
+		err = n.syncHeaders(peer, status)
+		if err != nil {
+			n.log.Warn("Syncing headers failed", "peer", peer.TCPAddress(), "err", err)
+			n.penalizePeer(peer, err)
+			continue
+		}
+		n.metrics.observeSyncLag(status.Number, n.headers.LatestHeader().Number)
+
+		err = n.syncKnownPeers(status)
+		if err != nil {
+			n.log.Warn("Syncing known peers failed", "peer", peer.TCPAddress(), "err", err)
+			continue
+		}
+
+		return
+	}
+}
+
+func (n *Node) syncHeaders(peer PeerNode, status StatusRes) error {
+	// if the peer has no blocks or we already know its latest header, ignore it
+	if status.Hash.IsEmpty() || n.headers.HasHeader(status.Hash) {
+		return nil
+	}
+
+	n.log.Info("Found new headers", "height", status.Number, "hash", status.Hash.Hex(), "peer", peer.TCPAddress())
+
+	// only the proof of work and parent links are verified,
+	// the TXs and balances are trusted by their Merkle roots
+	_, err := fetchHeadersFromForkPoint(peer, n.headers.BlockLocator(), status.Number, func(page []database.BlockHeader) error {
+		for _, header := range page {
+			_, err := n.headers.AddHeader(header)
+			if err != nil {
+				return fmt.Errorf("header '%d' from peer '%s' rejected. %w. %s", header.Number, peer.TCPAddress(), errInvalidBlock, err.Error())
+			}
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// fetchVerifiedAccountProof return the account state proven
+// by a full peer against the state root of a synced header
+func (n *Node) fetchVerifiedAccountProof(acc database.Account) (AccountProofRes, error) {
+	err := fmt.Errorf("no full peer to fetch account '%s' from", acc.String())
+
+	for _, peer := range n.copyKnownPeers() {
+		if n.isSelf(peer) {
+			continue
+		}
+
+		proof := AccountProofRes{}
+		err = getPeerRes(peer, fmt.Sprintf("%s?%s=%s", endPointBalanceProof, endPointBalanceProofQueryKey, acc.String()), &proof)
+		if err != nil {
+			n.penalizePeer(peer, err)
+			continue
+		}
+
+		header, isCanonical := n.headers.CanonicalHeader(proof.BlockHash)
+		if !isCanonical {
+			err = fmt.Errorf("block '%x' of the account proof from peer '%s' isn't in the synced header chain", proof.BlockHash, peer.TCPAddress())
+			continue
+		}
+
+		// a lagging peer isn't malicious, the balance is requested from the next one
+		if !n.isRecentHeader(header) {
+			err = fmt.Errorf("block '%d' of the account proof from peer '%s' is too old, the synced header chain is at block '%d'", header.Number, peer.TCPAddress(), n.headers.LatestHeader().Number)
+			continue
+		}
+
+		isValid, verifyErr := database.VerifyAccountProof(database.AccountProof{
+			Account: acc,
+			Balance: proof.Balance,
+			Nonce:   proof.Nonce,
+			Proof:   proof.Proof,
+		}, header.StateRoot)
+		if verifyErr != nil || !isValid {
+			err = fmt.Errorf("%w of account '%s' from peer '%s'", errInvalidProof, acc.String(), peer.TCPAddress())
+			n.penalizePeer(peer, err)
+			continue
+		}
+
+		proof.Account = acc
+		proof.BlockNumber = header.Number
+		proof.StateRoot = header.StateRoot
+
+		return proof, nil
+	}
+
+	return AccountProofRes{}, err
+}
+
+// isRecentHeader return true when the canonical header is at most
+// lightProofMaxAgeBlocks behind the synced header chain tip
+func (n *Node) isRecentHeader(header database.BlockHeader) bool {
+	return header.Number+lightProofMaxAgeBlocks >= n.headers.LatestHeader().Number
+}
+
+// fetchVerifiedTXProof return the TX inclusion proven
+// by a full peer against the TX root of a synced header
+func (n *Node) fetchVerifiedTXProof(txHash database.Hash) (TXProofRes, error) {
+	err := fmt.Errorf("no full peer to fetch TX '%x' from", txHash)
+
+	for _, peer := range n.copyKnownPeers() {
+		if n.isSelf(peer) {
+			continue
+		}
+
+		proof := TXProofRes{}
+		err = getPeerRes(peer, fmt.Sprintf("%s?%s=%s", endPointTXProof, endPointTXProofQueryKeyHash, txHash.Hex()), &proof)
+		if err != nil {
+			n.penalizePeer(peer, err)
+			continue
+		}
+
+		header, isCanonical := n.headers.CanonicalHeader(proof.BlockHash)
+		if !isCanonical {
+			err = fmt.Errorf("block '%x' of the TX proof from peer '%s' isn't in the synced header chain", proof.BlockHash, peer.TCPAddress())
+			continue
+		}
+
+		if !database.VerifyMerkleProof(txHash, header.TXRoot, proof.Proof) {
+			err = fmt.Errorf("%w of TX '%x' from peer '%s'", errInvalidProof, txHash, peer.TCPAddress())
+			n.penalizePeer(peer, err)
+			continue
+		}
+
+		proof.TXHash = txHash
+		proof.BlockNumber = header.Number
+		proof.TXRoot = header.TXRoot
+
+		return proof, nil
+	}
+
+	return TXProofRes{}, err
+}
+
+func lightStatusHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	res := StatusRes{
+		Hash:       node.headers.LatestHash(),
+		Number:     node.headers.LatestHeader().Number,
+		Work:       node.headers.LatestWork(),
+		KnownPeers: node.copyKnownPeers(),
+		PendingTXs: []database.SignedTx{},
+	}
+
+	writeRes(w, res)
+}
+
+func lightBalanceProofHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	accRaw := r.URL.Query().Get(endPointBalanceProofQueryKey)
+	if !common.IsHexAddress(accRaw) {
+		writeErrRes(w, fmt.Errorf("invalid account '%s'", accRaw))
+		return
+	}
+
+	proof, err := node.fetchVerifiedAccountProof(database.NewAccount(accRaw))
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, proof)
+}
+
+func lightTXProofHandler(w http.ResponseWriter, r *http.Request, node *Node) {
+	reqHash := r.URL.Query().Get(endPointTXProofQueryKeyHash)
+
+	txHash := database.Hash{}
+	err := txHash.UnmarshalText([]byte(reqHash))
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	proof, err := node.fetchVerifiedTXProof(txHash)
+	if err != nil {
+		writeErrRes(w, err)
+		return
+	}
+
+	writeRes(w, proof)
+}
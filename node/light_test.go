@@ -0,0 +1,179 @@
+package node
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+func TestNode_FetchVerifiedProofs(t *testing.T) {
+	sourceDataDir := getTestDataDirPath()
+	err := fs.RemoveDir(sourceDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	andrejKey, err := generateTestGenesis(sourceDataDir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := New(sourceDataDir, database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, nil)
+	source.state, err = database.NewStateFromDisk(sourceDataDir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.state.Close()
+
+	babayaga := database.NewAccount(testBabayagaAccount)
+	blockHashes := mineTestBlocks(t, source, andrejKey, babayaga, 2)
+
+	staleProof := testAccountProofRes(t, source, babayaga)
+
+	// the stale proof ends up more than lightProofMaxAgeBlocks behind the synced headers
+	blockHashes = append(blockHashes, mineTestBlocks(t, source, andrejKey, babayaga, lightProofMaxAgeBlocks+1)...)
+
+	txBlock, err := source.state.GetBlock(blockHashes[len(blockHashes)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	txHash, err := txBlock.Block.TXs[0].Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sourceServer, sourcePeer := startTestPeer(t, source, false)
+	defer sourceServer.Close()
+
+	lightDataDir := filepath.Join(os.TempDir(), ".tbb_test_light")
+	copyTestGenesis(t, sourceDataDir, lightDataDir)
+	defer fs.RemoveDir(lightDataDir)
+
+	light := NewLight(lightDataDir, "127.0.0.1", 8086, nil)
+	light.headers, err = database.NewHeaderChainFromDisk(lightDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer light.headers.Close()
+
+	status, err := queryPeerStatus(sourcePeer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = light.syncHeaders(sourcePeer, status)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if light.headers.LatestHash() != blockHashes[len(blockHashes)-1] {
+		t.Fatal("light node was suppose to sync all the source headers")
+	}
+
+	forgedProof := testAccountProofRes(t, source, babayaga)
+	forgedProof.Balance++
+
+	tests := []struct {
+		name         string
+		accountProof *AccountProofRes
+		txProof      *TXProofRes
+		err          string
+		isPenalized  bool
+	}{
+		{name: "valid proof"},
+		{name: "root mismatch", accountProof: &forgedProof, err: errInvalidProof.Error(), isPenalized: true},
+		{name: "TX proof of unknown block", txProof: &TXProofRes{BlockHash: database.Hash{0x01}}, err: "isn't in the synced header chain"},
+		{name: "stale proof", accountProof: &staleProof, err: "is too old"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			server, peer := startTestProofPeer(t, source, tc.accountProof, tc.txProof)
+			defer server.Close()
+
+			light.AddPeer(peer)
+			defer light.RemovePeer(peer)
+
+			accountProof, accountErr := light.fetchVerifiedAccountProof(babayaga)
+			txProof, txErr := light.fetchVerifiedTXProof(txHash)
+
+			err := errors.Join(accountErr, txErr)
+			if tc.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if accountProof.BlockHash != blockHashes[len(blockHashes)-1] || accountProof.Balance != source.state.Balances[babayaga] {
+					t.Fatal("account proof was suppose to be verified against the latest header")
+				}
+
+				if txProof.BlockHash != txBlock.Hash || txProof.TXHash != txHash {
+					t.Fatal("TX proof was suppose to be verified against the TX block header")
+				}
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.err) {
+				t.Fatalf("proof was suppose to be rejected with '%s', got %v", tc.err, err)
+			}
+
+			isPenalized := light.peerScores[peer.TCPAddress()].score > 0
+			if isPenalized != tc.isPenalized {
+				t.Fatalf("peer penalized %t, expected %t", isPenalized, tc.isPenalized)
+			}
+		})
+	}
+}
+
+// startTestProofPeer starts a test full peer serving the proofs,
+// a nil proof is served from the state of the node
+func startTestProofPeer(t *testing.T, n *Node, accountProof *AccountProofRes, txProof *TXProofRes) (*httptest.Server, PeerNode) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(endPointBalanceProof, func(w http.ResponseWriter, r *http.Request) {
+		if accountProof != nil {
+			writeRes(w, *accountProof)
+			return
+		}
+
+		balanceProofHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointTXProof, func(w http.ResponseWriter, r *http.Request) {
+		if txProof != nil {
+			writeRes(w, *txProof)
+			return
+		}
+
+		txProofHandler(w, r, n)
+	})
+
+	server := httptest.NewServer(mux)
+
+	return server, testServerPeer(t, server)
+}
+
+// testAccountProofRes return the account proof the node serves at its latest block
+func testAccountProofRes(t *testing.T, n *Node, acc database.Account) AccountProofRes {
+	proof, err := n.state.GetAccountProof(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return AccountProofRes{
+		Account:     proof.Account,
+		Balance:     proof.Balance,
+		Nonce:       proof.Nonce,
+		BlockHash:   proof.BlockHash,
+		BlockNumber: proof.BlockNumber,
+		StateRoot:   proof.StateRoot,
+		Proof:       proof.Proof,
+	}
+}
@@ -0,0 +1,15 @@
+package node
+
+import (
+	"os"
+	"testing"
+
+	"the-blockchain-bar/logger"
+)
+
+// TestMain silences the default logger, so only failing tests show up in the test output
+func TestMain(m *testing.M) {
+	logger.SetDefault(logger.Discard())
+
+	os.Exit(m.Run())
+}
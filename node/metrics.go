@@ -0,0 +1,164 @@
+package node
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	endPointMetrics = "/metrics"
+
+	metricsNamespace = "tbb"
+
+	blockSourceSync  = "sync"
+	blockSourceMined = "mined"
+)
+
+// nodeMetrics are the Prometheus metrics of a node. Every node has its own registry,
+// so several nodes running in one process don't share their metrics.
+type nodeMetrics struct {
+	registry *prometheus.Registry
+
+	minedBlocks    prometheus.Counter
+	miningHashes   prometheus.Counter
+	miningHashRate prometheus.Gauge
+
+	syncDuration prometheus.Histogram
+	syncLag      prometheus.Gauge
+
+	importedBlocks      *prometheus.CounterVec
+	rejectedBlocks      *prometheus.CounterVec
+	blockImportDuration *prometheus.HistogramVec
+}
+
+// newNodeMetrics will return metrics of the node, the chain height,
+// pending TXs and peers gauges are read from the node when scraped
+func newNodeMetrics(n *Node) *nodeMetrics {
+	m := &nodeMetrics{
+		registry: prometheus.NewRegistry(),
+		minedBlocks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mined_blocks_total",
+			Help:      "Number of blocks mined by the node.",
+		}),
+		miningHashes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "mining_hashes_total",
+			Help:      "Number of block hashes computed while mining, including cancelled mining.",
+		}),
+		miningHashRate: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "mining_hash_rate",
+			Help:      "Hashes per second of the last mining.",
+		}),
+		syncDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "sync_duration_seconds",
+			Help:      "Duration of syncing blocks or headers, peers and pending TXs from the known peers.",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 4, 8),
+		}),
+		syncLag: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "sync_lag_blocks",
+			Help:      "Number of blocks the node is behind the highest chain of its peers after the last sync.",
+		}),
+		importedBlocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "imported_blocks_total",
+			Help:      "Number of blocks added to the state, by source of the block.",
+		}, []string{"source"}),
+		rejectedBlocks: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "rejected_blocks_total",
+			Help:      "Number of blocks the state refused to add, by source of the block.",
+		}, []string{"source"}),
+		blockImportDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "block_import_duration_seconds",
+			Help:      "Duration of adding a block to the state, by source of the block.",
+			Buckets:   prometheus.ExponentialBuckets(0.0005, 4, 8),
+		}, []string{"source"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.minedBlocks,
+		m.miningHashes,
+		m.miningHashRate,
+		m.syncDuration,
+		m.syncLag,
+		m.importedBlocks,
+		m.rejectedBlocks,
+		m.blockImportDuration,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "chain_height",
+			Help:      "Number of the latest canonical block, or block header of a light node.",
+		}, func() float64 {
+			return float64(n.chainHeight())
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "pending_txs",
+			Help:      "Number of TXs in the pending pool.",
+		}, func() float64 {
+			return float64(len(n.getPendingTXsAsArray()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "known_peers",
+			Help:      "Number of known peers.",
+		}, func() float64 {
+			return float64(len(n.copyKnownPeers()))
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "mining",
+			Help:      "1 while the node is mining a block.",
+		}, func() float64 {
+			if n.IsMining() {
+				return 1
+			}
+			return 0
+		}),
+	)
+
+	return m
+}
+
+// handler return the HTTP handler serving the metrics in Prometheus text format
+func (m *nodeMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// observeMining records the hashes computed by a finished or cancelled mining
+func (m *nodeMetrics) observeMining(attempts int, duration time.Duration) {
+	m.miningHashes.Add(float64(attempts))
+	if duration > 0 {
+		m.miningHashRate.Set(float64(attempts) / duration.Seconds())
+	}
+}
+
+// observeBlockImport records adding a block of the source to the state
+func (m *nodeMetrics) observeBlockImport(source string, duration time.Duration, err error) {
+	m.blockImportDuration.WithLabelValues(source).Observe(duration.Seconds())
+
+	if err != nil {
+		m.rejectedBlocks.WithLabelValues(source).Inc()
+		return
+	}
+	m.importedBlocks.WithLabelValues(source).Inc()
+}
+
+// observeSyncLag records how far behind the highest peer chain the node is
+func (m *nodeMetrics) observeSyncLag(peerHeight uint64, height uint64) {
+	if peerHeight < height {
+		peerHeight = height
+	}
+	m.syncLag.Set(float64(peerHeight - height))
+}
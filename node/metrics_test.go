@@ -0,0 +1,131 @@
+package node
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+func TestNode_MetricsExposeMiningAndBlockImports(t *testing.T) {
+	datadir := getTestDataDirPath()
+	err := fs.RemoveDir(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	andrejKey, err := generateTestGenesis(datadir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := database.NewAccount(testBabayagaAccount)
+
+	n := New(datadir, database.DefaultBackend, "127.0.0.1", 8085, andrej, nil)
+	n.state, err = database.NewStateFromDisk(datadir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.state.Close()
+
+	for nonce := uint(1); nonce <= 2; nonce++ {
+		tx, err := database.SignTx(database.NewTx(andrej, babayaga, 1, nonce, ""), andrejKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = n.AddPendingTX(tx, n.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expectTestMetric(t, scrapeTestMetrics(t, n.metrics.handler()), "tbb_pending_txs 1")
+
+		err = n.minePendingTXs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	metrics := scrapeTestMetrics(t, n.metrics.handler())
+	for _, expected := range []string{
+		"tbb_chain_height 1",
+		"tbb_pending_txs 0",
+		"tbb_mined_blocks_total 2",
+		`tbb_imported_blocks_total{source="mined"} 2`,
+		`tbb_block_import_duration_seconds_count{source="mined"} 2`,
+		"tbb_mining 0",
+	} {
+		expectTestMetric(t, metrics, expected)
+	}
+
+	if strings.Contains(metrics, "tbb_mining_hashes_total 0\n") || !strings.Contains(metrics, "tbb_mining_hash_rate ") {
+		t.Fatalf("mining hashes were suppose to be counted\n%s", metrics)
+	}
+}
+
+func TestNode_MetricsServedOnSeparatePort(t *testing.T) {
+	dataDir := filepath.Join(os.TempDir(), ".tbb_test_metrics")
+	err := fs.RemoveDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.RemoveDir(dataDir)
+
+	n := New(dataDir, database.DefaultBackend, "127.0.0.1", getFreeTestPort(t), database.Account{}, nil)
+	n.SetMetricsPort(getFreeTestPort(t))
+	runErr := runTestNode(t, n)
+	defer shutdownTestNode(t, n, runErr)
+
+	res, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", n.metricsPort, endPointMetrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("metrics port responded with %d", res.StatusCode)
+	}
+	expectTestMetric(t, string(body), "tbb_chain_height 0")
+
+	res, err = http.Get(fmt.Sprintf("http://%s%s", n.info.TCPAddress(), endPointMetrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusNotFound {
+		t.Fatalf("metrics were not suppose to be served on the API port, got %d", res.StatusCode)
+	}
+}
+
+func scrapeTestMetrics(t *testing.T, handler http.Handler) string {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, endPointMetrics, nil))
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("metrics responded with %d. %s", w.Code, w.Body.String())
+	}
+
+	return w.Body.String()
+}
+
+func expectTestMetric(t *testing.T, metrics string, expected string) {
+	if !strings.Contains(metrics, expected+"\n") {
+		t.Fatalf("metric '%s' not found in\n%s", expected, metrics)
+	}
+}
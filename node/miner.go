@@ -8,89 +8,110 @@ import (
 	"time"
 
 	"the-blockchain-bar/database"
-	"the-blockchain-bar/fs"
+	"the-blockchain-bar/logger"
 )
 
 // PendingBlock is a block where waiting to be validate
 type PendingBlock struct {
-	parent database.Hash
-	number uint64
-	time   uint64
-	miner  database.Account
-	txs    []database.Tx
+	parent     database.Hash
+	number     uint64
+	time       uint64
+	difficulty uint64
+	miner      database.Account
+	stateRoot  database.Hash
+	txs        []database.SignedTx
 }
 
 // NewPendingBlock will return new pending block
 func NewPendingBlock(
 	parent database.Hash,
 	number uint64,
+	difficulty uint64,
 	miner database.Account,
-	txs []database.Tx) PendingBlock {
+	stateRoot database.Hash,
+	txs []database.SignedTx) PendingBlock {
 	return PendingBlock{
-		parent: parent,
-		number: number,
-		time:   uint64(time.Now().Unix()),
-		miner:  miner,
-		txs:    txs,
+		parent:     parent,
+		number:     number,
+		time:       uint64(time.Now().Unix()),
+		difficulty: difficulty,
+		miner:      miner,
+		stateRoot:  stateRoot,
+		txs:        txs,
 	}
 }
 
 // Mine will mine token by validating transaction (consensus)
 func Mine(ctx context.Context, pb PendingBlock) (database.Block, error) {
+	block, _, err := mine(ctx, pb, logger.Default())
+	return block, err
+}
+
+// mine return the mined block with the number of hashes computed, also when the mining fails
+func mine(ctx context.Context, pb PendingBlock, log logger.Logger) (database.Block, int, error) {
 	if len(pb.txs) == 0 {
-		return database.Block{}, errors.New("mining empty blocks is not allowed")
+		return database.Block{}, 0, errors.New("mining empty blocks is not allowed")
 	}
 
 	start := time.Now()
 	attempt := 0
-	var (
-		block database.Block
-		hash  database.Hash
-		nonce uint32
+	var hash database.Hash
+
+	// the nonce is the only header field changing between attempts
+	block, err := database.NewBlock(
+		pb.parent,
+		pb.number,
+		0,
+		pb.time,
+		pb.difficulty,
+		pb.miner,
+		pb.stateRoot,
+		pb.txs,
 	)
+	if err != nil {
+		return database.Block{}, 0, fmt.Errorf("couldn't mine block. %s", err.Error())
+	}
 
-	for !database.IsBlockHashValid(hash) {
+	for {
 		select {
 		case <-ctx.Done():
-			fmt.Println("mining cancelled")
-			return database.Block{}, fmt.Errorf("mining cancelled. %s", ctx.Err())
+			log.Debug("Mining cancelled", "height", pb.number, "attempt", attempt)
+			return database.Block{}, attempt, fmt.Errorf("mining cancelled. %s", ctx.Err())
 		default:
 		}
 
 		attempt++
-		nonce = generateNonce()
+		block.Header.Nonce = generateNonce()
 
 		if attempt%1000000 == 0 || attempt == 1 {
-			fmt.Printf("mining %d pending TXs. Attempt: %d\n", len(pb.txs), attempt)
+			log.Debug("Mining pending TXs", "height", pb.number, "txs", len(pb.txs), "attempt", attempt)
 		}
 
-		block = database.NewBlock(
-			pb.parent,
-			pb.number,
-			nonce,
-			pb.time,
-			pb.miner,
-			pb.txs,
-		)
-
 		blockHash, err := block.Hash()
 		if err != nil {
-			return database.Block{}, fmt.Errorf("couldn't mine block. %s", err.Error())
+			return database.Block{}, attempt, fmt.Errorf("couldn't mine block. %s", err.Error())
 		}
 
 		hash = blockHash
+		if database.IsBlockHashValid(hash, pb.difficulty) {
+			break
+		}
 	}
 
-	fmt.Printf("Mined new block '%x' using PoW 🥳 %s:\n", hash, fs.Unicode("\\UIF389"))
-	fmt.Printf("Height: '%v'\n", block.Header.Number)
-	fmt.Printf("Nonce: '%v'", block.Header.Nonce)
-	fmt.Printf("Created: '%v'\n", block.Header.Time)
-	fmt.Printf("Miner: '%v'\n", block.Header.Miner)
-	fmt.Printf("Parent: '%v'\n\n", block.Header.Parent.Hex())
-	fmt.Printf("Attempt: '%v'\n", attempt)
-	fmt.Printf("Time: %s\n\n", time.Since(start))
+	log.Info(
+		"Mined new block using PoW",
+		"height", block.Header.Number,
+		"hash", hash.Hex(),
+		"nonce", block.Header.Nonce,
+		"difficulty", block.Header.Difficulty,
+		"miner", block.Header.Miner.String(),
+		"parent", block.Header.Parent.Hex(),
+		"txs", len(pb.txs),
+		"attempt", attempt,
+		"duration", time.Since(start),
+	)
 
-	return block, nil
+	return block, attempt, nil
 }
 
 func generateNonce() uint32 {
@@ -6,6 +6,18 @@ import (
 	"testing"
 	"the-blockchain-bar/database"
 	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+const (
+	testAndrejAccount   = "0x09ee50f2f37fcba1845de6fe5c762e83e65e755c"
+	testBabayagaAccount = "0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a"
+
+	// testMiningDifficulty keeps the tests chain trivial to mine
+	testMiningDifficulty = uint64(1)
+	// testSlowMiningDifficulty takes seconds to mine a block
+	testSlowMiningDifficulty = uint64(1 << 18)
 )
 
 func TestValidBlockHash(t *testing.T) {
@@ -15,7 +27,7 @@ func TestValidBlockHash(t *testing.T) {
 
 	hex.Decode(hash[:], []byte(hexHash))
 
-	isValid := database.IsBlockHashValid(hash)
+	isValid := database.IsBlockHashValid(hash, database.DefaultDifficulty)
 	if !isValid {
 		t.Fatalf("hash '%s' starting with 6 zeroes is suppose to be valid", hexHash)
 	}
@@ -27,15 +39,18 @@ func TestInvalidBlockHash(t *testing.T) {
 
 	hex.Decode(hash[:], []byte(hexHash))
 
-	isValid := database.IsBlockHashValid(hash)
+	isValid := database.IsBlockHashValid(hash, database.DefaultDifficulty)
 	if isValid {
 		t.Fatal("hash is not suppose to be valid")
 	}
 }
 
 func TestMine(t *testing.T) {
-	miner := database.NewAccount("andrej")
-	pendingBlock := createRandomPendingBlock(miner)
+	miner := database.NewAccount(testAndrejAccount)
+	pendingBlock, err := createRandomPendingBlock(miner, 1<<8)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	ctx := context.Background()
 	minedBlock, err := Mine(ctx, pendingBlock)
@@ -48,7 +63,7 @@ func TestMine(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if !database.IsBlockHashValid(mindeBlockhash) {
+	if !database.IsBlockHashValid(mindeBlockhash, minedBlock.Header.Difficulty) {
 		t.Fatal("mined block hash is not valid")
 	}
 
@@ -58,30 +73,44 @@ func TestMine(t *testing.T) {
 }
 
 func TestMineWithTimeout(t *testing.T) {
-	miner := database.NewAccount("andrej")
-	pendingBlock := createRandomPendingBlock(miner)
+	miner := database.NewAccount(testAndrejAccount)
+	pendingBlock, err := createRandomPendingBlock(miner, database.DefaultDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), time.Microsecond*100)
 	defer cancel()
-	_, err := Mine(ctx, pendingBlock)
+	_, err = Mine(ctx, pendingBlock)
 	if err == nil {
 		t.Fatal(err)
 	}
 }
 
-func createRandomPendingBlock(miner database.Account) PendingBlock {
+func createRandomPendingBlock(miner database.Account, difficulty uint64) (PendingBlock, error) {
+	privKey, err := crypto.GenerateKey()
+	if err != nil {
+		return PendingBlock{}, err
+	}
+
+	tx, err := database.SignTx(database.Tx{
+		From:  crypto.PubkeyToAddress(privKey.PublicKey),
+		To:    database.NewAccount(testBabayagaAccount),
+		Value: 1,
+		Nonce: 1,
+		Time:  1579451695,
+		Data:  "",
+	}, privKey)
+	if err != nil {
+		return PendingBlock{}, err
+	}
+
 	return NewPendingBlock(
 		database.Hash{},
 		1,
+		difficulty,
 		miner,
-		[]database.Tx{
-			{
-				From:  "andrej",
-				To:    "babayaga",
-				Value: 1,
-				Time:  1579451695,
-				Data:  "",
-			},
-		},
-	)
+		database.Hash{},
+		[]database.SignedTx{tx},
+	), nil
 }
@@ -2,12 +2,19 @@ package node
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/ethereum/go-ethereum/common"
+
 	"the-blockchain-bar/database"
+	"the-blockchain-bar/logger"
 )
 
 const (
@@ -19,15 +26,36 @@ const (
 	DefaultHTTPPort = 8080
 
 	endPointStatus                = "/node/status"
+	endPointNextNonce             = "/node/nonce/next"
+	endPointNextNonceQueryKeyAcc  = "account"
+	endPointTXProof               = "/tx/proof"
+	endPointTXProofQueryKeyHash   = "hash"
 	endPointSync                  = "/node/sync"
 	endPointSyncQueryKeyFromBlock = "fromBlock"
+	endPointSyncQueryKeyLimit     = "limit"
+	endPointHeaders               = "/node/headers"
+	endPointHeadersQueryKeyFrom   = "fromBlock"
+	endPointHeadersQueryKeyLimit  = "limit"
+	endPointBalanceProof          = "/balances/proof"
+	endPointBalanceProofQueryKey  = "account"
+
+	endPointPeers = "/node/peers"
 
 	endPointAddPeer              = "/node/peer"
 	endPointAddPeerQueryKeyIP    = "ip"
 	endpointAddPeerQueryKeyPort  = "port"
 	endpointAddPeerQueryKeyMiner = "miner"
 
+	// syncMaxPageBlocks limits how many blocks a sync response holds
+	syncMaxPageBlocks = 100
+	// syncMaxPageHeaders limits how many headers a headers response holds
+	syncMaxPageHeaders = 2000
+	// syncPeerTimeoutSeconds limits how long a sync request to a peer can take
+	syncPeerTimeoutSeconds = 10
+
 	miningIntervalSeconds = 10
+	// miningMaxBlockTXs limits how many pending TXs are mined into one block
+	miningMaxBlockTXs = 500
 )
 
 // PeerNode is node owned by other user
@@ -46,25 +74,58 @@ func (pn PeerNode) TCPAddress() string {
 	return fmt.Sprintf("%s:%d", pn.IP, pn.Port)
 }
 
-// Node is consist of host ledger and smart contract
+// Node is consist of host ledger and smart contract.
+// Node is safe for concurrent use by the HTTP handlers, the sync and the mine goroutines.
 type Node struct {
 	dataDir         string
+	dbBackend       string
 	info            PeerNode
 	state           *database.State
+	stateMu         sync.RWMutex
 	knownPeers      map[string]PeerNode
-	pendingTXs      map[string]database.Tx
-	archivedTXs     map[string]database.Tx
+	knownPeersMu    sync.RWMutex
+	pendingTXs      map[string]database.SignedTx
+	archivedTXs     map[string]database.SignedTx
+	txsMu           sync.Mutex
 	newSyncedBlocks chan database.Block
-	newPendingTXs   chan database.Tx
+	newPendingTXs   chan database.SignedTx
 	isMining        bool
+	isMiningMu      sync.RWMutex
+	log             logger.Logger
+	metrics         *nodeMetrics
+	// metricsPort serves the metrics apart from the API when set
+	metricsPort uint64
+
+	// light nodes follow only block headers and verify
+	// balances and TXs fetched from full peers with proofs
+	isLight bool
+	headers *database.HeaderChain
+
+	// misbehavior scores of known and banned peers by their TCP address
+	peerScores   map[string]peerScore
+	peerScoresMu sync.Mutex
+
+	// blocks announced by peers or by this node, so gossip doesn't loop
+	announcedBlocks   map[database.Hash]time.Time
+	announcedBlocksMu sync.Mutex
+	// blockAnnouncements queues announced blocks for the sync loop to download
+	blockAnnouncements chan blockAnnouncement
+	// importMu serializes importing synced, announced and mined blocks
+	importMu sync.Mutex
+
+	// lifecycle of the running node, stopRun is set while the node runs
+	runMu          sync.Mutex
+	stopRun        context.CancelFunc
+	stopped        chan struct{}
+	backgroundDone <-chan struct{}
 }
 
-// New will return new node
-func New(dataDir string, ip string, port uint64, acc database.Account, bootstrap PeerNode) *Node {
-	knownPeers := make(map[string]PeerNode)
-	knownPeers[bootstrap.TCPAddress()] = bootstrap
-	return &Node{
-		dataDir: dataDir,
+// New will return new node, a node without bootstraps runs as a seed
+// waiting for other nodes to peer with it
+func New(dataDir string, dbBackend string, ip string, port uint64, acc database.Account, bootstraps []PeerNode) *Node {
+	n := &Node{
+		dataDir:   dataDir,
+		dbBackend: dbBackend,
 		info: NewPeerNode(
 			ip,
 			port,
@@ -72,13 +133,48 @@ func New(dataDir string, ip string, port uint64, acc database.Account, bootstrap
 			acc,
 			true,
 		),
-		knownPeers:      knownPeers,
-		pendingTXs:      make(map[string]database.Tx),
-		archivedTXs:     make(map[string]database.Tx),
-		newSyncedBlocks: make(chan database.Block),
-		newPendingTXs:   make(chan database.Tx, 10000),
-		isMining:        false,
+		knownPeers:         make(map[string]PeerNode),
+		pendingTXs:         make(map[string]database.SignedTx),
+		archivedTXs:        make(map[string]database.SignedTx),
+		newSyncedBlocks:    make(chan database.Block),
+		newPendingTXs:      make(chan database.SignedTx, 10000),
+		isMining:           false,
+		peerScores:         make(map[string]peerScore),
+		announcedBlocks:    make(map[database.Hash]time.Time),
+		blockAnnouncements: make(chan blockAnnouncement, gossipMaxQueuedBlocks),
+		log:                logger.Default(),
+	}
+	n.metrics = newNodeMetrics(n)
+
+	for _, bootstrap := range bootstraps {
+		if n.isSelf(bootstrap) {
+			n.log.Warn("Skipping bootstrap, it's this node", "peer", bootstrap.TCPAddress())
+			continue
+		}
+
+		n.knownPeers[bootstrap.TCPAddress()] = bootstrap
 	}
+
+	return n
+}
+
+// NewLight will return new light node, it doesn't mine
+// and keeps only the block headers
+func NewLight(dataDir string, ip string, port uint64, bootstraps []PeerNode) *Node {
+	n := New(dataDir, database.DefaultBackend, ip, port, database.Account{}, bootstraps)
+	n.isLight = true
+
+	return n
+}
+
+// SetLogger will replace the logger of the node and its state, it must be set before Run
+func (n *Node) SetLogger(log logger.Logger) {
+	n.log = log
+}
+
+// SetMetricsPort will serve the metrics on the port instead of the API port, it must be set before Run
+func (n *Node) SetMetricsPort(port uint64) {
+	n.metricsPort = port
 }
 
 // NewPeerNode will return new peer node
@@ -92,153 +188,375 @@ func NewPeerNode(ip string, port uint64, isBootstrap bool, acc database.Account,
 	}
 }
 
-// Run will run rest API
+// ParsePeerNode will return bootstrap peer node from the "[account@]ip:port" address
+func ParsePeerNode(addr string) (PeerNode, error) {
+	acc := database.Account{}
+	if i := strings.LastIndex(addr, "@"); i >= 0 {
+		if !common.IsHexAddress(addr[:i]) {
+			return PeerNode{}, fmt.Errorf("invalid peer '%s', account '%s' isn't an address", addr, addr[:i])
+		}
+
+		acc = database.NewAccount(addr[:i])
+		addr = addr[i+1:]
+	}
+
+	ip, portRaw, err := net.SplitHostPort(addr)
+	if err != nil {
+		return PeerNode{}, fmt.Errorf("invalid peer '%s'. %w", addr, err)
+	}
+
+	port, err := strconv.ParseUint(portRaw, 10, 64)
+	if err != nil || port == 0 || port > 65535 {
+		return PeerNode{}, fmt.Errorf("invalid peer '%s', port '%s' isn't a TCP port", addr, portRaw)
+	}
+
+	if ip == "" {
+		ip = DefaultIP
+	}
+
+	return NewPeerNode(ip, port, true, acc, false), nil
+}
+
+// Run will run rest API until the context is cancelled or the node is shut down.
+// Several nodes can run in one process as each one serves its own ServeMux.
 func (n *Node) Run(ctx context.Context) error {
-	fmt.Println(fmt.Sprintf("Listening on %s:%d", n.info.IP, n.info.Port))
+	ctx, err := n.beginRun(ctx)
+	if err != nil {
+		return err
+	}
+	defer n.endRun()
 
-	state, err := database.NewStateFromDisk(n.dataDir)
+	if n.isLight {
+		return n.runLight(ctx)
+	}
+
+	state, err := database.NewStateFromDiskWithLogger(n.dataDir, n.dbBackend, n.log)
 	if err != nil {
 		return err
 	}
 	defer state.Close()
 
+	n.stateMu.Lock()
 	n.state = state
+	n.stateMu.Unlock()
+
+	n.log.Info("Listening", "ip", n.info.IP, "port", n.info.Port, "height", state.LatestBlock().Header.Number, "hash", state.LatestBlockHash().Hex())
 
-	fmt.Println("blockchain state:")
-	fmt.Printf("- height: %d\n", n.state.LatestBlock().Header.Number)
-	fmt.Printf("- hash: %s\n", n.state.LatestBlockHash().Hex())
+	n.loadPeers()
+	defer n.storePeers()
 
-	go n.sync(ctx)
-	go n.mine(ctx)
+	stopBackground := n.runBackground(n.sync, n.mine)
+	defer stopBackground()
 
-	http.HandleFunc("/balances/list", func(w http.ResponseWriter, r *http.Request) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/balances/list", func(w http.ResponseWriter, r *http.Request) {
 		listBalancesHandler(w, r, state)
 	})
 
-	http.HandleFunc("/tx/add", func(w http.ResponseWriter, r *http.Request) {
+	// the TX routes are method patterns, they share the /tx/ path with the explorer TX lookup
+	mux.HandleFunc("POST /tx/add", func(w http.ResponseWriter, r *http.Request) {
 		txAddHandler(w, r, n)
 	})
 
-	http.HandleFunc(endPointStatus, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc("GET "+endPointTXProof, func(w http.ResponseWriter, r *http.Request) {
+		txProofHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointStatus, func(w http.ResponseWriter, r *http.Request) {
 		statusHandler(w, r, n)
 	})
 
-	http.HandleFunc(endPointSync, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(endPointNextNonce, func(w http.ResponseWriter, r *http.Request) {
+		nextNonceHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointSync, func(w http.ResponseWriter, r *http.Request) {
 		syncHandler(w, r, n)
 	})
 
-	http.HandleFunc(endPointAddPeer, func(w http.ResponseWriter, r *http.Request) {
+	mux.HandleFunc(endPointHeaders, func(w http.ResponseWriter, r *http.Request) {
+		headersHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointBalanceProof, func(w http.ResponseWriter, r *http.Request) {
+		balanceProofHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointAddPeer, func(w http.ResponseWriter, r *http.Request) {
 		addPeerHandler(w, r, n)
 	})
 
-	server := &http.Server{
-		Addr: fmt.Sprintf(":%d", n.info.Port),
+	mux.HandleFunc(endPointPeers, func(w http.ResponseWriter, r *http.Request) {
+		peersHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointGossipBlock, func(w http.ResponseWriter, r *http.Request) {
+		blockAnnounceHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointGossipTX, func(w http.ResponseWriter, r *http.Request) {
+		txAnnounceHandler(w, r, n)
+	})
+
+	mux.HandleFunc("GET "+endPointBlocks, func(w http.ResponseWriter, r *http.Request) {
+		blocksHandler(w, r, n)
+	})
+
+	mux.HandleFunc("GET "+endPointBlockByHash, func(w http.ResponseWriter, r *http.Request) {
+		blockByHashHandler(w, r, n)
+	})
+
+	mux.HandleFunc("GET "+endPointBlockByHeight, func(w http.ResponseWriter, r *http.Request) {
+		blockByHeightHandler(w, r, n)
+	})
+
+	mux.HandleFunc("GET "+endPointTX, func(w http.ResponseWriter, r *http.Request) {
+		txHandler(w, r, n)
+	})
+
+	mux.HandleFunc("GET "+endPointAccount, func(w http.ResponseWriter, r *http.Request) {
+		accountHandler(w, r, n)
+	})
+
+	return n.serveAPI(ctx, mux)
+}
+
+// loadPeers adds peers of the previous run from the peer book
+func (n *Node) loadPeers() {
+	err := n.loadPeerBook()
+	if err != nil {
+		n.log.Error("Unable to load peers of the previous run", "err", err)
 	}
-	go func() {
-		<-ctx.Done()
-		_ = server.Close()
-	}()
+}
 
-	err = server.ListenAndServe()
-	if err != http.ErrServerClosed {
-		return err
+// storePeers persists the peer book
+func (n *Node) storePeers() {
+	err := n.savePeerBook()
+	if err != nil {
+		n.log.Error("Unable to persist peers", "err", err)
 	}
-	return nil
 }
 
 // LatestBlockHash from database
 func (n *Node) LatestBlockHash() database.Hash {
-	return n.state.LatestBlockHash()
+	state := n.getState()
+	if state == nil {
+		return database.Hash{}
+	}
+
+	return state.LatestBlockHash()
+}
+
+// getState return state of the node, nil until the node runs.
+// Goroutines started by Run can use the state field directly.
+func (n *Node) getState() *database.State {
+	n.stateMu.RLock()
+	defer n.stateMu.RUnlock()
+
+	return n.state
 }
 
 // AddPeer will add new peer to known peers
 func (n *Node) AddPeer(peer PeerNode) {
+	n.knownPeersMu.Lock()
+	defer n.knownPeersMu.Unlock()
+
 	n.knownPeers[peer.TCPAddress()] = peer
 }
 
 // RemovePeer remove known peers
 func (n *Node) RemovePeer(peer PeerNode) {
+	n.knownPeersMu.Lock()
+	defer n.knownPeersMu.Unlock()
+
 	delete(n.knownPeers, peer.TCPAddress())
 }
 
 // IsKnownPeer check if a peer is known by bootstrap node
 func (n *Node) IsKnownPeer(peer PeerNode) bool {
-	if peer.IP == n.info.IP && peer.Port == n.info.Port {
+	if n.isSelf(peer) {
 		return true
 	}
 
+	n.knownPeersMu.RLock()
+	defer n.knownPeersMu.RUnlock()
+
 	_, isKnownPeer := n.knownPeers[peer.TCPAddress()]
 	return isKnownPeer
 }
 
-func (n *Node) mine(ctx context.Context) error {
-	var (
-		miningCtx         context.Context
-		stopCurrentMining context.CancelFunc
-	)
+// copyKnownPeers return copy of the known peers by their TCP address
+func (n *Node) copyKnownPeers() map[string]PeerNode {
+	n.knownPeersMu.RLock()
+	defer n.knownPeersMu.RUnlock()
+
+	peers := make(map[string]PeerNode, len(n.knownPeers))
+	for addr, peer := range n.knownPeers {
+		peers[addr] = peer
+	}
+
+	return peers
+}
+
+// isSelf check if the peer is this node, local addresses of this node's port
+// are the same node whatever IP the node was started with
+func (n *Node) isSelf(peer PeerNode) bool {
+	if peer.Port != n.info.Port {
+		return false
+	}
+
+	return peer.IP == n.info.IP || (isLocalIP(peer.IP) && isLocalIP(n.info.IP))
+}
+
+func isLocalIP(ip string) bool {
+	switch ip {
+	case "", "localhost", "0.0.0.0", "::":
+		return true
+	}
+
+	parsed := net.ParseIP(ip)
+	return parsed != nil && parsed.IsLoopback()
+}
+
+func (n *Node) mine(ctx context.Context) {
+	var stopCurrentMining context.CancelFunc
+
+	// a block is mined by one goroutine at a time, it reports back once it's done
+	miningDone := make(chan error, 1)
 
 	ticker := time.NewTicker(time.Second * miningIntervalSeconds)
 	for {
 		select {
 		case <-ticker.C:
+			if n.IsMining() || len(n.getPendingTXsAsArray()) == 0 {
+				continue
+			}
+
+			miningCtx, stopMining := context.WithCancel(ctx)
+			stopCurrentMining = stopMining
+			n.setMining(true)
+
 			go func() {
-				if len(n.pendingTXs) > 0 && !n.isMining {
-					n.isMining = true
-				}
-
-				miningCtx, stopCurrentMining = context.WithCancel(ctx)
-				err := n.minePendingTXs(miningCtx)
-				if err != nil {
-					fmt.Printf("ERROR: %s\n", err)
-				}
-				n.isMining = false
+				defer stopMining()
+				miningDone <- n.minePendingTXs(miningCtx)
 			}()
+		case err := <-miningDone:
+			n.setMining(false)
+
+			if err != nil {
+				n.log.Error("Mining failed", "err", err)
+			}
+		case <-n.newPendingTXs:
+			// the new pending TX is mined on the next tick
 		case block, _ := <-n.newSyncedBlocks:
-			if n.isMining {
+			if n.IsMining() {
 				blockHash, _ := block.Hash()
-				fmt.Printf("\nPeer mined next block '%s' faster :\n", blockHash.Hex())
+				n.log.Info("Peer mined next block faster", "height", block.Header.Number, "hash", blockHash.Hex())
 				n.removeMinedPendingTXs(block)
 				stopCurrentMining()
 			}
 		case <-ctx.Done():
 			ticker.Stop()
-			return nil
+			if n.IsMining() {
+				stopCurrentMining()
+				<-miningDone
+				n.setMining(false)
+			}
+
+			return
 		}
 	}
 }
 
+// IsMining check if the node is mining a block
+func (n *Node) IsMining() bool {
+	n.isMiningMu.RLock()
+	defer n.isMiningMu.RUnlock()
+
+	return n.isMining
+}
+
+func (n *Node) setMining(isMining bool) {
+	n.isMiningMu.Lock()
+	defer n.isMiningMu.Unlock()
+
+	n.isMining = isMining
+}
+
 func (n *Node) minePendingTXs(ctx context.Context) error {
+	txs := n.getPendingTXsToMine()
+
+	// a block synced meanwhile can't mix into the header of the block to mine
+	header, err := n.state.NextBlockHeader(n.info.Account, txs)
+	if err != nil {
+		return err
+	}
+
 	blockToMine := NewPendingBlock(
-		n.state.LatestBlockHash(),
-		n.state.LatestBlock().Header.Number+1,
+		header.Parent,
+		header.Number,
+		header.Difficulty,
 		n.info.Account,
-		n.getPendingTXsAsArray(),
+		header.StateRoot,
+		txs,
 	)
 
-	minedBlock, err := Mine(ctx, blockToMine)
+	start := time.Now()
+	minedBlock, attempts, err := mine(ctx, blockToMine, n.log)
+	n.metrics.observeMining(attempts, time.Since(start))
 	if err != nil {
 		return err
 	}
+	n.metrics.minedBlocks.Inc()
 
 	n.removeMinedPendingTXs(minedBlock)
 
-	_, err = n.state.AddBlock(minedBlock)
+	n.importMu.Lock()
+	_, err = n.addBlock(minedBlock, blockSourceMined)
+	n.importMu.Unlock()
 	if err != nil {
 		return err
 	}
 
+	n.announceBlock(minedBlock.Header, n.info)
+
 	return nil
 }
 
-func (n *Node) removeMinedPendingTXs(block database.Block) {
-	if len(block.TXs) > 0 && len(n.pendingTXs) > 0 {
-		fmt.Println("updateing in memory pending TXS Pool:")
+// addBlock adds the block from the source to the state and records the import metrics
+func (n *Node) addBlock(block database.Block, source string) (database.Hash, error) {
+	start := time.Now()
+	blockHash, err := n.state.AddBlock(block)
+	n.metrics.observeBlockImport(source, time.Since(start), err)
+
+	return blockHash, err
+}
+
+// chainHeight return number of the latest block, or block header of a light node
+func (n *Node) chainHeight() uint64 {
+	if n.isLight {
+		if n.headers == nil {
+			return 0
+		}
+		return n.headers.LatestHeader().Number
+	}
+
+	state := n.getState()
+	if state == nil {
+		return 0
 	}
+	return state.LatestBlock().Header.Number
+}
+
+func (n *Node) removeMinedPendingTXs(block database.Block) {
+	n.txsMu.Lock()
+	defer n.txsMu.Unlock()
 
 	for _, tx := range block.TXs {
 		txHash, _ := tx.Hash()
 		if _, exists := n.pendingTXs[txHash.Hex()]; exists {
-			fmt.Printf("\t-archiving mined TX: %s\n", txHash.Hex())
+			n.log.Debug("Archiving mined TX", "tx", txHash.Hex(), "height", block.Header.Number)
 			n.archivedTXs[txHash.Hex()] = tx
 			delete(n.pendingTXs, txHash.Hex())
 		}
@@ -246,37 +564,194 @@ func (n *Node) removeMinedPendingTXs(block database.Block) {
 }
 
 // AddPendingTX will add pending tx
-func (n *Node) AddPendingTX(tx database.Tx, fromPeer PeerNode) error {
+// only transactions signed by the sender account are accepted
+func (n *Node) AddPendingTX(tx database.SignedTx, fromPeer PeerNode) error {
+	_, err := n.addPendingTX(tx, fromPeer)
+	return err
+}
+
+// addPendingTX adds the TX into the pending pool and announces it to the peers,
+// false is returned when the TX was already pending or mined
+func (n *Node) addPendingTX(tx database.SignedTx, fromPeer PeerNode) (bool, error) {
+	// legacy TXs were only valid in legacy blocks
+	if tx.Version != 0 {
+		return false, fmt.Errorf("%w. TX encoding version '%d' can't be mined anymore", errInvalidTX, tx.Version)
+	}
+
 	txHash, err := tx.Hash()
 	if err != nil {
-		return err
+		return false, err
 	}
 
-	txJSON, err := json.Marshal(tx)
+	ok, err := tx.IsAuthentic()
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	if !ok {
+		return false, fmt.Errorf("%w. Sender '%s' is forged", errInvalidTX, tx.From.String())
+	}
+
+	if tx.Fee < database.MinTxFee {
+		return false, fmt.Errorf("%w. Fee must be at least %d TBB, not %d TBB", errInvalidTX, database.MinTxFee, tx.Fee)
 	}
 
+	if tx.IsCostOverflowing() {
+		return false, fmt.Errorf("%w. Value %d TBB and fee %d TBB overflow the TX cost", errInvalidTX, tx.Value, tx.Fee)
+	}
+
+	// TXs with an already applied nonce are replays and can never be mined
+	if state := n.getState(); state != nil && tx.Nonce < state.GetNextAccountNonce(tx.From) {
+		return false, fmt.Errorf("wrong TX. Sender '%s' nonce '%d' was already used", tx.From.String(), tx.Nonce)
+	}
+
+	n.txsMu.Lock()
 	_, isAlredyPending := n.pendingTXs[txHash.Hex()]
 	_, isArchived := n.archivedTXs[txHash.Hex()]
 
-	if !isAlredyPending && !isArchived {
-		fmt.Printf("added pending tx %s from Peer %s\n", txJSON, fromPeer.TCPAddress())
-		n.pendingTXs[txHash.Hex()] = tx
-		n.newPendingTXs <- tx
+	if isAlredyPending || isArchived {
+		n.txsMu.Unlock()
+		return false, nil
 	}
 
-	return nil
+	n.log.Debug("Added pending TX", "tx", txHash.Hex(), "from", tx.From.String(), "nonce", tx.Nonce, "peer", fromPeer.TCPAddress())
+	n.pendingTXs[txHash.Hex()] = tx
+	n.txsMu.Unlock()
+
+	// the notification is dropped when nobody drains it, the TX stays pending
+	select {
+	case n.newPendingTXs <- tx:
+	default:
+	}
+
+	n.announceTX(tx, fromPeer)
+
+	return true, nil
 }
 
-func (n *Node) getPendingTXsAsArray() []database.Tx {
-	txs := make([]database.Tx, len(n.pendingTXs))
+// refreshPendingTXs returns TXs orphaned by a chain reorg into the pool
+// and archives pending TXs already mined in the canonical chain
+func (n *Node) refreshPendingTXs() {
+	for _, tx := range n.state.PopOrphanedTXs() {
+		txHash, _ := tx.Hash()
+
+		n.txsMu.Lock()
+		delete(n.archivedTXs, txHash.Hex())
+		n.txsMu.Unlock()
+
+		err := n.AddPendingTX(tx, n.info)
+		if err != nil {
+			n.log.Warn("Orphaned TX can't be mined again", "tx", txHash.Hex(), "err", err)
+		}
+	}
+
+	n.txsMu.Lock()
+	defer n.txsMu.Unlock()
+
+	for txHash, tx := range n.pendingTXs {
+		if tx.Nonce < n.state.GetNextAccountNonce(tx.From) {
+			n.archivedTXs[txHash] = tx
+			delete(n.pendingTXs, txHash)
+		}
+	}
+}
+
+// getPendingTX return the pending TX of the hash
+func (n *Node) getPendingTX(txHash database.Hash) (database.SignedTx, bool) {
+	n.txsMu.Lock()
+	defer n.txsMu.Unlock()
+
+	tx, isPending := n.pendingTXs[txHash.Hex()]
+	return tx, isPending
+}
+
+// getPendingTXsAsArray return pending TXs ordered by nonce,
+// so TXs of the same sender can be applied one after another
+func (n *Node) getPendingTXsAsArray() []database.SignedTx {
+	n.txsMu.Lock()
+	txs := make([]database.SignedTx, len(n.pendingTXs))
 
 	i := 0
 	for _, tx := range n.pendingTXs {
 		txs[i] = tx
 		i++
 	}
+	n.txsMu.Unlock()
+
+	sort.Slice(txs, func(i, j int) bool {
+		if txs[i].Nonce == txs[j].Nonce {
+			return txs[i].Time < txs[j].Time
+		}
+
+		return txs[i].Nonce < txs[j].Nonce
+	})
+
+	return txs
+}
+
+// getPendingTXsToMine return at most miningMaxBlockTXs pending TXs
+// prioritizing higher fees, while keeping TXs of each sender in nonce order.
+// TXs which can't be applied on top of the current state stay in the pool.
+func (n *Node) getPendingTXsToMine() []database.SignedTx {
+	sendersTXs := make(map[database.Account][]database.SignedTx)
+	for _, tx := range n.getPendingTXsAsArray() {
+		sendersTXs[tx.From] = append(sendersTXs[tx.From], tx)
+	}
+
+	// of TXs sharing a nonce the one paying the highest fee is mined, so a sender can
+	// replace a stuck TX by a higher fee one, the earlier TX wins only on equal fees
+	for _, accTXs := range sendersTXs {
+		sort.SliceStable(accTXs, func(i, j int) bool {
+			if accTXs[i].Nonce != accTXs[j].Nonce {
+				return accTXs[i].Nonce < accTXs[j].Nonce
+			}
+
+			return accTXs[i].Fee > accTXs[j].Fee
+		})
+	}
+
+	stateBalances, _ := n.state.GetBalances()
+	nextNonces := make(map[database.Account]uint)
+	balances := make(map[database.Account]uint)
+	for acc := range sendersTXs {
+		nextNonces[acc] = n.state.GetNextAccountNonce(acc)
+		balances[acc] = stateBalances[acc]
+	}
+
+	txs := make([]database.SignedTx, 0)
+	for len(txs) < miningMaxBlockTXs {
+		var (
+			best  database.SignedTx
+			found bool
+		)
+
+		for acc, accTXs := range sendersTXs {
+			for len(accTXs) > 0 && accTXs[0].Nonce < nextNonces[acc] {
+				accTXs = accTXs[1:]
+			}
+
+			if len(accTXs) == 0 || accTXs[0].Nonce != nextNonces[acc] || accTXs[0].IsCostOverflowing() || accTXs[0].Cost() > balances[acc] {
+				delete(sendersTXs, acc)
+				continue
+			}
+			sendersTXs[acc] = accTXs
+
+			tx := accTXs[0]
+			if !found || tx.Fee > best.Fee || (tx.Fee == best.Fee && tx.Time < best.Time) {
+				best = tx
+				found = true
+			}
+		}
+
+		if !found {
+			break
+		}
+
+		txs = append(txs, best)
+		nextNonces[best.From]++
+		balances[best.From] -= best.Cost()
+		sendersTXs[best.From] = sendersTXs[best.From][1:]
+	}
 
 	return txs
 }
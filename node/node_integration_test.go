@@ -2,6 +2,9 @@ package node
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
@@ -9,6 +12,8 @@ import (
 
 	"the-blockchain-bar/database"
 	"the-blockchain-bar/fs"
+
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 func TestNode_Run(t *testing.T) {
@@ -18,13 +23,13 @@ func TestNode_Run(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	n := New(datadir, "127.0.0.1", 8085, database.NewAccount("andrej"), PeerNode{})
+	n := New(datadir, database.DefaultBackend, "127.0.0.1", 8085, database.NewAccount(testAndrejAccount), nil)
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
 	defer cancel()
 
 	err = n.Run(ctx)
-	if err.Error() != "http: Server closed" {
-		t.Fatal("node server was suppose to close after 5s")
+	if err != nil {
+		t.Fatal("node server was suppose to close after 5s", err)
 	}
 }
 
@@ -36,6 +41,13 @@ func TestNode_Mining(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	andrejKey, err := generateTestGenesis(datadir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := database.NewAccount(testBabayagaAccount)
+
 	// Required for AddPendingTX() to describe
 	// from what node the TX came from (local node in this case)
 	nInfo := NewPeerNode(
@@ -50,10 +62,11 @@ func TestNode_Mining(t *testing.T) {
 	// Andrej as a miner
 	n := New(
 		datadir,
+		database.DefaultBackend,
 		nInfo.IP,
 		nInfo.Port,
-		database.NewAccount("andrej"),
-		nInfo,
+		andrej,
+		[]PeerNode{nInfo},
 	)
 
 	// Allow the mining to run for 30 mins, in the worst case
@@ -63,15 +76,15 @@ func TestNode_Mining(t *testing.T) {
 	// because the n.Run() few lines below is a blocking call
 	go func() {
 		time.Sleep(time.Second * miningIntervalSeconds / 3)
-		tx := database.NewTx("andrej", "babayaga", 1, "")
+		tx, _ := database.SignTx(database.NewTx(andrej, babayaga, 1, 1, ""), andrejKey)
 		_ = n.AddPendingTX(tx, nInfo)
 	}()
 
 	// Schedule a new TX in 12 seconds from now simulating
 	// that it came in -= while the first TX is being mined
 	go func() {
-		time.Sleep(time.Second*miningIntervalSeconds + 2)
-		tx := database.NewTx("andrej", "babayaga", 2, "")
+		time.Sleep(time.Second * (miningIntervalSeconds + 2))
+		tx, _ := database.SignTx(database.NewTx(andrej, babayaga, 2, 2, ""), andrejKey)
 		_ = n.AddPendingTX(tx, nInfo)
 	}()
 
@@ -82,7 +95,7 @@ func TestNode_Mining(t *testing.T) {
 		for {
 			select {
 			case <-ticker.C:
-				if n.state.LatestBlock().Header.Number == 1 {
+				if n.getState().LatestBlock().Header.Number == 1 {
 					closeNode()
 					return
 				}
@@ -106,6 +119,12 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// babayaga's mining must last long enough for Andrej's block to arrive first
+	andrejKey, err := generateTestGenesis(datadir, testSlowMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// Required for AddPendingTX() to describe
 	// from what node the TX came from (local node in this case)
 	nInfo := NewPeerNode(
@@ -116,26 +135,45 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 		true,
 	)
 
-	andrejAcc := database.NewAccount("andrej")
-	babayagaAcc := database.NewAccount("babayaga")
-	n := New(datadir, nInfo.IP, nInfo.Port, babayagaAcc, nInfo)
+	andrejAcc := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayagaAcc := database.NewAccount(testBabayagaAccount)
+	n := New(datadir, database.DefaultBackend, nInfo.IP, nInfo.Port, babayagaAcc, []PeerNode{nInfo})
 
 	// Allow the test to run for 30 mins in the worst case
 	ctx, closeNode := context.WithTimeout(context.Background(), time.Minute*30)
 
-	tx1 := database.NewTx("andrej", "babayaga", 2, "")
-	tx2 := database.NewTx("andrej", "babayaga", 2, "")
+	tx1, err := database.SignTx(database.NewTx(andrejAcc, babayagaAcc, 1, 1, ""), andrejKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := database.SignTx(database.NewTx(andrejAcc, babayagaAcc, 2, 2, ""), andrejKey)
+	if err != nil {
+		t.Fatal(err)
+	}
 	tx2Hash, _ := tx2.Hash()
 
 	// Pre-mine a valid block without running the `n.Run()`
 
 	// with Andrej as a miner who will receive the block reward
 	// to simulate the block came on the fly from another peer
+	state, err := database.NewStateFromDisk(datadir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stateRoot, err := state.NextStateRoot(andrejAcc, []database.SignedTx{tx1})
+	state.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	validPreMinedPb := NewPendingBlock(
 		database.Hash{},
 		0,
+		testSlowMiningDifficulty,
 		andrejAcc,
-		[]database.Tx{tx1},
+		stateRoot,
+		[]database.SignedTx{tx1},
 	)
 	validSyncedBlock, err := Mine(
 		ctx,
@@ -151,45 +189,54 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 
 		err := n.AddPendingTX(tx1, nInfo)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 
 		err = n.AddPendingTX(tx2, nInfo)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 	}()
 
 	// once the babayaga is mining the block, simulate that
 	// Andrej mined the block with TX1 in it faster
 	go func() {
-		time.Sleep(time.Second * (miningIntervalSeconds + 2))
-		if !n.isMining {
-			t.Fatal("should be mining")
+		if !waitUntil(ctx, func() bool { return n.IsMining() }) {
+			t.Error("should be mining")
+			return
 		}
 
-		_, err := n.state.AddBlock(validSyncedBlock)
+		_, err := n.getState().AddBlock(validSyncedBlock)
 		if err != nil {
-			t.Fatal(err)
+			t.Error(err)
+			return
 		}
 		// Mock the Andrej's block came from a network
 		n.newSyncedBlocks <- validSyncedBlock
 
 		time.Sleep(time.Second * 2)
-		if n.isMining {
-			t.Fatal("synced block should have canceled mining")
+		if n.IsMining() {
+			t.Error("synced block should have canceled mining")
+			return
 		}
 
 		// Mined TX1 by andrej should be removed from mempool
-		_, onlyTX2IsPending := n.pendingTXs[tx2Hash.Hex()]
+		pendingTXs := n.getPendingTXsAsArray()
+		onlyTX2IsPending := false
+		for _, tx := range pendingTXs {
+			txHash, _ := tx.Hash()
+			onlyTX2IsPending = onlyTX2IsPending || txHash == tx2Hash
+		}
 
-		if len(n.pendingTXs) != 1 && !onlyTX2IsPending {
-			t.Fatal("synced block should have canceled mining of already mined TX")
+		if len(pendingTXs) != 1 && !onlyTX2IsPending {
+			t.Error("synced block should have canceled mining of already mined TX")
+			return
 		}
 
-		time.Sleep(time.Second * (miningIntervalSeconds + 2))
-		if !n.isMining {
-			t.Fatal("should be mining again the 1 TX not included in synced block")
+		if !waitUntil(ctx, func() bool { return n.IsMining() || n.getState().LatestBlock().Header.Number == 1 }) {
+			t.Error("should be mining again the 1 TX not included in synced block")
 		}
 	}()
 
@@ -200,7 +247,7 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 		for {
 			select {
 			case <-ticker.C:
-				if n.state.LatestBlock().Header.Number == 1 {
+				if n.getState().LatestBlock().Header.Number == 1 {
 					closeNode()
 					return
 				}
@@ -214,27 +261,30 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 		// Take a snapshot of the DB balances
 		// before the mining is finished and the 2 blocks
 		// are created
-		startingAndrejBalance := n.state.Balances[andrejAcc]
-		startingBabaYagaBalance := n.state.Balances[babayagaAcc]
+		startingBalances, _ := n.getState().GetBalances()
+		startingAndrejBalance := startingBalances[andrejAcc]
+		startingBabaYagaBalance := startingBalances[babayagaAcc]
 
 		// Wait until the 30 mins timeout is reached or
 		// the 2 blocks got already mined and the closeNOde() was triggered
 		<-ctx.Done()
 
-		endAndrejBalance := n.state.Balances[andrejAcc]
-		endBabaYagaBalance := n.state.Balances[babayagaAcc]
+		endBalances, _ := n.getState().GetBalances()
+		endAndrejBalance := endBalances[andrejAcc]
+		endBabaYagaBalance := endBalances[babayagaAcc]
 
 		// in TX1 Andrej transferred 1 TBB token to babayaga
 		// in TX2 Andrej transferred 2 TBB token to babayaga
-		expectedEndAndrejBalance := startingAndrejBalance - tx1.Value - tx2.Value + database.BlockReward
-		expectedEndBabaYagaBalance := startingBabaYagaBalance + tx1.Value + tx2.Value + database.BlockReward
+		// each miner also collects the fee of the TX it mined
+		expectedEndAndrejBalance := startingAndrejBalance - tx1.Cost() - tx2.Cost() + database.BlockReward + tx1.Fee
+		expectedEndBabaYagaBalance := startingBabaYagaBalance + tx1.Value + tx2.Value + database.BlockReward + tx2.Fee
 
 		if endAndrejBalance != expectedEndAndrejBalance {
-			t.Fatalf("Andrej expected end balance is %d not %d", expectedEndAndrejBalance, endAndrejBalance)
+			t.Errorf("Andrej expected end balance is %d not %d", expectedEndAndrejBalance, endAndrejBalance)
 		}
 
 		if endBabaYagaBalance != expectedEndBabaYagaBalance {
-			t.Fatalf("BabaYaga expected end balance is %d not %d", expectedEndBabaYagaBalance, endBabaYagaBalance)
+			t.Errorf("BabaYaga expected end balance is %d not %d", expectedEndBabaYagaBalance, endBabaYagaBalance)
 		}
 
 		t.Logf("Starting Andrej balance: %d", startingAndrejBalance)
@@ -249,7 +299,7 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 		t.Fatal("was suppose to mine 2 pending TX into 2 valid blocks under 30m")
 	}
 
-	if len(n.pendingTXs) != 0 {
+	if len(n.getPendingTXsAsArray()) != 0 {
 		t.Fatal("no pending TXs should be left to mine")
 	}
 }
@@ -257,3 +307,59 @@ func TestNode_MiningStopsOnNewSyncedBlock(t *testing.T) {
 func getTestDataDirPath() string {
 	return filepath.Join(os.TempDir(), ".tbb_test")
 }
+
+// generateTestGenesis writes a genesis into the data dir funding
+// a freshly generated account and the extra accounts,
+// and returns the generated account private key
+func generateTestGenesis(dataDir string, difficulty uint64, extraAccounts ...database.Account) (*ecdsa.PrivateKey, error) {
+	privKey, err := crypto.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+
+	balances := map[database.Account]uint{
+		crypto.PubkeyToAddress(privKey.PublicKey): 1000000,
+	}
+	for _, acc := range extraAccounts {
+		balances[acc] = 1000000
+	}
+
+	genesisJSON, err := json.Marshal(map[string]interface{}{
+		"difficulty": difficulty,
+		"balances":   balances,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	dbDir := filepath.Join(dataDir, "database")
+	err = os.MkdirAll(dbDir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dbDir, "genesis.json"), genesisJSON, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	return privKey, nil
+}
+
+// waitUntil polls the condition until it's met or the context is done
+func waitUntil(ctx context.Context, condition func() bool) bool {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		if condition() {
+			return true
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
@@ -0,0 +1,445 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+func TestNode_PendingTXsToMinePrioritizeFees(t *testing.T) {
+	datadir := getTestDataDirPath()
+	err := fs.RemoveDir(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caesarKey, err := crypto.GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	caesar := crypto.PubkeyToAddress(caesarKey.PublicKey)
+
+	andrejKey, err := generateTestGenesis(datadir, testMiningDifficulty, caesar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := database.NewAccount(testBabayagaAccount)
+
+	n := New(datadir, database.DefaultBackend, "127.0.0.1", 8085, andrej, nil)
+	n.state, err = database.NewStateFromDisk(datadir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.state.Close()
+
+	// nobody drains the full new pending TXs notifications, adding TXs can't block on them
+	for len(n.newPendingTXs) < cap(n.newPendingTXs) {
+		n.newPendingTXs <- database.SignedTx{}
+	}
+
+	txs := []database.Tx{
+		database.NewTx(andrej, babayaga, 1, 1, ""),
+		database.NewTx(andrej, babayaga, 2, 2, ""),
+		// nonce gap, can't be mined until nonce 3 is known
+		database.NewTx(andrej, babayaga, 4, 4, ""),
+	}
+	// a higher fee can't jump ahead of a lower nonce
+	txs[1].Fee = database.MinTxFee * 2
+
+	for _, tx := range txs {
+		signedTx, err := database.SignTx(tx, andrejKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = n.AddPendingTX(signedTx, n.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	caesarTx := database.NewTx(caesar, babayaga, 1, 1, "")
+	caesarTx.Fee = database.MinTxFee * 3
+	signedCaesarTx, err := database.SignTx(caesarTx, caesarKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.AddPendingTX(signedCaesarTx, n.info)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// value and fee wrap around to a cost andrej could pay
+	overflowTx := database.NewTx(andrej, babayaga, math.MaxUint-database.MinTxFee+1, 3, "")
+	signedOverflowTx, err := database.SignTx(overflowTx, andrejKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = n.AddPendingTX(signedOverflowTx, n.info)
+	if !errors.Is(err, errInvalidTX) {
+		t.Fatalf("TX with overflowing cost was suppose to be invalid, got %v", err)
+	}
+
+	toMine := n.getPendingTXsToMine()
+	if len(toMine) != 3 {
+		t.Fatalf("expected 3 TXs to mine, got %d", len(toMine))
+	}
+
+	if toMine[0].From != caesar {
+		t.Fatal("TX with the highest fee was suppose to be mined first")
+	}
+
+	if toMine[1].Nonce != 1 || toMine[2].Nonce != 2 {
+		t.Fatal("andrej TXs to mine were suppose to be in nonce order")
+	}
+}
+
+func TestNode_PendingTXsToMineReplaceByFee(t *testing.T) {
+	datadir := getTestDataDirPath()
+	err := fs.RemoveDir(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	andrejKey, err := generateTestGenesis(datadir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := database.NewAccount(testBabayagaAccount)
+
+	n := New(datadir, database.DefaultBackend, "127.0.0.1", 8085, andrej, nil)
+	n.state, err = database.NewStateFromDisk(datadir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.state.Close()
+
+	now := uint64(time.Now().Unix())
+	newTx := func(value uint, nonce uint, fee uint, txTime uint64) database.SignedTx {
+		tx := database.NewTx(andrej, babayaga, value, nonce, "")
+		tx.Fee = fee
+		tx.Time = txTime
+
+		signedTx, err := database.SignTx(tx, andrejKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return signedTx
+	}
+
+	// a stuck TX replaced by a later one paying a higher fee
+	stuckTx := newTx(1, 1, database.MinTxFee, now)
+	replacingTx := newTx(1, 1, database.MinTxFee*2, now+1)
+	// of TXs paying the same fee the earlier one wins
+	earlierTx := newTx(2, 2, database.MinTxFee, now+2)
+	laterTx := newTx(3, 2, database.MinTxFee, now+3)
+
+	for _, tx := range []database.SignedTx{stuckTx, replacingTx, earlierTx, laterTx} {
+		err = n.AddPendingTX(tx, n.info)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	toMine := n.getPendingTXsToMine()
+	if len(toMine) != 2 {
+		t.Fatalf("expected 2 TXs to mine, got %d", len(toMine))
+	}
+
+	if toMine[0].Fee != database.MinTxFee*2 {
+		t.Fatal("TX with the higher fee was suppose to replace the stuck TX of the same nonce")
+	}
+
+	if toMine[1].Value != 2 {
+		t.Fatal("the earlier of TXs with the same nonce and fee was suppose to be mined")
+	}
+}
+
+func TestNode_SyncHandlerPaginatesBlocks(t *testing.T) {
+	datadir := getTestDataDirPath()
+	err := fs.RemoveDir(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	andrejKey, err := generateTestGenesis(datadir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := database.NewAccount(testBabayagaAccount)
+
+	n := New(datadir, database.DefaultBackend, "127.0.0.1", 8085, andrej, nil)
+	n.state, err = database.NewStateFromDisk(datadir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.state.Close()
+
+	blockHashes := mineTestBlocks(t, n, andrejKey, babayaga, 3)
+
+	syncPage := func(fromBlock database.Hash, limit string) (int, SyncRes) {
+		url := fmt.Sprintf("%s?%s=%s&%s=%s", endPointSync, endPointSyncQueryKeyFromBlock, fromBlock.Hex(), endPointSyncQueryKeyLimit, limit)
+		w := httptest.NewRecorder()
+		syncHandler(w, httptest.NewRequest(http.MethodGet, url, nil), n)
+
+		syncRes := SyncRes{}
+		_ = json.Unmarshal(w.Body.Bytes(), &syncRes)
+
+		return w.Code, syncRes
+	}
+
+	status, page := syncPage(database.Hash{}, "2")
+	if status != http.StatusOK || len(page.Blocks) != 2 || !page.HasMore {
+		t.Fatal("first page was suppose to hold 2 blocks with more to follow")
+	}
+
+	status, page = syncPage(blockHashes[1], "2")
+	if status != http.StatusOK || len(page.Blocks) != 1 || page.HasMore {
+		t.Fatal("last page was suppose to hold only the tip block")
+	}
+
+	status, _ = syncPage(database.Hash{0x01}, "2")
+	if status != http.StatusNotFound {
+		t.Fatalf("sync from an unknown block was suppose to respond %d, not %d", http.StatusNotFound, status)
+	}
+
+	status, _ = syncPage(database.Hash{}, "0")
+	if status != http.StatusBadRequest {
+		t.Fatalf("sync with an invalid limit was suppose to respond %d, not %d", http.StatusBadRequest, status)
+	}
+}
+
+// mineTestBlocks mines blocks of one TX each on top of the node chain
+func mineTestBlocks(t *testing.T, n *Node, fromKey *ecdsa.PrivateKey, to database.Account, count int) []database.Hash {
+	from := crypto.PubkeyToAddress(fromKey.PublicKey)
+
+	blockHashes := make([]database.Hash, 0, count)
+	for i := 0; i < count; i++ {
+		tx, err := database.SignTx(database.NewTx(from, to, 1, n.state.GetNextAccountNonce(from), ""), fromKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header, err := n.state.NextBlockHeader(from, []database.SignedTx{tx})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pb := NewPendingBlock(
+			header.Parent,
+			header.Number,
+			header.Difficulty,
+			from,
+			header.StateRoot,
+			[]database.SignedTx{tx},
+		)
+		block, err := Mine(context.Background(), pb)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		blockHash, err := n.state.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blockHashes = append(blockHashes, blockHash)
+	}
+
+	return blockHashes
+}
+
+func TestNode_NewSkipsItselfAsBootstrap(t *testing.T) {
+	self, err := ParsePeerNode("localhost:8080")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	peer, err := ParsePeerNode(testAndrejAccount + "@127.0.0.1:8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !peer.IsBootstrap || peer.Account != database.NewAccount(testAndrejAccount) {
+		t.Fatal("parsed peer was suppose to be a bootstrap of the account")
+	}
+
+	for _, addr := range []string{"127.0.0.1", "127.0.0.1:0", "0x1@127.0.0.1:8080"} {
+		if _, err := ParsePeerNode(addr); err == nil {
+			t.Fatalf("peer '%s' was suppose to be invalid", addr)
+		}
+	}
+
+	n := New(getTestDataDirPath(), database.DefaultBackend, "", DefaultHTTPPort, database.Account{}, []PeerNode{self, peer})
+	if len(n.knownPeers) != 1 || !n.IsKnownPeer(peer) {
+		t.Fatal("node was suppose to peer only with the other bootstrap")
+	}
+
+	seed := New(getTestDataDirPath(), database.DefaultBackend, DefaultIP, DefaultHTTPPort, database.Account{}, nil)
+	if len(seed.knownPeers) != 0 {
+		t.Fatal("seed node was not suppose to know any peers")
+	}
+}
+
+// TestNode_ConcurrentTXsSyncAndMining is meant to be run with -race
+func TestNode_ConcurrentTXsSyncAndMining(t *testing.T) {
+	datadir := getTestDataDirPath()
+	err := fs.RemoveDir(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	andrejKey, err := generateTestGenesis(datadir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	andrej := crypto.PubkeyToAddress(andrejKey.PublicKey)
+	babayaga := database.NewAccount(testBabayagaAccount)
+
+	n := New(datadir, database.DefaultBackend, "127.0.0.1", 8085, andrej, nil)
+	n.state, err = database.NewStateFromDisk(datadir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n.state.Close()
+
+	server, peer := startTestPeer(t, n, false)
+	defer server.Close()
+
+	targetDataDir := filepath.Join(os.TempDir(), ".tbb_test_concurrent")
+	target := newTestSyncNode(t, datadir, targetDataDir, 8086)
+	defer fs.RemoveDir(targetDataDir)
+	defer target.state.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-n.newPendingTXs:
+			case <-target.newSyncedBlocks:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	syncTarget := func() error {
+		status, err := queryPeerStatus(peer)
+		if err != nil {
+			return err
+		}
+
+		return target.syncBlocks([]peerStatus{{peer, status}})
+	}
+
+	const txsCount = 20
+	var wg sync.WaitGroup
+
+	for nonce := uint(1); nonce <= txsCount; nonce++ {
+		wg.Add(1)
+		go func(nonce uint) {
+			defer wg.Done()
+
+			tx, err := database.SignTx(database.NewTx(andrej, babayaga, 1, nonce, ""), andrejKey)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			reqJSON, err := json.Marshal(TxAddReq{
+				From:  tx.From.String(),
+				To:    tx.To.String(),
+				Value: tx.Value,
+				Fee:   tx.Fee,
+				Nonce: tx.Nonce,
+				Data:  tx.Data,
+				Time:  tx.Time,
+				Sig:   tx.Sig,
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			w := httptest.NewRecorder()
+			txAddHandler(w, httptest.NewRequest(http.MethodPost, "/tx/add", bytes.NewReader(reqJSON)), n)
+			if w.Code != http.StatusOK {
+				t.Errorf("TX '%d' was suppose to be added. %s", nonce, w.Body.String())
+			}
+
+			listBalancesHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/balances/list", nil), n.state)
+		}(nonce)
+	}
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 3; i++ {
+			if len(n.getPendingTXsAsArray()) == 0 {
+				time.Sleep(10 * time.Millisecond)
+				continue
+			}
+
+			err := n.minePendingTXs(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 3; i++ {
+			err := syncTarget()
+			if err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	wg.Wait()
+
+	for i := 0; i < txsCount && len(n.getPendingTXsAsArray()) > 0; i++ {
+		err = n.minePendingTXs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n.state.GetNextAccountNonce(andrej) != txsCount+1 {
+		t.Fatalf("all %d TXs added concurrently were suppose to be mined", txsCount)
+	}
+
+	err = syncTarget()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target.state.LatestBlockHash() != n.state.LatestBlockHash() {
+		t.Fatal("target was suppose to sync all the blocks mined concurrently")
+	}
+}
@@ -0,0 +1,174 @@
+package node
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+const (
+	peerBookFileName = "peers.json"
+	// peerStaleSeconds is how long a peer which doesn't respond is kept in the peer book
+	peerStaleSeconds = 7 * 24 * 60 * 60
+	// peerMaxFailures is how many requests in a row a peer can fail before it's dropped from the peer book
+	peerMaxFailures = 10
+)
+
+// peerBookEntry is a known or banned peer persisted in the peers.json
+type peerBookEntry struct {
+	IP          string           `json:"ip"`
+	Port        uint64           `json:"port"`
+	IsBootstrap bool             `json:"is_bootstrap"`
+	Account     database.Account `json:"account"`
+	LastSeen    int64            `json:"last_seen"`
+	Failures    int              `json:"failures"`
+	Score       int              `json:"score"`
+	BannedUntil int64            `json:"banned_until,omitempty"`
+}
+
+// peerBook is the peers.json content
+type peerBook struct {
+	Peers []peerBookEntry `json:"peers"`
+}
+
+func getPeerBookFilePath(dataDir string) string {
+	return filepath.Join(dataDir, peerBookFileName)
+}
+
+// loadPeerBook adds peers persisted by the previous run into KnownPeers,
+// stale peers are aged out and banned peers stay banned
+func (n *Node) loadPeerBook() error {
+	content, err := ioutil.ReadFile(getPeerBookFilePath(n.dataDir))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var book peerBook
+	err = json.Unmarshal(content, &book)
+	if err != nil {
+		return err
+	}
+
+	n.peerScoresMu.Lock()
+	defer n.peerScoresMu.Unlock()
+
+	now := time.Now()
+	for _, entry := range book.Peers {
+		if isStalePeer(entry, now) {
+			continue
+		}
+
+		peer := NewPeerNode(entry.IP, entry.Port, entry.IsBootstrap, entry.Account, false)
+		if n.isSelf(peer) {
+			continue
+		}
+
+		ps := peerScore{
+			peer:     peer,
+			score:    entry.Score,
+			lastSeen: time.Unix(entry.LastSeen, 0),
+			failures: entry.Failures,
+		}
+		if entry.BannedUntil > 0 {
+			ps.bannedUntil = time.Unix(entry.BannedUntil, 0)
+		}
+		n.peerScores[peer.TCPAddress()] = ps
+
+		if !now.Before(ps.bannedUntil) {
+			n.AddPeer(peer)
+		}
+	}
+
+	return nil
+}
+
+// savePeerBook persists the known and banned peers into the peers.json
+func (n *Node) savePeerBook() error {
+	n.peerScoresMu.Lock()
+
+	now := time.Now()
+	knownPeers := n.copyKnownPeers()
+	book := peerBook{Peers: make([]peerBookEntry, 0, len(knownPeers))}
+
+	addrs := make(map[string]bool)
+	for addr := range knownPeers {
+		addrs[addr] = true
+	}
+	for addr, ps := range n.peerScores {
+		if now.Before(ps.bannedUntil) {
+			addrs[addr] = true
+		}
+	}
+
+	for addr := range addrs {
+		ps := n.peerScores[addr]
+		peer, isKnown := knownPeers[addr]
+		if !isKnown {
+			peer = ps.peer
+		}
+
+		if peer.IP == "" || peer.Port == 0 {
+			continue
+		}
+
+		// a peer heard of but never contacted ages out from the time it was first persisted
+		if ps.lastSeen.IsZero() {
+			ps.peer = peer
+			ps.lastSeen = now
+			n.peerScores[addr] = ps
+		}
+
+		entry := peerBookEntry{
+			IP:          peer.IP,
+			Port:        peer.Port,
+			IsBootstrap: peer.IsBootstrap,
+			Account:     peer.Account,
+			LastSeen:    ps.lastSeen.Unix(),
+			Failures:    ps.failures,
+			Score:       ps.score,
+		}
+		if now.Before(ps.bannedUntil) {
+			entry.BannedUntil = ps.bannedUntil.Unix()
+		}
+
+		if !isStalePeer(entry, now) {
+			book.Peers = append(book.Peers, entry)
+		}
+	}
+
+	n.peerScoresMu.Unlock()
+
+	sort.Slice(book.Peers, func(i, j int) bool {
+		if book.Peers[i].IP == book.Peers[j].IP {
+			return book.Peers[i].Port < book.Peers[j].Port
+		}
+
+		return book.Peers[i].IP < book.Peers[j].IP
+	})
+
+	content, err := json.MarshalIndent(book, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return fs.WriteFileSynced(getPeerBookFilePath(n.dataDir), content)
+}
+
+// isStalePeer check if the peer didn't respond for too long or too many times,
+// banned peers are kept until their ban expires
+func isStalePeer(entry peerBookEntry, now time.Time) bool {
+	if entry.BannedUntil > now.Unix() {
+		return false
+	}
+
+	return entry.Failures >= peerMaxFailures || now.Unix()-entry.LastSeen > peerStaleSeconds
+}
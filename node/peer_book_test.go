@@ -0,0 +1,69 @@
+package node
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+func TestNode_PeerBookPersistsPeersAcrossRestarts(t *testing.T) {
+	datadir := getTestDataDirPath()
+	err := fs.RemoveDir(datadir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.RemoveDir(datadir)
+
+	err = os.MkdirAll(datadir, os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seenPeer := NewPeerNode("127.0.0.1", 8086, false, database.NewAccount(testBabayagaAccount), true)
+	learnedPeer := NewPeerNode("127.0.0.1", 8087, false, database.Account{}, false)
+	stalePeer := NewPeerNode("127.0.0.1", 8088, false, database.Account{}, true)
+	failingPeer := NewPeerNode("127.0.0.1", 8089, false, database.Account{}, true)
+	bannedPeer := NewPeerNode("127.0.0.1", 8090, false, database.Account{}, true)
+
+	n := New(datadir, database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, []PeerNode{seenPeer})
+	for _, peer := range []PeerNode{learnedPeer, stalePeer, failingPeer, bannedPeer} {
+		n.AddPeer(peer)
+	}
+
+	n.rewardPeer(seenPeer)
+	n.peerScores[stalePeer.TCPAddress()] = peerScore{peer: stalePeer, lastSeen: time.Now().Add(-(peerStaleSeconds + 60) * time.Second)}
+	n.peerScores[failingPeer.TCPAddress()] = peerScore{peer: failingPeer, lastSeen: time.Now(), failures: peerMaxFailures}
+	for i := 0; i < 2; i++ {
+		n.penalizePeer(bannedPeer, errInvalidBlock)
+	}
+
+	err = n.savePeerBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	restarted := New(datadir, database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, nil)
+	err = restarted.loadPeerBook()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !restarted.IsKnownPeer(seenPeer) || !restarted.IsKnownPeer(learnedPeer) {
+		t.Fatal("peers of the previous run were suppose to be known after restart")
+	}
+
+	if restarted.knownPeers[seenPeer.TCPAddress()].Account != seenPeer.Account || restarted.knownPeers[seenPeer.TCPAddress()].connected {
+		t.Fatal("restored peer was suppose to keep its account and join again")
+	}
+
+	if restarted.IsKnownPeer(stalePeer) || restarted.IsKnownPeer(failingPeer) {
+		t.Fatal("stale and failing peers were suppose to age out of the peer book")
+	}
+
+	if restarted.IsKnownPeer(bannedPeer) || !restarted.IsBannedPeer(bannedPeer) {
+		t.Fatal("banned peer was suppose to stay banned after restart")
+	}
+}
@@ -0,0 +1,185 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"time"
+)
+
+const (
+	// peerBanScore is the misbehavior score a peer is banned at
+	peerBanScore = 100
+	// peerBanSeconds is how long a banned peer is ignored
+	peerBanSeconds = 10 * 60
+
+	peerPenaltyInvalidBlock = 50
+	peerPenaltyMalformedRes = 25
+	peerPenaltyUnresponsive = 20
+	peerPenaltyInvalidTX    = 10
+	// peerScoreRecovery is how much of the score a responsive peer recovers each sync
+	peerScoreRecovery = 1
+)
+
+var (
+	// errInvalidBlock is wrapped by errors of blocks and headers failing validation
+	errInvalidBlock = errors.New("invalid block")
+	// errInvalidProof is wrapped by errors of Merkle proofs not matching the synced headers
+	errInvalidProof = errors.New("invalid proof")
+	// errInvalidTX is wrapped by errors of TXs which can never be valid
+	errInvalidTX = errors.New("wrong TX")
+	// errMalformedRes is wrapped by errors of peer responses which can't be read
+	errMalformedRes = errors.New("malformed response")
+)
+
+// peerScore is misbehavior of a peer, the peer is banned
+// until bannedUntil when its score reaches peerBanScore
+type peerScore struct {
+	peer        PeerNode
+	score       int
+	bannedUntil time.Time
+	// lastSeen is when the peer last responded, or when it was first heard of
+	lastSeen time.Time
+	// failures counts requests the peer didn't respond to since it last responded
+	failures int
+}
+
+// PeerScoreRes is a known or banned peer with its misbehavior score
+type PeerScoreRes struct {
+	PeerNode
+	Score       int   `json:"score"`
+	IsBanned    bool  `json:"is_banned"`
+	BannedUntil int64 `json:"banned_until,omitempty"`
+}
+
+// PeersRes is a response for the known and banned peers scores
+type PeersRes struct {
+	Peers []PeerScoreRes `json:"peers"`
+}
+
+// penalizePeer raises the peer misbehavior score by the penalty for the error,
+// the peer is removed from KnownPeers and banned once its score reaches peerBanScore
+func (n *Node) penalizePeer(peer PeerNode, err error) {
+	penalty := misbehaviorPenalty(err)
+	if penalty == 0 {
+		return
+	}
+
+	n.peerScoresMu.Lock()
+	defer n.peerScoresMu.Unlock()
+
+	ps := n.peerScores[peer.TCPAddress()]
+	ps.peer = peer
+	ps.score += penalty
+
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		ps.failures++
+	}
+
+	n.log.Debug("Peer misbehavior score raised", "peer", peer.TCPAddress(), "penalty", penalty, "score", ps.score, "err", err)
+
+	if ps.score >= peerBanScore {
+		ps.score = 0
+		ps.bannedUntil = time.Now().Add(peerBanSeconds * time.Second)
+		n.RemovePeer(peer)
+
+		n.log.Warn("Peer was banned", "peer", peer.TCPAddress(), "until", ps.bannedUntil.Format(time.RFC3339), "err", err)
+	}
+
+	n.peerScores[peer.TCPAddress()] = ps
+}
+
+// rewardPeer records the peer responded and lowers its misbehavior score
+func (n *Node) rewardPeer(peer PeerNode) {
+	n.peerScoresMu.Lock()
+	defer n.peerScoresMu.Unlock()
+
+	ps := n.peerScores[peer.TCPAddress()]
+	ps.peer = peer
+	ps.lastSeen = time.Now()
+	ps.failures = 0
+
+	ps.score -= peerScoreRecovery
+	if ps.score < 0 {
+		ps.score = 0
+	}
+	n.peerScores[peer.TCPAddress()] = ps
+}
+
+// IsBannedPeer check if the peer is banned for misbehavior
+func (n *Node) IsBannedPeer(peer PeerNode) bool {
+	n.peerScoresMu.Lock()
+	defer n.peerScoresMu.Unlock()
+
+	return time.Now().Before(n.peerScores[peer.TCPAddress()].bannedUntil)
+}
+
+// unbanExpiredPeers returns peers with an expired ban into KnownPeers
+func (n *Node) unbanExpiredPeers() {
+	n.peerScoresMu.Lock()
+	defer n.peerScoresMu.Unlock()
+
+	for addr, ps := range n.peerScores {
+		if ps.bannedUntil.IsZero() || time.Now().Before(ps.bannedUntil) {
+			continue
+		}
+
+		ps.bannedUntil = time.Time{}
+		n.peerScores[addr] = ps
+
+		n.log.Info("Peer ban expired", "peer", addr)
+		ps.peer.connected = false
+		n.AddPeer(ps.peer)
+	}
+}
+
+// peersScores return known and banned peers ordered by address
+func (n *Node) peersScores() []PeerScoreRes {
+	n.peerScoresMu.Lock()
+	defer n.peerScoresMu.Unlock()
+
+	knownPeers := n.copyKnownPeers()
+	peers := make([]PeerScoreRes, 0, len(knownPeers))
+	for addr, peer := range knownPeers {
+		peers = append(peers, PeerScoreRes{PeerNode: peer, Score: n.peerScores[addr].score})
+	}
+
+	for addr, ps := range n.peerScores {
+		if _, isKnown := knownPeers[addr]; isKnown || !time.Now().Before(ps.bannedUntil) {
+			continue
+		}
+
+		peers = append(peers, PeerScoreRes{
+			PeerNode:    ps.peer,
+			Score:       ps.score,
+			IsBanned:    true,
+			BannedUntil: ps.bannedUntil.Unix(),
+		})
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].TCPAddress() < peers[j].TCPAddress()
+	})
+
+	return peers
+}
+
+// misbehaviorPenalty return score penalty of a peer request error,
+// errors not caused by the peer aren't penalized
+func misbehaviorPenalty(err error) int {
+	var netErr net.Error
+
+	switch {
+	case errors.Is(err, errInvalidBlock), errors.Is(err, errInvalidProof):
+		return peerPenaltyInvalidBlock
+	case errors.Is(err, errMalformedRes):
+		return peerPenaltyMalformedRes
+	case errors.Is(err, errInvalidTX):
+		return peerPenaltyInvalidTX
+	case errors.As(err, &netErr):
+		return peerPenaltyUnresponsive
+	}
+
+	return 0
+}
@@ -0,0 +1,95 @@
+package node
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"the-blockchain-bar/database"
+)
+
+func TestNode_PenalizePeerBansMisbehavingPeer(t *testing.T) {
+	n := New(getTestDataDirPath(), database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, nil)
+
+	peer := NewPeerNode("127.0.0.1", 8086, false, database.Account{}, true)
+	n.AddPeer(peer)
+
+	_, err := readPeerTestRes(`{"blocks": "not blocks"}`)
+	n.penalizePeer(peer, err)
+	if n.peerScores[peer.TCPAddress()].score != peerPenaltyMalformedRes {
+		t.Fatalf("malformed response was suppose to raise the peer score to %d", peerPenaltyMalformedRes)
+	}
+
+	n.rewardPeer(peer)
+	if n.peerScores[peer.TCPAddress()].score != peerPenaltyMalformedRes-peerScoreRecovery {
+		t.Fatal("responsive peer was suppose to recover part of its score")
+	}
+
+	n.penalizePeer(peer, fmt.Errorf("wrong TX nonce"))
+	if n.peerScores[peer.TCPAddress()].score != peerPenaltyMalformedRes-peerScoreRecovery {
+		t.Fatal("errors not caused by the peer were not suppose to be penalized")
+	}
+
+	for i := 0; i < 2; i++ {
+		n.penalizePeer(peer, fmt.Errorf("block rejected. %w", errInvalidBlock))
+	}
+
+	if !n.IsBannedPeer(peer) || n.IsKnownPeer(peer) {
+		t.Fatal("peer serving invalid blocks was suppose to be banned and removed from KnownPeers")
+	}
+
+	err = n.syncKnownPeers(StatusRes{KnownPeers: map[string]PeerNode{peer.TCPAddress(): peer}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n.IsKnownPeer(peer) {
+		t.Fatal("banned peer was not suppose to be added from peer status")
+	}
+
+	w := httptest.NewRecorder()
+	addPeerHandler(w, httptest.NewRequest(http.MethodGet, fmt.Sprintf("%s?%s=%s&%s=%d", endPointAddPeer, endPointAddPeerQueryKeyIP, peer.IP, endpointAddPeerQueryKeyPort, peer.Port), nil), n)
+
+	addPeerRes := AddPeerRes{}
+	_ = json.Unmarshal(w.Body.Bytes(), &addPeerRes)
+	if addPeerRes.Success || n.IsKnownPeer(peer) {
+		t.Fatal("banned peer was not suppose to join KnownPeers")
+	}
+
+	w = httptest.NewRecorder()
+	peersHandler(w, httptest.NewRequest(http.MethodGet, endPointPeers, nil), n)
+
+	peersRes := PeersRes{}
+	_ = json.Unmarshal(w.Body.Bytes(), &peersRes)
+	if len(peersRes.Peers) != 1 {
+		t.Fatal("peers response was suppose to list the banned peer")
+	}
+
+	for _, p := range peersRes.Peers {
+		if p.IsBanned != (p.TCPAddress() == peer.TCPAddress()) {
+			t.Fatalf("peer '%s' was suppose to be banned only if it served invalid blocks", p.TCPAddress())
+		}
+	}
+
+	ps := n.peerScores[peer.TCPAddress()]
+	ps.bannedUntil = time.Now().Add(-time.Second)
+	n.peerScores[peer.TCPAddress()] = ps
+
+	n.unbanExpiredPeers()
+	if n.IsBannedPeer(peer) || !n.IsKnownPeer(peer) {
+		t.Fatal("peer was suppose to return into KnownPeers once its ban expired")
+	}
+}
+
+func readPeerTestRes(body string) (SyncRes, error) {
+	w := httptest.NewRecorder()
+	w.WriteString(body)
+
+	syncRes := SyncRes{}
+	err := readRes(w.Result(), &syncRes)
+
+	return syncRes, err
+}
@@ -2,119 +2,407 @@ package node
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"math/big"
 	"net/http"
-	"the-blockchain-bar/database"
+	"sort"
+	"sync"
 	"time"
+
+	"the-blockchain-bar/database"
 )
 
-func (n *Node) sync(ctx context.Context) error {
+// errUnknownBlock is returned when a peer doesn't know the block to sync from
+var errUnknownBlock = errors.New("unknown block")
+
+// errForkMismatch is returned when a peer serves blocks of another fork than the synced headers,
+// the peer may have reorganized since its status so it isn't penalized
+var errForkMismatch = errors.New("blocks of another fork")
+
+// syncHTTPClient times out requests to peers,
+// so a stalled peer doesn't hold the sync and its block range is retried on another peer
+var syncHTTPClient = &http.Client{Timeout: syncPeerTimeoutSeconds * time.Second}
+
+func (n *Node) sync(ctx context.Context) {
 	ticker := time.NewTicker(10 * time.Second)
 
 	for {
 		select {
 		case <-ticker.C:
-			n.doSync()
+			n.doSync(ctx)
+			n.storePeers()
+		case announcement := <-n.blockAnnouncements:
+			err := n.importAnnouncedBlock(announcement)
+			if err != nil {
+				n.log.Warn("Importing announced block failed", "peer", announcement.peer.TCPAddress(), "err", err)
+			}
 		case <-ctx.Done():
 			ticker.Stop()
+			return
 		}
 	}
 }
 
-func (n *Node) doSync() {
-	for _, peer := range n.knownPeers {
-		if n.info.IP == peer.IP && n.info.Port == peer.Port {
+// peerStatus is a reachable peer with its latest status
+type peerStatus struct {
+	peer   PeerNode
+	status StatusRes
+}
+
+// doSync queries status of every known peer, downloads blocks of
+// the best peer chain from all the peers and syncs their peers and TXs
+func (n *Node) doSync(ctx context.Context) {
+	start := time.Now()
+	defer func() {
+		n.metrics.syncDuration.Observe(time.Since(start).Seconds())
+	}()
+
+	n.unbanExpiredPeers()
+
+	knownPeers := n.copyKnownPeers()
+	peers := make([]peerStatus, 0, len(knownPeers))
+	for _, peer := range knownPeers {
+		if ctx.Err() != nil {
+			return
+		}
+
+		if n.isSelf(peer) {
 			continue
 		}
 
-		fmt.Printf("Searching for new Peers and their Blocks and Peers: '%s'\n", peer.TCPAddress())
+		n.log.Debug("Searching for new peers and their blocks", "peer", peer.TCPAddress())
 
+		// an unresponsive peer is removed from KnownPeers once banned
 		status, err := queryPeerStatus(peer)
 		if err != nil {
-			fmt.Printf("error: %s\n", err)
-			fmt.Printf("Peer '%s' was removed from KnownPeers\n", peer.TCPAddress())
-			n.RemovePeer(peer)
+			n.log.Warn("Querying peer status failed", "peer", peer.TCPAddress(), "err", err)
+			n.penalizePeer(peer, err)
 			continue
 		}
+		n.rewardPeer(peer)
 
 		err = n.joinKnownPeers(peer)
 		if err != nil {
-			fmt.Printf("error: %s\n", err)
+			n.log.Warn("Joining peer failed", "peer", peer.TCPAddress(), "err", err)
+			n.penalizePeer(peer, err)
 			continue
 		}
 
-		err = n.syncBlocks(peer, status)
+		peers = append(peers, peerStatus{peer, status})
+	}
+
+	if len(peers) == 0 || ctx.Err() != nil {
+		return
+	}
+
+	err := n.syncBlocks(peers)
+	if err != nil {
+		n.log.Warn("Syncing blocks failed", "err", err)
+	}
+
+	peersHeight := uint64(0)
+	for _, p := range peers {
+		if p.status.Number > peersHeight {
+			peersHeight = p.status.Number
+		}
+	}
+	n.metrics.observeSyncLag(peersHeight, n.state.LatestBlock().Header.Number)
+
+	for _, p := range peers {
+		err = n.syncKnownPeers(p.status)
 		if err != nil {
-			fmt.Printf("error: %s\n", err)
+			n.log.Warn("Syncing known peers failed", "peer", p.peer.TCPAddress(), "err", err)
 			continue
 		}
 
-		err = n.syncBlocks(peer, status)
+		err = n.syncPendingTXs(p.peer, p.status.PendingTXs)
 		if err != nil {
-			fmt.Printf("error: %s\n", err)
+			n.log.Error("Syncing pending TXs failed", "peer", p.peer.TCPAddress(), "err", err)
 			continue
 		}
+	}
+}
 
-		err = n.syncKnownPeers(status)
-		if err != nil {
-			fmt.Printf("error: %s\n", err)
+// syncBlocks syncs headers first from the peer with the most cumulative work,
+// then downloads the block bodies in parallel ranges from the peers
+// and applies them in order
+func (n *Node) syncBlocks(peers []peerStatus) error {
+	n.importMu.Lock()
+	defer n.importMu.Unlock()
+
+	var err error
+	for _, best := range rankPeersByWork(peers) {
+		// if the peer has no blocks or we already know its latest block, try the next one
+		if best.status.Hash.IsEmpty() || n.state.HasBlock(best.status.Hash) {
 			continue
 		}
 
-		err = n.syncPendingTXs(peer, status.PendingTXs)
+		n.log.Info("Found new blocks", "height", best.status.Number, "hash", best.status.Hash.Hex(), "peer", best.peer.TCPAddress())
+
+		// the headers are verified page by page as they are fetched,
+		// so a peer can't fill the memory with invalid headers
+		verifier := n.state.NewHeadersVerifier()
+		hashes := make([]database.Hash, 0)
+
+		var headers []database.BlockHeader
+		headers, err = fetchHeadersFromForkPoint(best.peer, n.state.BlockLocator(), best.status.Number, func(page []database.BlockHeader) error {
+			pageHashes, err := verifier.Verify(page)
+			if err != nil {
+				return fmt.Errorf("headers from peer '%s' rejected. %w. %s", best.peer.TCPAddress(), errInvalidBlock, err.Error())
+			}
+
+			hashes = append(hashes, pageHashes...)
+			return nil
+		})
 		if err != nil {
-			fmt.Printf("ERROR: %s\n", err)
+			n.log.Warn("Fetching headers failed", "peer", best.peer.TCPAddress(), "err", err)
+			n.penalizePeer(best.peer, err)
 			continue
 		}
 
-		return
+		return n.syncBlocksOfHeaders(peers, best, headers, hashes)
 	}
+
+	return err
 }
 
-func (n *Node) syncBlocks(peer PeerNode, status StatusRes) error {
-	localBlockNumber := n.state.LatestBlock().Header.Number
+// rankPeersByWork return the peers from the most cumulative work,
+// peers of the same work are ranked by height
+func rankPeersByWork(peers []peerStatus) []peerStatus {
+	ranked := make([]peerStatus, len(peers))
+	copy(ranked, peers)
 
-	//if the peer has no blocks, ignore it
-	if status.Hash.IsEmpty() {
-		return nil
+	sort.SliceStable(ranked, func(i, j int) bool {
+		workCmp := peerWork(ranked[i].status).Cmp(peerWork(ranked[j].status))
+		if workCmp != 0 {
+			return workCmp > 0
+		}
+
+		return ranked[i].status.Number > ranked[j].status.Number
+	})
+
+	return ranked
+}
+
+// peerWork return the status cumulative work, a status without work has none
+func peerWork(status StatusRes) *big.Int {
+	if status.Work == nil {
+		return big.NewInt(0)
 	}
 
-	// if the peer has less blocks than us, ignore it
-	if status.Number < localBlockNumber {
-		return nil
+	return status.Work
+}
+
+// syncBlocksOfHeaders downloads the blocks of the headers synced from the best peer
+func (n *Node) syncBlocksOfHeaders(peers []peerStatus, best peerStatus, headers []database.BlockHeader, hashes []database.Hash) error {
+	// blocks are requested only from peers with their latest block in the synced headers
+	headerIndexes := make(map[database.Hash]int, len(hashes))
+	for i, hash := range hashes {
+		headerIndexes[hash] = i
 	}
 
-	// if it's the genesis block and we already synced it, ignore it
-	if status.Number == 0 && !n.state.LatestBlockHash().IsEmpty() {
-		return nil
+	// blocks of a competing branch are kept aside until
+	// the branch has more work and the chain reorganizes
+	defer n.refreshPendingTXs()
+
+	// a window of ranges is downloaded at once, one range per peer,
+	// so catching up on a long chain doesn't hold it in memory
+	windowBlocks := syncMaxPageBlocks * len(peers)
+	for start := 0; start < len(headers); start += windowBlocks {
+		end := start + windowBlocks
+		if end > len(headers) {
+			end = len(headers)
+		}
+
+		rangesCount := (end - start + syncMaxPageBlocks - 1) / syncMaxPageBlocks
+		ranges := make([][]database.Block, rangesCount)
+		rangesPeers := make([]PeerNode, rangesCount)
+		errs := make([]error, rangesCount)
+		var wg sync.WaitGroup
+
+		for i := 0; i < rangesCount; i++ {
+			from := start + i*syncMaxPageBlocks
+			to := from + syncMaxPageBlocks
+			if to > end {
+				to = end
+			}
+
+			wg.Add(1)
+			go func(i, from, to int) {
+				defer wg.Done()
+				ranges[i], rangesPeers[i], errs[i] = n.fetchBlocksRange(rangePeers(peers, best, headerIndexes, to-1, i), headers[from].Parent, hashes[from:to])
+			}(i, from, to)
+		}
+
+		wg.Wait()
+
+		for i, blocks := range ranges {
+			if errs[i] != nil {
+				return errs[i]
+			}
+
+			// the TX and state roots of every block are verified against
+			// our own replay, so a peer disagreeing on balances is rejected
+			for _, block := range blocks {
+				blockHash, err := n.addBlock(block, blockSourceSync)
+				if err != nil {
+					// the block matches the header chain, so both the peer
+					// serving the headers and the block served an invalid block
+					err = fmt.Errorf("block '%d' from peer '%s' rejected. %w. %s", block.Header.Number, rangesPeers[i].TCPAddress(), errInvalidBlock, err.Error())
+					n.penalizePeer(rangesPeers[i], err)
+					if rangesPeers[i].TCPAddress() != best.peer.TCPAddress() {
+						n.penalizePeer(best.peer, err)
+					}
+
+					return err
+				}
+
+				if n.state.LatestBlockHash() == blockHash {
+					n.notifySyncedBlock(block)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// rangePeers return peers with the latest block in the synced headers at or after the range
+// last header, so peers of competing forks aren't asked for blocks they don't have.
+// The peers are rotated so parallel ranges are first requested from different peers.
+func rangePeers(peers []peerStatus, best peerStatus, headerIndexes map[database.Hash]int, lastIndex int, rangeIndex int) []PeerNode {
+	rangePeers := []PeerNode{best.peer}
+	for _, p := range peers {
+		if p.peer.TCPAddress() == best.peer.TCPAddress() {
+			continue
+		}
+
+		index, isSynced := headerIndexes[p.status.Hash]
+		if isSynced && index >= lastIndex {
+			rangePeers = append(rangePeers, p.peer)
+		}
 	}
 
-	newBlocksCount := status.Number - localBlockNumber
-	if localBlockNumber == 0 && status.Number == 0 {
-		newBlocksCount = 1
+	offset := rangeIndex % len(rangePeers)
+	return append(rangePeers[offset:], rangePeers[:offset]...)
+}
+
+// fetchBlocksRange fetches blocks of the header hashes following the block,
+// from the first peer answering with the expected blocks in time.
+// It return the blocks with the peer which served them.
+func (n *Node) fetchBlocksRange(peers []PeerNode, fromBlock database.Hash, hashes []database.Hash) ([]database.Block, PeerNode, error) {
+	var err error
+	for _, peer := range peers {
+		var blocks []database.Block
+		blocks, err = fetchBlocksRangeFromPeer(peer, fromBlock, hashes)
+		if err == nil {
+			return blocks, peer, nil
+		}
+
+		n.log.Warn("Fetching blocks failed", "peer", peer.TCPAddress(), "err", err)
+		n.penalizePeer(peer, err)
 	}
-	fmt.Printf("found %d new blocks from peer %s\n", newBlocksCount, peer.TCPAddress())
 
-	blocks, err := fetchBlocksFromPeer(peer, n.state.LatestBlockHash())
+	return nil, PeerNode{}, fmt.Errorf("no peer served %d blocks after block '%x'. %s", len(hashes), fromBlock, err.Error())
+}
+
+func fetchBlocksRangeFromPeer(peer PeerNode, fromBlock database.Hash, hashes []database.Hash) ([]database.Block, error) {
+	page, err := fetchBlocksFromPeer(peer, fromBlock, uint64(len(hashes)))
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("peer '%s' didn't serve blocks after block '%x'. %w", peer.TCPAddress(), fromBlock, err)
+	}
+
+	if len(page.Blocks) > len(hashes) {
+		return nil, fmt.Errorf("peer '%s' served %d blocks after block '%x' instead of %d. %w", peer.TCPAddress(), len(page.Blocks), fromBlock, len(hashes), errMalformedRes)
+	}
+
+	if len(page.Blocks) < len(hashes) {
+		return nil, fmt.Errorf("peer '%s' served %d blocks after block '%x' instead of %d. %w", peer.TCPAddress(), len(page.Blocks), fromBlock, len(hashes), errForkMismatch)
 	}
 
-	for _, block := range blocks {
-		_, err = n.state.AddBlock(block)
+	for i, block := range page.Blocks {
+		blockHash, err := block.Hash()
 		if err != nil {
-			return err
+			return nil, err
+		}
+
+		if blockHash != hashes[i] {
+			return nil, fmt.Errorf("peer '%s' served block '%d' not matching the synced headers. %w", peer.TCPAddress(), block.Header.Number, errForkMismatch)
 		}
-		n.newSyncedBlocks <- block
 	}
 
-	return nil
+	return page.Blocks, nil
+}
+
+// fetchHeadersFromForkPoint fetches headers following the latest of the
+// locator blocks the peer knows, up to the height the peer announced
+func fetchHeadersFromForkPoint(peer PeerNode, locator []database.Hash, height uint64, verify func(page []database.BlockHeader) error) ([]database.BlockHeader, error) {
+	for _, hash := range locator {
+		page, err := fetchHeadersFromPeer(peer, hash, syncMaxPageHeaders)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(page.Headers) > 0 {
+			return fetchHeadersPages(peer, page, height, verify)
+		}
+	}
+
+	page, err := fetchHeadersFromPeer(peer, database.Hash{}, syncMaxPageHeaders)
+	if err != nil {
+		return nil, err
+	}
+
+	return fetchHeadersPages(peer, page, height, verify)
+}
+
+// fetchHeadersPages verifies the first page of headers and fetches the following pages
+// until the peer has no more headers. The headers must be numbered one after another
+// up to the announced height, so a peer can't stream endless headers.
+func fetchHeadersPages(peer PeerNode, page HeadersRes, height uint64, verify func(page []database.BlockHeader) error) ([]database.BlockHeader, error) {
+	headers := make([]database.BlockHeader, 0, len(page.Headers))
+	for {
+		for i, header := range page.Headers {
+			if i > 0 && header.Number != page.Headers[i-1].Number+1 {
+				return nil, fmt.Errorf("peer '%s' served header '%d' out of order. %w", peer.TCPAddress(), header.Number, errMalformedRes)
+			}
+
+			if header.Number > height {
+				return nil, fmt.Errorf("peer '%s' served header '%d' above its announced height '%d'. %w", peer.TCPAddress(), header.Number, height, errMalformedRes)
+			}
+		}
+
+		err := verify(page.Headers)
+		if err != nil {
+			return nil, err
+		}
+		headers = append(headers, page.Headers...)
+
+		if !page.HasMore || len(page.Headers) == 0 {
+			return headers, nil
+		}
+
+		lastHash, err := page.Headers[len(page.Headers)-1].Hash()
+		if err != nil {
+			return nil, err
+		}
+
+		page, err = fetchHeadersFromPeer(peer, lastHash, syncMaxPageHeaders)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(page.Headers) > 0 && page.Headers[0].Parent != lastHash {
+			return nil, fmt.Errorf("peer '%s' served headers not following header '%x'. %w", peer.TCPAddress(), lastHash, errMalformedRes)
+		}
+	}
 }
 
 func (n *Node) syncKnownPeers(status StatusRes) error {
 	for _, statusPeer := range status.KnownPeers {
-		if !n.IsKnownPeer(statusPeer) {
-			fmt.Printf("found new peer %s\n", statusPeer.TCPAddress())
+		if !n.IsKnownPeer(statusPeer) && !n.IsBannedPeer(statusPeer) {
+			n.log.Info("Found new peer", "peer", statusPeer.TCPAddress())
 			n.AddPeer(statusPeer)
 		}
 	}
@@ -122,10 +410,13 @@ func (n *Node) syncKnownPeers(status StatusRes) error {
 	return nil
 }
 
-func (n *Node) syncPendingTXs(peer PeerNode, txs []database.Tx) error {
+// syncPendingTXs adds pending TXs of the peer, TXs which can never
+// be valid are penalized while stale TXs are skipped
+func (n *Node) syncPendingTXs(peer PeerNode, txs []database.SignedTx) error {
 	for _, tx := range txs {
 		err := n.AddPendingTX(tx, peer)
-		if err != nil {
+		if errors.Is(err, errInvalidTX) {
+			n.penalizePeer(peer, err)
 			return err
 		}
 	}
@@ -148,7 +439,7 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 		n.info.Port,
 	)
 
-	res, err := http.Get(url)
+	res, err := syncHTTPClient.Get(url)
 	if err != nil {
 		return err
 	}
@@ -162,10 +453,8 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 		return fmt.Errorf(addPeerRes.Error)
 	}
 
-	knownPeer := n.knownPeers[peer.TCPAddress()]
-	knownPeer.connected = addPeerRes.Success
-
-	n.AddPeer(knownPeer)
+	peer.connected = addPeerRes.Success
+	n.AddPeer(peer)
 
 	if !addPeerRes.Success {
 		return fmt.Errorf("unable to join KnownPeers of '%s'", peer.TCPAddress())
@@ -176,7 +465,7 @@ func (n *Node) joinKnownPeers(peer PeerNode) error {
 
 func queryPeerStatus(peer PeerNode) (StatusRes, error) {
 	url := fmt.Sprintf("http://%s%s", peer.TCPAddress(), endPointStatus)
-	res, err := http.Get(url)
+	res, err := syncHTTPClient.Get(url)
 	if err != nil {
 		return StatusRes{}, err
 	}
@@ -190,27 +479,74 @@ func queryPeerStatus(peer PeerNode) (StatusRes, error) {
 	return statusRes, nil
 }
 
-func fetchBlocksFromPeer(peer PeerNode, fromBlock database.Hash) ([]database.Block, error) {
-	fmt.Printf("imporint blocks from Peer %s... \n", peer.TCPAddress())
-
+// fetchBlocksFromPeer fetches a page of canonical blocks following the block,
+// errUnknownBlock is returned when the peer doesn't know the block
+func fetchBlocksFromPeer(peer PeerNode, fromBlock database.Hash, limit uint64) (SyncRes, error) {
 	url := fmt.Sprintf(
-		"http://%s%s?%s=%s",
+		"http://%s%s?%s=%s&%s=%d",
 		peer.TCPAddress(),
 		endPointSync,
 		endPointSyncQueryKeyFromBlock,
 		fromBlock.Hex(),
+		endPointSyncQueryKeyLimit,
+		limit,
 	)
 
-	res, err := http.Get(url)
+	res, err := syncHTTPClient.Get(url)
 	if err != nil {
-		return nil, err
+		return SyncRes{}, err
+	}
+
+	if res.StatusCode == http.StatusNotFound {
+		res.Body.Close()
+		return SyncRes{}, errUnknownBlock
+	}
+
+	if res.StatusCode != http.StatusOK {
+		errRes := ErrRes{}
+		err = readRes(res, &errRes)
+		if err != nil {
+			return SyncRes{}, err
+		}
+
+		return SyncRes{}, fmt.Errorf("peer '%s' responded with error. %s", peer.TCPAddress(), errRes.Error)
 	}
 
 	syncRes := SyncRes{}
 	err = readRes(res, &syncRes)
 	if err != nil {
-		return nil, err
+		return SyncRes{}, err
+	}
+
+	return syncRes, nil
+}
+
+func fetchHeadersFromPeer(peer PeerNode, fromBlock database.Hash, limit uint64) (HeadersRes, error) {
+	headersRes := HeadersRes{}
+	err := getPeerRes(peer, fmt.Sprintf("%s?%s=%s&%s=%d", endPointHeaders, endPointHeadersQueryKeyFrom, fromBlock.Hex(), endPointHeadersQueryKeyLimit, limit), &headersRes)
+	if err != nil {
+		return HeadersRes{}, err
+	}
+
+	return headersRes, nil
+}
+
+// getPeerRes reads response of the peer endpoint, an error response is returned as error
+func getPeerRes(peer PeerNode, endpoint string, resBody interface{}) error {
+	res, err := syncHTTPClient.Get(fmt.Sprintf("http://%s%s", peer.TCPAddress(), endpoint))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		errRes := ErrRes{}
+		err = readRes(res, &errRes)
+		if err != nil {
+			return err
+		}
+
+		return fmt.Errorf("peer '%s' responded with error. %s", peer.TCPAddress(), errRes.Error)
 	}
 
-	return syncRes.Blocks, nil
+	return readRes(res, resBody)
 }
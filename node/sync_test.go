@@ -0,0 +1,325 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+func TestNode_SyncBlocksHeadersFirstRetriesOnAnotherPeer(t *testing.T) {
+	sourceDataDir := getTestDataDirPath()
+	err := fs.RemoveDir(sourceDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	andrejKey, err := generateTestGenesis(sourceDataDir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := New(sourceDataDir, database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, nil)
+	source.state, err = database.NewStateFromDisk(sourceDataDir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.state.Close()
+
+	blockHashes := mineTestBlocks(t, source, andrejKey, database.NewAccount(testBabayagaAccount), 5)
+
+	goodServer, goodPeer := startTestPeer(t, source, false)
+	defer goodServer.Close()
+
+	// the stalled peer serves status and headers but fails serving blocks
+	stalledServer, stalledPeer := startTestPeer(t, source, true)
+	defer stalledServer.Close()
+
+	targetDataDir := filepath.Join(os.TempDir(), ".tbb_test_sync")
+	target := newTestSyncNode(t, sourceDataDir, targetDataDir, 8086)
+	defer fs.RemoveDir(targetDataDir)
+	defer target.state.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-target.newSyncedBlocks:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	status := StatusRes{
+		Hash:   source.state.LatestBlockHash(),
+		Number: source.state.LatestBlock().Header.Number,
+	}
+
+	err = target.syncBlocks([]peerStatus{{stalledPeer, status}, {goodPeer, status}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target.state.LatestBlockHash() != blockHashes[len(blockHashes)-1] {
+		t.Fatal("blocks failed by the stalled peer were suppose to be downloaded from the other peer")
+	}
+}
+
+func TestNode_SyncBlocksFromPeerWithMostWork(t *testing.T) {
+	sourceDataDir := getTestDataDirPath()
+	err := fs.RemoveDir(sourceDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.RemoveDir(sourceDataDir)
+
+	andrejKey, err := generateTestGenesis(sourceDataDir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := New(sourceDataDir, database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, nil)
+	source.state, err = database.NewStateFromDisk(sourceDataDir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.state.Close()
+
+	blockHashes := mineTestBlocks(t, source, andrejKey, database.NewAccount(testBabayagaAccount), 5)
+
+	targetDataDir := filepath.Join(os.TempDir(), ".tbb_test_sync")
+	target := newTestSyncNode(t, sourceDataDir, targetDataDir, 8086)
+	defer fs.RemoveDir(targetDataDir)
+	defer target.state.Close()
+
+	blocks, err := source.state.GetBlocksAfter(database.Hash{}, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, block := range blocks {
+		_, err = target.state.AddBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-target.newSyncedBlocks:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	sourceServer, sourcePeer := startTestPeer(t, source, false)
+	defer sourceServer.Close()
+
+	knownServer, knownPeer := startTestPeer(t, source, false)
+	defer knownServer.Close()
+
+	// the peer claims the most work but its tip is already synced
+	known := peerStatus{knownPeer, StatusRes{Hash: blockHashes[2], Number: 2, Work: big.NewInt(1000)}}
+	// a higher chain of less work, the peer doesn't respond if it's asked
+	lighter := peerStatus{NewPeerNode("127.0.0.1", 1, false, database.Account{}, true), StatusRes{Hash: database.Hash{9}, Number: 50, Work: big.NewInt(1)}}
+	heavier := peerStatus{sourcePeer, StatusRes{Hash: blockHashes[4], Number: 4, Work: source.state.LatestBlockWork()}}
+
+	err = target.syncBlocks([]peerStatus{lighter, known, heavier})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if target.state.LatestBlockHash() != blockHashes[4] {
+		t.Fatal("blocks of the peer with the most work were suppose to be synced")
+	}
+
+	if target.peerScores[lighter.peer.TCPAddress()].score != 0 {
+		t.Fatal("the peer of the lighter chain was not suppose to be asked for headers")
+	}
+}
+
+// newTestSyncNode returns a node with an empty chain of the source node genesis
+func newTestSyncNode(t *testing.T, sourceDataDir string, dataDir string, port uint64) *Node {
+	copyTestGenesis(t, sourceDataDir, dataDir)
+
+	n := New(dataDir, database.DefaultBackend, "127.0.0.1", port, database.Account{}, nil)
+
+	var err error
+	n.state, err = database.NewStateFromDisk(dataDir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return n
+}
+
+// copyTestGenesis creates an empty data dir with the genesis of the source data dir
+func copyTestGenesis(t *testing.T, sourceDataDir string, dataDir string) {
+	err := fs.RemoveDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	genesisJSON, err := ioutil.ReadFile(filepath.Join(sourceDataDir, "database", "genesis.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(dataDir, "database"), os.ModePerm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dataDir, "database", "genesis.json"), genesisJSON, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTestPeer serves sync endpoints of the node on a local test server
+func startTestPeer(t *testing.T, n *Node, failBlocks bool) (*httptest.Server, PeerNode) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc(endPointStatus, func(w http.ResponseWriter, r *http.Request) {
+		statusHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointHeaders, func(w http.ResponseWriter, r *http.Request) {
+		headersHandler(w, r, n)
+	})
+
+	mux.HandleFunc(endPointSync, func(w http.ResponseWriter, r *http.Request) {
+		if failBlocks {
+			writeErrRes(w, errors.New("peer is stalled"))
+			return
+		}
+
+		syncHandler(w, r, n)
+	})
+
+	server := httptest.NewServer(mux)
+
+	return server, testServerPeer(t, server)
+}
+
+// testServerPeer return the peer node listening on the test server address
+func testServerPeer(t *testing.T, server *httptest.Server) PeerNode {
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host, portRaw, err := net.SplitHostPort(serverURL.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	port, err := strconv.ParseUint(portRaw, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return NewPeerNode(host, port, false, database.Account{}, true)
+}
+
+func TestNode_FetchHeadersInPages(t *testing.T) {
+	sourceDataDir := getTestDataDirPath()
+	err := fs.RemoveDir(sourceDataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.RemoveDir(sourceDataDir)
+
+	andrejKey, err := generateTestGenesis(sourceDataDir, testMiningDifficulty)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	source := New(sourceDataDir, database.DefaultBackend, "127.0.0.1", 8085, database.Account{}, nil)
+	source.state, err = database.NewStateFromDisk(sourceDataDir, database.DefaultBackend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer source.state.Close()
+
+	blockHashes := mineTestBlocks(t, source, andrejKey, database.NewAccount(testBabayagaAccount), 3)
+
+	server, peer := startTestPeer(t, source, false)
+	defer server.Close()
+
+	page, err := fetchHeadersFromPeer(peer, database.Hash{}, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(page.Headers) != 2 || !page.HasMore {
+		t.Fatalf("a page of 2 headers with more to follow was suppose to be served, got %d headers", len(page.Headers))
+	}
+
+	pages := 0
+	verifyPage := func(page []database.BlockHeader) error {
+		pages++
+		return nil
+	}
+
+	headers, err := fetchHeadersPages(peer, page, source.state.LatestBlock().Header.Number, verifyPage)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(headers) != len(blockHashes) || pages != 2 {
+		t.Fatalf("%d headers were suppose to be fetched and verified in 2 pages, not %d in %d pages", len(blockHashes), len(headers), pages)
+	}
+
+	_, err = fetchHeadersPages(peer, page, 1, verifyPage)
+	if !errors.Is(err, errMalformedRes) {
+		t.Fatalf("headers above the announced height were suppose to be rejected, got %v", err)
+	}
+
+	res, err := http.Get(fmt.Sprintf("%s%s?%s=%s&%s=0", server.URL, endPointHeaders, endPointHeadersQueryKeyFrom, database.Hash{}.Hex(), endPointHeadersQueryKeyLimit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("a zero limit was suppose to be rejected, got status %d", res.StatusCode)
+	}
+}
+
+func TestRangePeers_SkipsPeersOfOtherForks(t *testing.T) {
+	hashes := []database.Hash{{1}, {2}, {3}}
+	headerIndexes := map[database.Hash]int{hashes[0]: 0, hashes[1]: 1, hashes[2]: 2}
+
+	best := peerStatus{NewPeerNode("127.0.0.1", 8081, false, database.Account{}, true), StatusRes{Hash: hashes[2], Number: 3}}
+	behind := peerStatus{NewPeerNode("127.0.0.1", 8082, false, database.Account{}, true), StatusRes{Hash: hashes[0], Number: 1}}
+	synced := peerStatus{NewPeerNode("127.0.0.1", 8083, false, database.Account{}, true), StatusRes{Hash: hashes[1], Number: 2}}
+	// as high as the best peer but on a competing fork
+	fork := peerStatus{NewPeerNode("127.0.0.1", 8084, false, database.Account{}, true), StatusRes{Hash: database.Hash{4}, Number: 3}}
+
+	peers := rangePeers([]peerStatus{best, behind, synced, fork}, best, headerIndexes, 1, 0)
+	if len(peers) != 2 || peers[0].TCPAddress() != best.peer.TCPAddress() || peers[1].TCPAddress() != synced.peer.TCPAddress() {
+		t.Fatalf("only the best and synced peers were suppose to serve the range, got %v", peers)
+	}
+
+	err := fmt.Errorf("peer served block '2' not matching the synced headers. %w", errForkMismatch)
+	if misbehaviorPenalty(err) != 0 {
+		t.Fatal("a peer on another fork was not suppose to be penalized")
+	}
+}
@@ -0,0 +1,76 @@
+package wallet
+
+import (
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+
+	"the-blockchain-bar/database"
+)
+
+const keystoreDirName = "keystore"
+
+// GetKeystoreDirPath return path of keystore inside the data dir
+func GetKeystoreDirPath(dataDir string) string {
+	return filepath.Join(dataDir, keystoreDirName)
+}
+
+// NewKeystoreAccount will generate new key
+// encrypted with the password and stored in keystore
+func NewKeystoreAccount(dataDir, password string) (database.Account, error) {
+	ks := keystore.NewKeyStore(GetKeystoreDirPath(dataDir), keystore.StandardScryptN, keystore.StandardScryptP)
+	acc, err := ks.NewAccount(password)
+	if err != nil {
+		return database.Account{}, err
+	}
+
+	return acc.Address, nil
+}
+
+// ListAccounts return all accounts stored in keystore
+func ListAccounts(dataDir string) []database.Account {
+	ks := keystore.NewKeyStore(GetKeystoreDirPath(dataDir), keystore.StandardScryptN, keystore.StandardScryptP)
+
+	accounts := make([]database.Account, 0)
+	for _, acc := range ks.Accounts() {
+		accounts = append(accounts, acc.Address)
+	}
+
+	return accounts
+}
+
+// UnlockKey will decrypt account key with the password
+func UnlockKey(dataDir string, acc database.Account, password string) (*ecdsa.PrivateKey, error) {
+	ks := keystore.NewKeyStore(GetKeystoreDirPath(dataDir), keystore.StandardScryptN, keystore.StandardScryptP)
+
+	keystoreAcc, err := ks.Find(accounts.Account{Address: acc})
+	if err != nil {
+		return nil, fmt.Errorf("account '%s' not found in keystore. %s", acc.String(), err.Error())
+	}
+
+	keyJSON, err := ioutil.ReadFile(keystoreAcc.URL.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := keystore.DecryptKey(keyJSON, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return key.PrivateKey, nil
+}
+
+// SignTxWithKeystoreAccount will unlock account key and sign the transaction
+func SignTxWithKeystoreAccount(tx database.Tx, dataDir string, acc database.Account, password string) (database.SignedTx, error) {
+	privKey, err := UnlockKey(dataDir, acc, password)
+	if err != nil {
+		return database.SignedTx{}, err
+	}
+
+	return database.SignTx(tx, privKey)
+}
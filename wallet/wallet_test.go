@@ -0,0 +1,63 @@
+package wallet
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"the-blockchain-bar/database"
+	"the-blockchain-bar/fs"
+)
+
+const testKeystorePwd = "security123"
+
+func TestSignTxWithKeystoreAccount(t *testing.T) {
+	dataDir := filepath.Join(os.TempDir(), ".tbb_wallet_test")
+	err := fs.RemoveDir(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.RemoveDir(dataDir)
+
+	andrej, err := NewKeystoreAccount(dataDir, testKeystorePwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accounts := ListAccounts(dataDir)
+	if len(accounts) != 1 || accounts[0] != andrej {
+		t.Fatalf("keystore was suppose to list only account '%s'", andrej.String())
+	}
+
+	babayaga := database.NewAccount("0x22ba1f80452e6220c7cc6ea2d1e3eeddac5f694a")
+	tx := database.NewTx(andrej, babayaga, 100, 1, "")
+
+	_, err = SignTxWithKeystoreAccount(tx, dataDir, andrej, "wrong password")
+	if err == nil {
+		t.Fatal("unlocking key with a wrong password was suppose to fail")
+	}
+
+	signedTx, err := SignTxWithKeystoreAccount(tx, dataDir, andrej, testKeystorePwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ok, err := signedTx.IsAuthentic()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ok {
+		t.Fatal("signed TX was suppose to be authentic")
+	}
+
+	signedTx.From = babayaga
+	ok, err = signedTx.IsAuthentic()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok {
+		t.Fatal("TX with forged sender was suppose to be rejected")
+	}
+}